@@ -0,0 +1,33 @@
+//Command goference loads rule files and runs an interactive shell for
+//asserting, retracting and querying facts.
+//
+//Usage:
+//
+//	goference [rule-file ...]
+//
+//Type help at the prompt for a list of commands.
+package main
+
+import "fmt"
+import "os"
+
+import "github.com/Alan-Shaw/goference/engine"
+
+func main() {
+
+	sh := newShell(&engine.Engine{}, os.Stdout)
+
+	for _, filename := range os.Args[1:] {
+		err := sh.load(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	err := sh.run(os.Stdin, true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import "bufio"
+import "fmt"
+import "io"
+import "path/filepath"
+import "strconv"
+import "strings"
+
+import "github.com/Alan-Shaw/goference/engine"
+import "github.com/Alan-Shaw/goference/parser"
+import "github.com/Alan-Shaw/goference/rulebase"
+
+const helpText = `commands:
+  assert <object> <attribute> <value>    add a fact
+  retract <object> <attribute> <value>   remove a fact
+  infer [<object>|* [<attribute>]]       list inferences
+  facts [<object>|* [<attribute>]]       list facts in memory
+  why <object> <attribute> <value>       show how a fact was derived
+  whynot <rule>                          show how far a rule has got in matching
+  rules                                  list the rules
+  rule <id>: ... => ...                  define a rule
+  undefine <rule>                        remove a rule and withdraw its inferences
+  load <file>                            define the rules in a file (.json and .yaml too)
+  strategy depth|breadth|lex|mea|random [<seed>]
+                                         choose how rules of equal salience are ordered
+  help                                   show this text
+  quit                                   leave the shell
+string values must be quoted, e.g. assert patientXYZ has-symptom "fever"
+rules may end with "call print" to report when they fire or are withdrawn`
+
+type shell struct {
+	engine *engine.Engine
+	out    io.Writer
+}
+
+func newShell(e *engine.Engine, out io.Writer) *shell {
+
+	sh := &shell{engine: e, out: out}
+
+	//rules can report their firings with: call print
+	e.RegisterAction("print",
+		func(ruleId string, bindings engine.Bindings) error {
+			fmt.Fprintf(sh.out, "%s fired: %s\n", ruleId, bindings.String())
+			return nil
+		},
+		func(ruleId string, bindings engine.Bindings) error {
+			fmt.Fprintf(sh.out, "%s withdrawn: %s\n", ruleId, bindings.String())
+			return nil
+		})
+	return sh
+}
+
+//run reads commands until the input ends or quit is entered;
+//errors in individual commands are reported and do not stop the shell
+func (sh *shell) run(in io.Reader, prompt bool) error {
+
+	scanner := bufio.NewScanner(in)
+	for {
+		if prompt {
+			fmt.Fprint(sh.out, "> ")
+		}
+		if !scanner.Scan() {
+			break
+		}
+		quit, err := sh.execute(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(sh.out, "error: %s\n", err)
+		}
+		if quit {
+			return nil
+		}
+	}
+	if prompt {
+		fmt.Fprintln(sh.out)
+	}
+	return scanner.Err()
+}
+
+func (sh *shell) execute(line string) (quit bool, err error) {
+
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return false, nil
+	}
+
+	command := line
+	args := ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		command = line[:i]
+		args = strings.TrimSpace(line[i:])
+	}
+
+	switch command {
+	case "assert":
+		fct, err := parser.ParseFact(args)
+		if err != nil {
+			return false, err
+		}
+		return false, sh.engine.Assert(fct)
+	case "retract":
+		fct, err := parser.ParseFact(args)
+		if err != nil {
+			return false, err
+		}
+		return false, sh.engine.Retract(fct)
+	case "infer":
+		objectId, attribute, err := filterArgs(args)
+		if err != nil {
+			return false, err
+		}
+		list, err := sh.engine.GetInferences(objectId, attribute)
+		if err != nil {
+			return false, err
+		}
+		sh.printFacts(list)
+	case "facts":
+		objectId, attribute, err := filterArgs(args)
+		if err != nil {
+			return false, err
+		}
+		list, err := sh.engine.GetFacts(objectId, attribute)
+		if err != nil {
+			return false, err
+		}
+		sh.printFacts(list)
+	case "why":
+		fct, err := parser.ParseFact(args)
+		if err != nil {
+			return false, err
+		}
+		return false, sh.why(fct)
+	case "whynot":
+		d, err := sh.engine.WhyNot(args)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprint(sh.out, d.String())
+	case "rules":
+		for _, r := range sh.engine.Rules() {
+			fmt.Fprint(sh.out, parser.Format(r))
+		}
+	case "rule":
+		_, err := parser.Load(sh.engine, line)
+		return false, err
+	case "undefine":
+		return false, sh.engine.Undefine(args)
+	case "load":
+		if args == "" {
+			return false, fmt.Errorf("load: file name expected")
+		}
+		return false, sh.load(args)
+	case "strategy":
+		return false, sh.strategy(args)
+	case "help":
+		fmt.Fprintln(sh.out, helpText)
+	case "quit", "exit":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown command %q (type help for a list)", command)
+	}
+	return false, nil
+}
+
+func (sh *shell) load(filename string) error {
+
+	var err error
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json", ".yaml", ".yml":
+		_, err = rulebase.LoadRules(sh.engine, filename)
+	default:
+		_, err = parser.LoadFile(sh.engine, filename)
+	}
+	return err
+}
+
+func (sh *shell) strategy(args string) error {
+
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("strategy: a strategy name and optional seed expected")
+	}
+	for s := engine.Depth; s.String() != ""; s++ {
+		if s.String() != fields[0] {
+			continue
+		}
+		if len(fields) == 2 {
+			seed, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("strategy: invalid seed %q", fields[1])
+			}
+			sh.engine.SetSeed(seed)
+		}
+		return sh.engine.SetStrategy(s)
+	}
+	return fmt.Errorf("strategy: unknown strategy %q", fields[0])
+}
+
+func (sh *shell) printFacts(list []engine.Fact) {
+
+	for _, fct := range list {
+		fmt.Fprintln(sh.out, fct.String())
+	}
+	fmt.Fprintf(sh.out, "(%d)\n", len(list))
+}
+
+func (sh *shell) why(fct engine.Fact) error {
+
+	explanation, err := sh.engine.Explain(fct)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(sh.out, explanation.String())
+	return nil
+}
+
+//filterArgs reads the optional object and attribute of infer and facts
+func filterArgs(args string) (objectId string, attribute string, err error) {
+
+	fields := strings.Fields(args)
+	if len(fields) > 2 {
+		return "", "", fmt.Errorf("at most an object and an attribute expected")
+	}
+	if len(fields) > 0 && fields[0] != "*" {
+		objectId = strings.Trim(fields[0], `"`)
+	}
+	if len(fields) > 1 && fields[1] != "*" {
+		attribute = strings.Trim(fields[1], `"`)
+	}
+	return objectId, attribute, nil
+}
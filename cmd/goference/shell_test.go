@@ -0,0 +1,80 @@
+package main
+
+import "bytes"
+import "strings"
+import "testing"
+
+import "github.com/Alan-Shaw/goference/engine"
+
+func TestShell(t *testing.T) {
+
+	script := `
+rule adult: ?p age >= 18, not * curfew = "on" => ?p may-drive "true"
+assert ann age 21
+assert bob age 12
+infer * may-drive
+facts ann
+why ann may-drive "true"
+why ann age 21
+whynot adult
+retract ann age 21
+infer
+rules
+rule watch: ?p may-drive = "true" => call print
+assert dan age 30
+retract dan age 30
+undefine watch
+undefine watch
+rule adult: ?p age > 65 => ?p retired "true"
+rules
+strategy lex
+strategy chaos
+frobnicate
+quit
+assert carl age 40
+`
+	var out bytes.Buffer
+	sh := newShell(&engine.Engine{}, &out)
+	err := sh.run(strings.NewReader(script), false)
+	if err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+
+	expected := `O ann A may-drive V true
+(1)
+O ann A age V 21
+O ann A may-drive V true
+(2)
+O ann A may-drive V true
+  inferred by adult
+    [0] ?p age GE 18: O ann A age V 21 (asserted)
+    [1] not * curfew EQ "on": no matching fact
+O ann A age V 21 (asserted)
+rule adult
+  [0] ?p age GE 18: 1 fact
+  [1] not * curfew EQ "on": satisfied (no facts)
+  match 1: fired
+    [0] O ann A age V 21
+    [1] satisfied
+(0)
+rule adult:
+	?p age >= 18,
+	not * curfew = "on"
+=>
+	?p may-drive "true"
+watch fired: ?p=dan
+watch withdrawn: ?p=dan
+error: Undefine: rule watch is not defined
+error: 1:1: Rule adult is already defined
+rule adult:
+	?p age >= 18,
+	not * curfew = "on"
+=>
+	?p may-drive "true"
+error: strategy: unknown strategy "chaos"
+error: unknown command "frobnicate" (type help for a list)
+`
+	if out.String() != expected {
+		t.Errorf("Test Shell: expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
@@ -0,0 +1,119 @@
+package engine
+
+import "fmt"
+import "sort"
+import "strings"
+
+//Bindings maps the variables of a rule to the values they are bound to by a match
+type Bindings map[Variable]interface{}
+
+func (b Bindings) String() string {
+
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		keys = append(keys, string(k))
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("?%s=%v", k, b[Variable(k)])
+	}
+	return strings.Join(parts, " ")
+}
+
+//ActionFunc is a Go function called by a rule; ruleId identifies the rule
+//and bindings holds the values of its variables in the match that fired it.
+//It is called while the engine is changing, so it must not call the engine.
+type ActionFunc func(ruleId string, bindings Bindings) error
+
+//Action calls a registered Go function when its rule fires
+type Action struct {
+	Name string //as given to RegisterAction
+}
+
+type registeredAction struct {
+	fire ActionFunc
+	undo ActionFunc
+}
+
+//RegisterAction makes a Go function available to the RHS of rules under the given name.
+//fire is called each time a rule naming the action fires. Inferences are withdrawn when
+//a fact that the match depended on is retracted, but the engine cannot withdraw whatever
+//fire did; instead it calls undo (if it is not nil) with the same bindings. An action
+//registered under an existing name replaces it for rules defined afterwards.
+func (engine *Engine) RegisterAction(name string, fire ActionFunc, undo ActionFunc) error {
+
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
+	if name == "" {
+		return fmt.Errorf("RegisterAction: name is empty")
+	}
+	if fire == nil {
+		return fmt.Errorf("RegisterAction: %s has no function", name)
+	}
+	if engine.actions == nil {
+		engine.actions = make(map[string]registeredAction)
+	}
+	engine.actions[name] = registeredAction{fire: fire, undo: undo}
+	return nil
+}
+
+//bindings collects the value of every variable from a complete token
+func (node *pNode) bindings(tok *token) Bindings {
+
+	b := make(Bindings, len(node.testNetwork))
+	for v, tests := range node.testNetwork {
+		for _, tst := range tests {
+			f := tok.incoming[tst.tokenIndex]
+			if f == nil || f == node.parentEngine.nullFact {
+				continue
+			}
+			if tst.objectElseValue {
+				b[v] = f.ObjectId
+			} else {
+				b[v] = f.Value
+			}
+			break
+		}
+	}
+	return b
+}
+
+//callActions runs the actions of a token that is firing
+func (node *pNode) callActions(tok *token) error {
+
+	if len(node.actions) == 0 {
+		return nil
+	}
+	tok.bindings = node.bindings(tok)
+	for _, a := range node.actions {
+		err := a.fire(node.ruleId, tok.bindings)
+		if err != nil {
+			return fmt.Errorf("Action failure in %s: %s", node.ruleId, err)
+		}
+	}
+	return nil
+}
+
+//undoActions runs the undo functions of a token that fired and has been damaged
+func (tok *token) undoActions() error {
+
+	if tok.bindings == nil {
+		return nil //never fired
+	}
+	bindings := tok.bindings
+	tok.bindings = nil
+	node := tok.containedBy
+	for _, a := range node.actions {
+		if a.undo == nil {
+			continue
+		}
+		err := a.undo(node.ruleId, bindings)
+		if err != nil {
+			return fmt.Errorf("Action failure in %s: %s", node.ruleId, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package engine
+
+import "fmt"
+import "testing"
+
+func TestActions(t *testing.T) {
+
+	var calls []string
+	var p Variable = "p"
+
+	testEngine := Engine{}
+
+	feverRule := Rule{
+		Id: "fever",
+		LHS: []Condition{
+			Condition{ObjectId: p, Attribute: "temperature", Comparator: GT, Value: 100.0},
+			Condition{NotExists: true, ObjectId: "", Attribute: "maintenance", Comparator: EQ, Value: "on"},
+		},
+		RHS:     []Inference{Inference{ObjectId: p, Attribute: "has", Value: "fever"}},
+		Actions: []Action{Action{Name: "alert"}},
+	}
+
+	err := testEngine.Define(feverRule)
+	if err == nil {
+		t.Errorf("Test unregistered: expected an error")
+	}
+	if len(testEngine.productions) != 0 {
+		t.Errorf("Test unregistered: rule was partly defined")
+	}
+
+	err = testEngine.RegisterAction("alert",
+		func(ruleId string, bindings Bindings) error {
+			calls = append(calls, fmt.Sprintf("fire %s %s", ruleId, bindings.String()))
+			return nil
+		},
+		func(ruleId string, bindings Bindings) error {
+			calls = append(calls, fmt.Sprintf("undo %s %s", ruleId, bindings.String()))
+			return nil
+		})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = testEngine.Define(feverRule)
+	if err != nil {
+		t.Fatalf("Error defining rule %s: %s\n", feverRule.Id, err)
+	}
+
+	steps := []struct {
+		assert   bool
+		fct      Fact
+		expected []string
+	}{
+		{true, Fact{"patient1", "temperature", 101.5}, []string{"fire fever ?p=patient1"}},
+		{true, Fact{"patient2", "temperature", 98.6}, nil},
+		{true, Fact{"ward", "maintenance", "on"}, []string{"undo fever ?p=patient1"}},
+		{false, Fact{"ward", "maintenance", "on"}, []string{"fire fever ?p=patient1"}},
+		{false, Fact{"patient1", "temperature", 101.5}, []string{"undo fever ?p=patient1"}},
+	}
+
+	for i, step := range steps {
+		calls = nil
+		if step.assert {
+			err = testEngine.Assert(step.fct)
+		} else {
+			err = testEngine.Retract(step.fct)
+		}
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		if fmt.Sprint(calls) != fmt.Sprint(step.expected) {
+			t.Errorf("Test step %d: expected %v, got %v\n", i+1, step.expected, calls)
+		}
+	}
+
+	//errors from an action are returned to the caller
+	err = testEngine.RegisterAction("fail", func(ruleId string, bindings Bindings) error {
+		return fmt.Errorf("out of paper")
+	}, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = testEngine.Define(Rule{
+		Id:      "print",
+		LHS:     []Condition{Condition{ObjectId: p, Attribute: "report", Comparator: EQ, Value: "due"}},
+		Actions: []Action{Action{Name: "fail"}},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = testEngine.Assert(Fact{"patient1", "report", "due"})
+	if err == nil {
+		t.Errorf("Test failing action: expected an error")
+	}
+}
@@ -0,0 +1,217 @@
+package engine
+
+import "container/heap"
+import "fmt"
+import "math/rand"
+import "sort"
+
+//Strategy decides which of the activations on the agenda fires next
+//when they have the same salience
+type Strategy int
+
+const ( //enumeration
+	Depth   Strategy = iota //newest activation first (the default)
+	Breadth                 //oldest activation first
+	Lex                     //activation with the most recent facts first
+	Mea                     //activation with the most recent fact for its first condition first, then as Lex
+	Random                  //any activation, chosen by a seeded random source
+)
+
+func (s Strategy) String() string {
+
+	switch s {
+	case Depth:
+		return "depth"
+	case Breadth:
+		return "breadth"
+	case Lex:
+		return "lex"
+	case Mea:
+		return "mea"
+	case Random:
+		return "random"
+	default:
+		return ""
+	}
+}
+
+//SetStrategy changes the conflict resolution strategy of the engine
+func (engine *Engine) SetStrategy(s Strategy) error {
+
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
+	if s.String() == "" {
+		return fmt.Errorf("SetStrategy: unknown strategy %d", int(s))
+	}
+	engine.strategy = s
+	heap.Init(agendaHeap{engine}) //the order has changed
+	return nil
+}
+
+//SetSeed seeds the source used by the Random strategy (which otherwise uses 1)
+func (engine *Engine) SetSeed(seed int64) {
+
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
+	engine.seed(seed)
+}
+
+func (engine *Engine) seed(seed int64) {
+	engine.random = rand.New(rand.NewSource(seed))
+}
+
+//an activation is a complete token waiting on the agenda for its rule to fire
+type activation struct {
+	tok *token
+	seq uint64 //when the activation was created (larger is newer)
+	recency []uint64 //time tags of the token's facts, most recent first
+	fired bool
+	index int //in the agenda, while it is there
+}
+
+//agendaHeap keeps the agenda of an engine as a heap (see container/heap), with the
+//activation that precedes all of the others first
+type agendaHeap struct {
+	engine *Engine
+}
+
+func (h agendaHeap) Len() int {
+
+	return len(h.engine.agenda)
+}
+
+func (h agendaHeap) Less(i, j int) bool {
+
+	return h.engine.precedes(h.engine.agenda[i], h.engine.agenda[j])
+}
+
+func (h agendaHeap) Swap(i, j int) {
+
+	agenda := h.engine.agenda
+	agenda[i], agenda[j] = agenda[j], agenda[i]
+	agenda[i].index = i
+	agenda[j].index = j
+}
+
+func (h agendaHeap) Push(x interface{}) {
+
+	act := x.(*activation)
+	act.index = len(h.engine.agenda)
+	h.engine.agenda = append(h.engine.agenda, act)
+}
+
+func (h agendaHeap) Pop() interface{} {
+
+	last := len(h.engine.agenda) - 1
+	act := h.engine.agenda[last]
+	h.engine.agenda[last] = nil
+	h.engine.agenda = h.engine.agenda[:last]
+	act.index = -1
+	return act
+}
+
+func (engine *Engine) addActivation(tok *token) {
+
+	engine.clock++
+	act := &activation{tok: tok, seq: engine.clock}
+	for _, f := range tok.incoming {
+		act.recency = append(act.recency, engine.timetags[f])
+	}
+	sort.Slice(act.recency, func(i, j int) bool { return act.recency[i] > act.recency[j] })
+
+	tok.activation = act
+	heap.Push(agendaHeap{engine}, act)
+}
+
+//deactivate takes a token's activation off the agenda if it has not fired yet
+func (engine *Engine) deactivate(tok *token) {
+
+	act := tok.activation
+	if act == nil {
+		return
+	}
+	tok.activation = nil
+	if act.fired {
+		return
+	}
+	heap.Remove(agendaHeap{engine}, act.index)
+}
+
+//markFired takes a token's activation off the agenda as if it had fired
+func (engine *Engine) markFired(tok *token) {
+
+	act := tok.activation
+	if act == nil {
+		return
+	}
+	if !act.fired {
+		heap.Remove(agendaHeap{engine}, act.index)
+	}
+	act.fired = true
+}
+
+//selectActivation removes the next activation to fire from the agenda,
+//or returns nil if the agenda is empty
+func (engine *Engine) selectActivation() *activation {
+
+	if len(engine.agenda) == 0 {
+		return nil
+	}
+
+	best := 0 //the first in the heap, unless the choice is random
+	if engine.strategy == Random {
+		if engine.random == nil {
+			engine.seed(1)
+		}
+		//any of the activations with the highest salience, which means looking at all of them
+		var candidates []int
+		top := engine.agenda[0].tok.containedBy.salience
+		for i, act := range engine.agenda {
+			if act.tok.containedBy.salience == top {
+				candidates = append(candidates, i)
+			}
+		}
+		//the heap is only partly ordered, so sort the candidates for a repeatable choice
+		sort.Slice(candidates, func(i, j int) bool {
+			return engine.agenda[candidates[i]].seq < engine.agenda[candidates[j]].seq
+		})
+		best = candidates[engine.random.Intn(len(candidates))]
+	}
+
+	act := heap.Remove(agendaHeap{engine}, best).(*activation)
+	act.fired = true
+	return act
+}
+
+//precedes reports whether activation a should fire before activation b
+func (engine *Engine) precedes(a *activation, b *activation) bool {
+
+	salienceA := a.tok.containedBy.salience
+	salienceB := b.tok.containedBy.salience
+	if salienceA != salienceB {
+		return salienceA > salienceB
+	}
+
+	switch engine.strategy {
+	case Breadth:
+		return a.seq < b.seq
+	case Mea:
+		tags := engine.timetags
+		if tags[a.tok.incoming[0]] != tags[b.tok.incoming[0]] {
+			return tags[a.tok.incoming[0]] > tags[b.tok.incoming[0]]
+		}
+		fallthrough
+	case Lex:
+		for i := 0; i < len(a.recency) && i < len(b.recency); i++ {
+			if a.recency[i] != b.recency[i] {
+				return a.recency[i] > b.recency[i]
+			}
+		}
+		if len(a.recency) != len(b.recency) {
+			return len(a.recency) > len(b.recency)
+		}
+	}
+	return a.seq > b.seq
+}
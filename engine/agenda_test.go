@@ -0,0 +1,207 @@
+package engine
+
+import "fmt"
+import "reflect"
+import "testing"
+
+//agendaEngine defines single-fact rules on a fresh engine
+func agendaEngine(t *testing.T, s Strategy, rules ...Rule) *Engine {
+
+	testEngine := &Engine{}
+	err := testEngine.SetStrategy(s)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, r := range rules {
+		err = testEngine.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+	return testEngine
+}
+
+//propagateOnly adds facts to the network without letting any rule fire
+func propagateOnly(t *testing.T, testEngine *Engine, facts ...Fact) {
+
+	for i := range facts {
+		err := testEngine.propagate(&facts[i])
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+}
+
+//drain empties the agenda, returning rule id and first object id in firing order
+func drain(testEngine *Engine) []string {
+
+	var order []string
+	for act := testEngine.selectActivation(); act != nil; act = testEngine.selectActivation() {
+		order = append(order, fmt.Sprintf("%s/%s", act.tok.containedBy.ruleId, act.tok.incoming[0].ObjectId))
+	}
+	return order
+}
+
+func simpleRule(id string, salience int, attribute string) Rule {
+
+	var x Variable = "x"
+	return Rule{
+		Id:       id,
+		Salience: salience,
+		LHS:      []Condition{Condition{ObjectId: x, Attribute: attribute, Comparator: EQ, Value: 1}},
+		RHS:      []Inference{Inference{ObjectId: x, Attribute: id, Value: "fired"}},
+	}
+}
+
+func TestSalience(t *testing.T) {
+
+	for _, s := range []Strategy{Depth, Breadth} {
+		testEngine := agendaEngine(t, s, simpleRule("low", 0, "a"), simpleRule("high", 10, "a"))
+		propagateOnly(t, testEngine, Fact{"x1", "a", 1}, Fact{"x2", "a", 1})
+
+		var expected []string
+		if s == Depth {
+			expected = []string{"high/x2", "high/x1", "low/x2", "low/x1"}
+		} else {
+			expected = []string{"high/x1", "high/x2", "low/x1", "low/x2"}
+		}
+		order := drain(testEngine)
+		if !reflect.DeepEqual(order, expected) {
+			t.Errorf("Test %s: expected %v, got %v\n", s.String(), expected, order)
+		}
+	}
+}
+
+func TestLexStrategy(t *testing.T) {
+
+	var y Variable = "y"
+	neg := Rule{
+		Id: "neg",
+		LHS: []Condition{
+			Condition{ObjectId: y, Attribute: "d", Comparator: EQ, Value: 1},
+			Condition{NotExists: true, ObjectId: "", Attribute: "blocker", Comparator: EQ, Value: 1},
+		},
+		RHS: []Inference{Inference{ObjectId: y, Attribute: "neg", Value: "fired"}},
+	}
+
+	for _, s := range []Strategy{Depth, Lex} {
+		testEngine := agendaEngine(t, s, neg, simpleRule("one", 0, "e"))
+		blocker := Fact{"b", "blocker", 1}
+		propagateOnly(t, testEngine, blocker, Fact{"y", "d", 1}, Fact{"x", "e", 1})
+		//the activation of neg is created last, but its fact is older
+		f, err := testEngine.find(blocker)
+		if err != nil || f == nil {
+			t.Fatalf("blocker not found")
+		}
+		err = testEngine.retract(f)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		expected := []string{"neg/y", "one/x"}
+		if s == Lex {
+			expected = []string{"one/x", "neg/y"}
+		}
+		order := drain(testEngine)
+		if !reflect.DeepEqual(order, expected) {
+			t.Errorf("Test %s: expected %v, got %v\n", s.String(), expected, order)
+		}
+	}
+}
+
+func TestMeaStrategy(t *testing.T) {
+
+	var x Variable = "x"
+	pair := func(id string, first string, second string) Rule {
+		return Rule{
+			Id: id,
+			LHS: []Condition{
+				Condition{ObjectId: x, Attribute: first, Comparator: EQ, Value: 1},
+				Condition{ObjectId: x, Attribute: second, Comparator: EQ, Value: 1},
+			},
+			RHS: []Inference{Inference{ObjectId: x, Attribute: id, Value: "fired"}},
+		}
+	}
+
+	for _, s := range []Strategy{Lex, Mea} {
+		testEngine := agendaEngine(t, s, pair("two", "a", "c"), pair("three", "g", "f"))
+		propagateOnly(t, testEngine, Fact{"z", "g", 1}, Fact{"x", "c", 1}, Fact{"x", "a", 1}, Fact{"z", "f", 1})
+
+		expected := []string{"three/z", "two/x"}
+		if s == Mea {
+			expected = []string{"two/x", "three/z"}
+		}
+		order := drain(testEngine)
+		if !reflect.DeepEqual(order, expected) {
+			t.Errorf("Test %s: expected %v, got %v\n", s.String(), expected, order)
+		}
+	}
+}
+
+func TestRandomStrategy(t *testing.T) {
+
+	var orders [][]string
+	for i := 0; i < 2; i++ {
+		testEngine := agendaEngine(t, Random, simpleRule("r1", 0, "a"), simpleRule("r2", 0, "a"), simpleRule("r3", 5, "a"))
+		testEngine.SetSeed(42)
+		propagateOnly(t, testEngine, Fact{"x1", "a", 1}, Fact{"x2", "a", 1}, Fact{"x3", "a", 1})
+		order := drain(testEngine)
+		if len(order) != 9 {
+			t.Fatalf("Test random: expected 9 activations, got %v\n", order)
+		}
+		for _, id := range order[:3] {
+			if id[:2] != "r3" {
+				t.Errorf("Test random: salience ignored in %v\n", order)
+			}
+		}
+		orders = append(orders, order)
+	}
+	if !reflect.DeepEqual(orders[0], orders[1]) {
+		t.Errorf("Test random: same seed gave %v and %v\n", orders[0], orders[1])
+	}
+
+	testEngine := Engine{}
+	if testEngine.SetStrategy(Strategy(99)) == nil {
+		t.Errorf("Test random: expected an error for an unknown strategy")
+	}
+}
+
+func TestConflictResolution(t *testing.T) {
+
+	//with higher salience, block fires first and its inference stops
+	//the activation of grant from firing at all
+	var x Variable = "x"
+	grant := Rule{
+		Id: "grant",
+		LHS: []Condition{
+			Condition{ObjectId: x, Attribute: "request", Comparator: EQ, Value: "open"},
+			Condition{NotExists: true, ObjectId: "", Attribute: "lockdown", Comparator: EQ, Value: "on"},
+		},
+		RHS: []Inference{Inference{ObjectId: x, Attribute: "granted", Value: "true"}},
+	}
+	block := Rule{
+		Id:       "block",
+		Salience: 10,
+		LHS:      []Condition{Condition{ObjectId: x, Attribute: "request", Comparator: EQ, Value: "open"}},
+		RHS:      []Inference{Inference{ObjectId: "site", Attribute: "lockdown", Value: "on"}},
+	}
+	testEngine := agendaEngine(t, Depth, grant, block)
+	err := testEngine.Assert(Fact{"r1", "request", "open"})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	result, err := testEngine.GetInferences("", "granted")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(result) != 0 {
+		t.Errorf("Test conflict resolution: expected 0, got %d\n", len(result))
+	}
+	result, err = testEngine.GetInferences("site", "lockdown")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(result) != 1 {
+		t.Errorf("Test conflict resolution: expected 1, got %d\n", len(result))
+	}
+}
@@ -0,0 +1,137 @@
+package engine
+
+import "fmt"
+import "time"
+
+//Aggregate computes a value over every match of conditions of its own (see Condition.Aggregate).
+//The conditions are joined with the variables bound before the aggregate, so the matches are
+//grouped by those: "?p kind patient, count (?s symptom-of ?p)" counts the symptoms of each patient.
+type Aggregate struct {
+	Function   string      //count, sum, min, max or average
+	Of         Variable    //the variable, bound by the conditions, whose values are aggregated (unused by count)
+	Conditions []Condition //the first cannot be negated
+	Into       Variable    //optional: bound to the result, for later conditions and the RHS
+}
+
+//compileAggregate checks aggregate condition i of a rule and makes its quantifier, which still
+//needs its alpha nodes
+func compileAggregate(testNetwork map[Variable][]betaTest, lhs []Condition, i int) (*quantifier, error) {
+
+	condition := lhs[i]
+	a := condition.Aggregate
+	if condition.NotExists {
+		return nil, fmt.Errorf("An aggregate cannot be negated")
+	}
+	if condition.Label != "" {
+		return nil, fmt.Errorf("Label %s cannot be used with an aggregate", condition.Label)
+	}
+	if condition.ObjectId != nil || condition.Attribute != "" || condition.Any != nil || condition.ForAll != nil || condition.None != nil {
+		return nil, fmt.Errorf("An aggregate cannot also have an object, attribute, alternatives, forall or negated group")
+	}
+	switch a.Function {
+	case "count":
+		if a.Of != "" {
+			return nil, fmt.Errorf("Aggregate count counts matches and takes no variable")
+		}
+	case "sum", "min", "max", "average":
+		if a.Of == "" {
+			return nil, fmt.Errorf("Aggregate %s needs the variable whose values it takes", a.Function)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown aggregate function %s", a.Function)
+	}
+	if len(a.Conditions) == 0 {
+		return nil, fmt.Errorf("Aggregate %s has no conditions", a.Function)
+	}
+
+	q := &quantifier{conditions: a.Conditions, aggregate: a, comparator: condition.Comparator, compareTo: condition.Value}
+	local, err := q.compileConditions(testNetwork, lhs, i, "an aggregate")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := q.outer[a.Of]; a.Of != "" && !ok && !local[a.Of] {
+		return nil, fmt.Errorf("Variable %s of aggregate %s is not bound by its conditions", a.Of, a.Function)
+	}
+	if a.Into != "" {
+		if _, bound := firstBinding(testNetwork, lhs, a.Into, i); bound || local[a.Into] {
+			return nil, fmt.Errorf("Variable %s for the result of aggregate %s is already bound", a.Into, a.Function)
+		}
+	}
+	//the result is tested against a constant or a variable bound before the aggregate
+	switch v := condition.Value.(type) {
+	case Expression:
+		return nil, fmt.Errorf("Expression %s cannot be used in a condition", v)
+	case Variable:
+		tst, bound := firstBinding(testNetwork, lhs, v, i)
+		if !bound {
+			return nil, fmt.Errorf("Value variable %s must be bound by an earlier condition to be used with %s", v, condition.Comparator.String())
+		}
+		q.outer[v] = tst
+	}
+	return q, nil
+}
+
+//aggregated returns a fact holding the result of the aggregate for a partial match (with the
+//function as its attribute), from the bindings of its outer variables, the values of the
+//aggregated variable and the number of matches, or nil if there is no result or it fails the test
+func (q *quantifier) aggregated(b Bindings, values []interface{}, count int) (*Fact, error) {
+
+	var err error
+	var result interface{}
+	switch q.aggregate.Function {
+	case "count":
+		result = count
+	case "sum", "average":
+		var sum interface{} = 0
+		for i, v := range values {
+			if _, ok := v.(time.Duration); ok && i == 0 {
+				sum = v
+				continue
+			}
+			sum, err = arithmetic("add", []interface{}{sum, v})
+			if e, ok := err.(*ExpressionError); ok {
+				return nil, &ExpressionError{Function: q.aggregate.Function, Arg: i, Value: v, Msg: e.Msg}
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		result = sum
+		if q.aggregate.Function == "sum" {
+			break
+		}
+		if count == 0 {
+			return nil, nil
+		}
+		if d, ok := sum.(time.Duration); ok {
+			result = d / time.Duration(count)
+		} else {
+			n, _ := numberOf(sum)
+			result = n.float() / float64(count)
+		}
+	case "min", "max":
+		if count == 0 {
+			return nil, nil
+		}
+		op := LT
+		if q.aggregate.Function == "max" {
+			op = GT
+		}
+		result, err = extreme(q.aggregate.Function, values, op)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if q.compareTo != nil {
+		compareTo := q.compareTo
+		if v, ok := compareTo.(Variable); ok {
+			compareTo = b[v]
+		}
+		passed, err := match(result, q.comparator, compareTo)
+		if err != nil || !passed {
+			return nil, err
+		}
+	}
+	return &Fact{Attribute: q.aggregate.Function, Value: result}, nil
+}
@@ -0,0 +1,226 @@
+package engine
+
+import "bytes"
+import "strings"
+import "testing"
+
+func TestAggregate(t *testing.T) {
+
+	var p Variable = "p"
+	var s Variable = "s"
+	var n Variable = "n"
+	var o Variable = "o"
+	var i Variable = "i"
+	var v Variable = "v"
+	var total Variable = "total"
+	var limit Variable = "limit"
+	var avg Variable = "avg"
+
+	testEngine := Engine{}
+	rules := []Rule{
+		//a patient with 3 or more symptoms
+		Rule{
+			Id: "symptoms",
+			LHS: []Condition{
+				Condition{ObjectId: p, Attribute: "kind", Comparator: EQ, Value: "patient"},
+				Condition{Comparator: GE, Value: 3, Aggregate: &Aggregate{Function: "count", Into: n, Conditions: []Condition{
+					Condition{ObjectId: s, Attribute: "symptom-of", Comparator: EQ, Value: p},
+				}}},
+			},
+			RHS: []Inference{Inference{ObjectId: p, Attribute: "symptoms", Value: n}},
+		},
+		//the total of the lines of an order that have not been cancelled exceeds the order's limit
+		Rule{
+			Id: "large",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "limit", Comparator: EQ, Value: limit},
+				Condition{Comparator: GT, Value: limit, Aggregate: &Aggregate{Function: "sum", Of: v, Into: total, Conditions: []Condition{
+					Condition{ObjectId: i, Attribute: "order", Comparator: EQ, Value: o},
+					Condition{ObjectId: i, Attribute: "price", Comparator: EQ, Value: v},
+					Condition{NotExists: true, ObjectId: i, Attribute: "cancelled", Comparator: EQ, Value: true},
+				}}},
+			},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "large", Value: total}},
+		},
+		//the average reading, with no grouping and no test
+		Rule{
+			Id: "average",
+			LHS: []Condition{
+				Condition{Aggregate: &Aggregate{Function: "average", Of: v, Into: avg, Conditions: []Condition{
+					Condition{ObjectId: s, Attribute: "reading", Comparator: EQ, Value: v},
+				}}},
+				Condition{ObjectId: "ward", Attribute: "normal", Comparator: GE, Value: avg},
+			},
+			RHS: []Inference{Inference{ObjectId: "ward", Attribute: "average", Value: avg}},
+		},
+	}
+	for _, rule := range rules {
+		err := testEngine.Define(rule)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", rule.Id, err)
+		}
+	}
+
+	inferred := func(test string, attribute string, expected string) {
+		result, err := testEngine.GetInferences("", attribute)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		var got []string
+		for _, f := range result {
+			got = append(got, f.ObjectId+"="+strings.TrimSpace(strings.SplitN(f.String(), " V ", 2)[1]))
+		}
+		if strings.Join(got, " ") != expected {
+			t.Errorf("Test %s: expected %s %q, got %q\n", test, attribute, expected, strings.Join(got, " "))
+		}
+	}
+	change := func(retract bool, facts ...Fact) {
+		for _, f := range facts {
+			var err error
+			if retract {
+				err = testEngine.Retract(f)
+			} else {
+				err = testEngine.Assert(f)
+			}
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+	}
+
+	//the count of each patient is kept up to date
+	change(false, Fact{"ann", "kind", "patient"}, Fact{"bob", "kind", "patient"})
+	change(false, Fact{"cough", "symptom-of", "ann"}, Fact{"fever", "symptom-of", "ann"}, Fact{"cough", "symptom-of", "bob"})
+	inferred("1", "symptoms", "")
+	change(false, Fact{"rash", "symptom-of", "ann"})
+	inferred("2", "symptoms", "ann=3")
+	change(false, Fact{"ache", "symptom-of", "ann"})
+	inferred("3", "symptoms", "ann=4")
+	change(true, Fact{"rash", "symptom-of", "ann"}, Fact{"ache", "symptom-of", "ann"})
+	inferred("4", "symptoms", "")
+
+	//a sum tested against an outer variable, with a negated condition
+	change(false, Fact{"o1", "limit", 1000}, Fact{"l1", "order", "o1"}, Fact{"l1", "price", 600})
+	change(false, Fact{"l2", "order", "o1"}, Fact{"l2", "price", 500.5})
+	inferred("5", "large", "o1=1100.500000")
+	change(false, Fact{"l2", "cancelled", true})
+	inferred("6", "large", "")
+	change(false, Fact{"l3", "order", "o1"}, Fact{"l3", "price", 401})
+	inferred("7", "large", "o1=1001")
+	change(true, Fact{"o1", "limit", 1000})
+	change(false, Fact{"o1", "limit", 2000})
+	inferred("8", "large", "")
+
+	//min, max and average have no result until something matches
+	change(false, Fact{"ward", "normal", 40})
+	inferred("9", "average", "")
+	change(false, Fact{"x1", "reading", 37}, Fact{"x2", "reading", 38})
+	inferred("10", "average", "ward=37.500000")
+	change(false, Fact{"x3", "reading", 48})
+	inferred("11", "average", "")
+
+	justifications, err := testEngine.Justify(Fact{"o1", "large", 1001})
+	if err == nil && len(justifications) != 0 {
+		t.Errorf("Test 12: expected no justification for a withdrawn inference, got %v\n", justifications)
+	}
+	change(true, Fact{"o1", "limit", 2000})
+	change(false, Fact{"o1", "limit", 1000})
+	justifications, err = testEngine.Justify(Fact{"o1", "large", 1001})
+	if err != nil || len(justifications) != 1 || justifications[0].Facts[1] != (Fact{"", "sum", 1001}) {
+		t.Errorf("Test 12: expected the sum to justify the inference, got %v %v\n", justifications, err)
+	}
+	explanation, err := testEngine.Explain(Fact{"o1", "large", 1001})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !strings.Contains(explanation.String(), "[1] sum ?v (?i order EQ ?o, ?i price EQ ?v, not ?i cancelled EQ true) GT ?limit as ?total: sum is 1001\n") {
+		t.Errorf("Test 12: unexpected explanation\n%s", explanation.String())
+	}
+
+	diagnosis, err := testEngine.WhyNot("symptoms")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !strings.Contains(diagnosis.String(), "[1] count (?s symptom-of EQ ?p) GE 3 as ?n: 3 facts\n") {
+		t.Errorf("Test 13: unexpected diagnosis\n%s", diagnosis.String())
+	}
+
+	//a snapshot restores the matches with their results
+	var buf bytes.Buffer
+	err = testEngine.Snapshot(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	restored := Engine{}
+	err = restored.Restore(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	result, _ := restored.GetInferences("", "")
+	if len(result) != 1 || result[0] != (Fact{"o1", "large", 1001}) {
+		t.Errorf("Test 14: expected the inference to be restored, got %v\n", result)
+	}
+
+	//the alpha nodes of the conditions of an aggregate go with the rules
+	for _, rule := range rules {
+		err = testEngine.Undefine(rule.Id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if len(testEngine.alphaNetwork) != 0 {
+		t.Errorf("Test 15: expected no alpha nodes, got %d attributes\n", len(testEngine.alphaNetwork))
+	}
+}
+
+func TestAggregateErrors(t *testing.T) {
+
+	var p Variable = "p"
+	var s Variable = "s"
+	var v Variable = "v"
+	var n Variable = "n"
+
+	patient := Condition{ObjectId: p, Attribute: "kind", Comparator: EQ, Value: "patient"}
+	symptom := Condition{ObjectId: s, Attribute: "symptom-of", Comparator: EQ, Value: p}
+	count := func(c Condition) Rule {
+		return Rule{Id: "count", LHS: []Condition{patient, c}}
+	}
+
+	for i, test := range []struct {
+		rule Rule
+		msg  string
+	}{
+		{count(Condition{Aggregate: &Aggregate{Function: "median", Of: s, Conditions: []Condition{symptom}}}), "Unknown aggregate function median"},
+		{count(Condition{Aggregate: &Aggregate{Function: "sum", Conditions: []Condition{symptom}}}), "Aggregate sum needs the variable whose values it takes"},
+		{count(Condition{Aggregate: &Aggregate{Function: "count", Of: s, Conditions: []Condition{symptom}}}), "Aggregate count counts matches and takes no variable"},
+		{count(Condition{Aggregate: &Aggregate{Function: "max", Of: v, Conditions: []Condition{symptom}}}), "Variable v of aggregate max is not bound by its conditions"},
+		{count(Condition{Aggregate: &Aggregate{Function: "count"}}), "Aggregate count has no conditions"},
+		{count(Condition{Aggregate: &Aggregate{Function: "count", Into: p, Conditions: []Condition{symptom}}}), "Variable p for the result of aggregate count is already bound"},
+		{count(Condition{Comparator: GT, Value: v, Aggregate: &Aggregate{Function: "count", Conditions: []Condition{symptom}}}), "Value variable v must be bound by an earlier condition to be used with GT"},
+		{count(Condition{NotExists: true, Aggregate: &Aggregate{Function: "count", Conditions: []Condition{symptom}}}), "An aggregate cannot be negated"},
+		{count(Condition{Attribute: "x", Aggregate: &Aggregate{Function: "count", Conditions: []Condition{symptom}}}), "An aggregate cannot also have an object, attribute, alternatives, forall or negated group"},
+		{count(Condition{Aggregate: &Aggregate{Function: "count", Conditions: []Condition{Condition{NotExists: true, ObjectId: s, Attribute: "symptom-of", Value: p}}}}), "The first condition of an aggregate cannot be negated"},
+		{count(Condition{Aggregate: &Aggregate{Function: "count", Conditions: []Condition{Condition{ForAll: []Condition{symptom, symptom}}}}}), "Conditions within an aggregate cannot have alternatives, forall, aggregates or negated groups of their own"},
+		{Rule{Id: "local", LHS: []Condition{patient, Condition{Aggregate: &Aggregate{Function: "count", Into: n, Conditions: []Condition{symptom}}}}, RHS: []Inference{Inference{ObjectId: s, Attribute: "ok", Value: n}}}, "Variable s in local is not bound by a condition"},
+		{Rule{Id: "target", LHS: []Condition{patient, Condition{Aggregate: &Aggregate{Function: "count", Conditions: []Condition{symptom}}}}, Retractions: []Retraction{Retraction{Target: 1}}}, "Target 1 is an aggregate and matches no single fact"},
+	} {
+		testEngine := Engine{}
+		err := testEngine.Define(test.rule)
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("Test %d: expected %q, got %v\n", i+1, test.msg, err)
+		}
+	}
+
+	//values that cannot be summed are an error when the aggregate is computed
+	testEngine := Engine{}
+	err := testEngine.Define(Rule{Id: "sum", LHS: []Condition{
+		Condition{Aggregate: &Aggregate{Function: "sum", Of: v, Conditions: []Condition{Condition{ObjectId: s, Attribute: "price", Comparator: EQ, Value: v}}}},
+	}})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = testEngine.Assert(Fact{"x", "price", "free"})
+	if err == nil || !strings.Contains(err.Error(), "sum: argument 0 (free): not a number") {
+		t.Errorf("Test 14: expected an expression error, got %v\n", err)
+	}
+}
@@ -0,0 +1,256 @@
+package engine
+
+import "fmt"
+
+//Retraction removes one of the facts matched by its rule when the rule fires
+type Retraction struct {
+	Target interface{} //int (index of the condition in the LHS) or Variable (a condition's Label)
+}
+
+//Modification replaces the value of one of the facts matched by its rule when the rule fires
+type Modification struct {
+	Target interface{} //int or Variable, as for Retraction
+	Value  interface{} //the new value (constant, Variable or Expression)
+}
+
+//a kept inference was made by a token that then consumed its own match
+type keptInference struct {
+	node    *pNode //that keeps it
+	fact    *Fact
+	support []Fact //copies of the facts that the token matched
+}
+
+//a change is a compiled retraction (modify is false) or modification
+type change struct {
+	index  int //condition number of the target
+	modify bool
+	value  interface{}
+}
+
+//compileChanges checks the retractions and modifications of a rule and resolves their targets
+func compileChanges(r Rule) ([]change, error) {
+
+	bound := make(map[Variable]bool)
+	labels := make(map[Variable]int)
+	for i, condition := range r.LHS {
+		if condition.Label == "" {
+			continue
+		}
+		if condition.NotExists {
+			return nil, fmt.Errorf("Label %s cannot be used with a negated condition", condition.Label)
+		}
+		if _, ok := labels[condition.Label]; ok {
+			return nil, fmt.Errorf("Label %s is used more than once", condition.Label)
+		}
+		labels[condition.Label] = i
+	}
+	for _, condition := range r.LHS {
+		if condition.NotExists {
+			continue
+		}
+		if v, ok := condition.ObjectId.(Variable); ok {
+			bound[v] = true
+		}
+		if v, ok := condition.Value.(Variable); ok {
+			bound[v] = true
+		}
+		if condition.Aggregate != nil && condition.Aggregate.Into != "" {
+			bound[condition.Aggregate.Into] = true
+		}
+	}
+
+	target := func(t interface{}) (int, error) {
+		switch v := t.(type) {
+		case int:
+			if v < 0 || v >= len(r.LHS) {
+				return 0, fmt.Errorf("Target %d is not a condition of %s", v, r.Id)
+			}
+			if r.LHS[v].NotExists {
+				return 0, fmt.Errorf("Target %d is a negated condition and matches no fact", v)
+			}
+			if r.LHS[v].ForAll != nil {
+				return 0, fmt.Errorf("Target %d is a forall condition and matches no single fact", v)
+			}
+			if r.LHS[v].None != nil {
+				return 0, fmt.Errorf("Target %d is a negated group and matches no fact", v)
+			}
+			if r.LHS[v].Aggregate != nil {
+				return 0, fmt.Errorf("Target %d is an aggregate and matches no single fact", v)
+			}
+			return v, nil
+		case Variable:
+			i, ok := labels[v]
+			if !ok {
+				return 0, fmt.Errorf("Target %s is not the label of a condition", v)
+			}
+			return i, nil
+		default:
+			return 0, fmt.Errorf("Target must be int or Variable, not %T", t)
+		}
+	}
+
+	var changes []change
+	for _, retraction := range r.Retractions {
+		i, err := target(retraction.Target)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change{index: i})
+	}
+	for _, modification := range r.Modifications {
+		i, err := target(modification.Target)
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := modification.Value.(Variable); ok && !bound[v] {
+			return nil, fmt.Errorf("Variable %s in modification is not bound by a condition", v)
+		}
+		changes = append(changes, change{index: i, modify: true, value: modification.Value})
+	}
+	return changes, nil
+}
+
+//consume carries out the retractions and modifications of a token that is firing.
+//Because they remove facts that the token itself matched, the token is damaged by
+//its own firing; rather than withdraw what it has just done, the token hands its
+//inferences over to the p-node, where they are kept until retracted explicitly,
+//and its actions are not undone.
+//Any other tokens that matched the changed facts are damaged as usual.
+func (node *pNode) consume(tok *token) error {
+
+	if len(node.changes) == 0 {
+		return nil
+	}
+
+	var bindings Bindings
+
+	//collect the targets before any of them are removed from the token
+	targets := make([]*Fact, len(node.changes))
+	values := make([]interface{}, len(node.changes))
+	for i, c := range node.changes {
+		targets[i] = tok.incoming[c.index]
+		if !c.modify {
+			continue
+		}
+		switch c.value.(type) {
+		case Variable, Expression:
+			if bindings == nil {
+				bindings = node.bindings(tok)
+			}
+			value, err := evaluate(c.value, bindings)
+			if err != nil {
+				return fmt.Errorf("Modification failure in %s: %w", node.ruleId, err)
+			}
+			values[i] = value
+		default:
+			values[i] = c.value
+		}
+	}
+
+	//work out which changes take effect: a fact may be targeted twice, and a modification
+	//may leave a fact as it is
+	engine := node.parentEngine
+	var effective []int
+	changed := make(map[*Fact]bool)
+	for i, c := range node.changes {
+		f := targets[i]
+		if _, ok := engine.timetags[f]; !ok || changed[f] {
+			continue
+		}
+		if c.modify {
+			same, err := match(f.Value, EQ, values[i])
+			if err != nil {
+				return err
+			}
+			if same {
+				continue //nothing to change (and no reason to fire again)
+			}
+		}
+		changed[f] = true
+		effective = append(effective, i)
+	}
+	if len(effective) == 0 {
+		return nil //the match is intact, so its inferences follow it as usual
+	}
+
+	support := make([]Fact, len(tok.incoming))
+	for i, f := range tok.incoming {
+		support[i] = *f
+	}
+	for j, f := range tok.outgoing {
+		if f != nil {
+			k := &keptInference{node: node, fact: f, support: support}
+			engine.keep(k)
+			if engine.journal != nil {
+				engine.journal.kept = append(engine.journal.kept, k)
+			}
+		}
+		tok.outgoing[j] = nil
+	}
+	tok.bindings = nil
+
+	for _, i := range effective {
+		f := targets[i]
+		if _, ok := engine.timetags[f]; !ok {
+			continue //an inference whose match was broken by an earlier change
+		}
+		err := engine.retract(f)
+		if err != nil {
+			return err
+		}
+		if node.changes[i].modify {
+			modified := &Fact{ObjectId: f.ObjectId, Attribute: f.Attribute, Value: values[i]}
+			if engine.journal != nil {
+				engine.journal.asserted = append(engine.journal.asserted, modified)
+			}
+			engine.pushFact(modified)
+		}
+	}
+	return nil
+}
+
+//keep adds an inference to those kept by its p-node
+func (engine *Engine) keep(k *keptInference) {
+
+	node := k.node
+	if node.keptPositions == nil {
+		node.keptPositions = make(map[*keptInference]int)
+	}
+	node.keptPositions[k] = len(node.kept)
+	node.kept = append(node.kept, k)
+	if engine.kept == nil {
+		engine.kept = make(map[*Fact][]*keptInference)
+	}
+	engine.kept[k.fact] = append(engine.kept[k.fact], k)
+}
+
+//unkeep removes a kept inference from its p-node, leaving the support it gives its fact
+func (engine *Engine) unkeep(k *keptInference) {
+
+	node := k.node
+	i, ok := node.keptPositions[k]
+	if !ok {
+		return
+	}
+	delete(node.keptPositions, k)
+	last := len(node.kept) - 1
+	node.kept[i] = node.kept[last]
+	node.kept[last] = nil
+	node.kept = node.kept[:last]
+	if i < last {
+		node.keptPositions[node.kept[i]] = i
+	}
+
+	list := engine.kept[k.fact]
+	for j, other := range list {
+		if other == k {
+			list = append(list[:j], list[j+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(engine.kept, k.fact)
+	} else {
+		engine.kept[k.fact] = list
+	}
+}
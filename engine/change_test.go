@@ -0,0 +1,167 @@
+package engine
+
+import "testing"
+
+func TestModification(t *testing.T) {
+
+	var o Variable = "o"
+	var f Variable = "f"
+	shipped := 0
+
+	testEngine := Engine{}
+	err := testEngine.RegisterAction("ship", func(ruleId string, bindings Bindings) error {
+		shipped++
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	rules := []Rule{
+		Rule{
+			Id: "ship",
+			LHS: []Condition{
+				Condition{Label: f, ObjectId: o, Attribute: "status", Comparator: EQ, Value: "new"},
+				Condition{ObjectId: o, Attribute: "paid", Comparator: EQ, Value: "yes"},
+			},
+			Actions:       []Action{Action{Name: "ship"}},
+			Modifications: []Modification{Modification{Target: f, Value: "shipped"}},
+		},
+		Rule{
+			Id:  "attention",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "status", Comparator: EQ, Value: "new"}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "needs", Value: "attention"}},
+		},
+		Rule{
+			Id:  "archive",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "status", Comparator: EQ, Value: "shipped"}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "archived", Value: "true"}},
+		},
+		Rule{
+			Id:          "cleanup",
+			LHS:         []Condition{Condition{ObjectId: o, Attribute: "scratch", Comparator: EQ, Value: "x"}},
+			RHS:         []Inference{Inference{ObjectId: o, Attribute: "cleaned", Value: "yes"}},
+			Retractions: []Retraction{Retraction{Target: 0}},
+		},
+		Rule{
+			Id: "ready",
+			LHS: []Condition{
+				Condition{Label: f, ObjectId: o, Attribute: "state", Comparator: EQ, Value: "new"},
+				Condition{ObjectId: o, Attribute: "settled", Comparator: EQ, Value: true},
+			},
+			RHS:           []Inference{Inference{ObjectId: o, Attribute: "ready", Value: true}},
+			Modifications: []Modification{Modification{Target: f, Value: "new"}},
+		},
+	}
+	for _, r := range rules {
+		err = testEngine.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+
+	count := func(test string, objectId string, attribute string, expected int) {
+		result, err := testEngine.GetFacts(objectId, attribute)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		if len(result) != expected {
+			t.Errorf("Test %s: expected %d, got %d %v\n", test, expected, len(result), result)
+		}
+	}
+
+	err = testEngine.Assert(Fact{"o1", "status", "new"})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	count("1 needs attention", "o1", "needs", 1)
+
+	err = testEngine.Assert(Fact{"o1", "paid", "yes"})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if shipped != 1 {
+		t.Errorf("Test 2 shipped: expected 1, got %d\n", shipped)
+	}
+	count("2 status", "o1", "status", 1)
+	result, err := testEngine.GetFacts("o1", "status")
+	if err != nil || len(result) != 1 || result[0].Value != "shipped" {
+		t.Errorf("Test 2 status: expected shipped, got %v\n", result)
+	}
+	count("2 attention withdrawn", "o1", "needs", 0)
+	count("2 archived", "o1", "archived", 1)
+
+	//the rule consumes the fact it matched, but its inference stays
+	err = testEngine.Assert(Fact{"o2", "scratch", "x"})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	count("3 scratch retracted", "o2", "scratch", 0)
+	count("3 cleaned", "o2", "cleaned", 1)
+
+	//a modification that changes nothing leaves the match, and its inference, as they were
+	err = testEngine.Assert(Fact{"o3", "state", "new"})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	err = testEngine.Assert(Fact{"o3", "settled", true})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	count("4 ready", "o3", "ready", 1)
+	err = testEngine.Retract(Fact{"o3", "settled", true})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	count("4 ready withdrawn", "o3", "ready", 0)
+	if len(testEngine.productions[4].kept) != 0 {
+		t.Errorf("Test 4: expected nothing kept, got %d\n", len(testEngine.productions[4].kept))
+	}
+}
+
+func TestChangeErrors(t *testing.T) {
+
+	var o Variable = "o"
+	var f Variable = "f"
+
+	base := func() Rule {
+		return Rule{
+			Id: "bad",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "a", Comparator: EQ, Value: 1},
+				Condition{NotExists: true, ObjectId: "", Attribute: "b", Comparator: EQ, Value: 1},
+			},
+		}
+	}
+
+	var rules []Rule
+	r := base()
+	r.Retractions = []Retraction{Retraction{Target: 2}}
+	rules = append(rules, r)
+	r = base()
+	r.Retractions = []Retraction{Retraction{Target: 1}}
+	rules = append(rules, r)
+	r = base()
+	r.Retractions = []Retraction{Retraction{Target: f}}
+	rules = append(rules, r)
+	r = base()
+	r.LHS[1].Label = f
+	rules = append(rules, r)
+	r = base()
+	r.Modifications = []Modification{Modification{Target: 0, Value: Variable("unbound")}}
+	rules = append(rules, r)
+	r = base()
+	r.Retractions = []Retraction{Retraction{Target: "0"}}
+	rules = append(rules, r)
+
+	for i, r := range rules {
+		testEngine := Engine{}
+		err := testEngine.Define(r)
+		if err == nil {
+			t.Errorf("Test %d: expected an error\n", i)
+		}
+		if len(testEngine.productions) != 0 {
+			t.Errorf("Test %d: rule was partly defined\n", i)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package engine
+
+import "fmt"
+import "sync"
+import "testing"
+
+func TestConcurrency(t *testing.T) {
+
+	var o Variable = "o"
+
+	testEngine := &Engine{}
+	err := testEngine.Define(Rule{
+		Id:  "check",
+		LHS: []Condition{Condition{ObjectId: o, Attribute: "item", Comparator: EQ, Value: "new"}},
+		RHS: []Inference{Inference{ObjectId: o, Attribute: "checked", Value: "yes"}},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	writers := 4
+	n := 50
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*n*2)
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				fct := Fact{fmt.Sprintf("w%d-%d", w, i), "item", "new"}
+				err := testEngine.Assert(fct)
+				if err != nil {
+					errs <- err
+				}
+				if i%2 == 1 {
+					err = testEngine.Retract(fct)
+					if err != nil {
+						errs <- err
+					}
+				}
+			}
+		}(w)
+	}
+
+	//every read sees each inference together with the fact it was inferred from
+	var readers sync.WaitGroup
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := 0; i < n; i++ {
+				facts, err := testEngine.GetFacts("", "")
+				if err != nil {
+					errs <- err
+					return
+				}
+				items := make(map[string]bool)
+				for _, f := range facts {
+					if f.Attribute == "item" {
+						items[f.ObjectId] = true
+					}
+				}
+				for _, f := range facts {
+					if f.Attribute == "checked" && !items[f.ObjectId] {
+						errs <- fmt.Errorf("%s is checked without its item", f.ObjectId)
+						return
+					}
+				}
+				_, err = testEngine.GetInferences("", "checked")
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf(err.Error())
+	}
+
+	result, err := testEngine.GetInferences("", "checked")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(result) != writers*n/2 {
+		t.Errorf("Expected %d inferences, got %d\n", writers*n/2, len(result))
+	}
+}
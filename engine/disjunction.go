@@ -0,0 +1,100 @@
+package engine
+
+import "fmt"
+
+//a branch is one way of satisfying the LHS of a rule with alternatives (see Condition.Any):
+//the conditions that remain when a single group is chosen from every set of alternatives
+type branch struct {
+	lhs   []Condition
+	index []int //the position in lhs of each condition of the rule's LHS (-1 for alternatives)
+}
+
+//expand rewrites a list of conditions as the branches it holds, one for each choice of
+//group from its alternatives, so that "A, (B or C, D)" becomes "A, B" and "A, C, D"
+func expand(lhs []Condition) ([]branch, error) {
+
+	list := []branch{branch{}}
+	for _, condition := range lhs {
+		if condition.Any == nil {
+			for i, b := range list {
+				list[i].index = append(b.index, len(b.lhs))
+				list[i].lhs = append(b.lhs, condition)
+			}
+			continue
+		}
+		if condition.NotExists {
+			return nil, fmt.Errorf("Alternatives cannot be negated")
+		}
+		if condition.Label != "" {
+			return nil, fmt.Errorf("Label %s cannot be used with alternatives", condition.Label)
+		}
+		if condition.ObjectId != nil || condition.Attribute != "" || condition.Value != nil || condition.ForAll != nil || condition.Aggregate != nil || condition.None != nil {
+			return nil, fmt.Errorf("A condition with alternatives cannot also have an object, attribute, value, forall, aggregate or negated group")
+		}
+		var alternatives [][]Condition
+		for _, group := range condition.Any {
+			if len(group) == 0 {
+				return nil, fmt.Errorf("A group of alternatives has no conditions")
+			}
+			sub, err := expand(group)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range sub {
+				alternatives = append(alternatives, s.lhs)
+			}
+		}
+		var next []branch
+		for _, b := range list {
+			for _, alternative := range alternatives {
+				//full slices, so that the branches never share an array
+				next = append(next, branch{
+					lhs:   append(b.lhs[:len(b.lhs):len(b.lhs)], alternative...),
+					index: append(b.index[:len(b.index):len(b.index)], -1),
+				})
+			}
+		}
+		list = next
+	}
+	return list, nil
+}
+
+//rule returns the rule as it reads in the branch: its LHS is the branch's conditions, and
+//retractions and modifications given by condition index are renumbered to match
+func (b branch) rule(r Rule) (Rule, error) {
+
+	r.LHS = b.lhs
+	target := func(t interface{}) (interface{}, error) {
+		i, ok := t.(int)
+		if !ok {
+			return t, nil
+		}
+		if i < 0 || i >= len(b.index) {
+			return nil, fmt.Errorf("Target %d is not a condition of %s", i, r.Id)
+		}
+		if b.index[i] < 0 {
+			return nil, fmt.Errorf("Target %d is a condition with alternatives and matches no single fact", i)
+		}
+		return b.index[i], nil
+	}
+
+	retractions := make([]Retraction, len(r.Retractions))
+	for i, retraction := range r.Retractions {
+		t, err := target(retraction.Target)
+		if err != nil {
+			return r, err
+		}
+		retractions[i] = Retraction{Target: t}
+	}
+	modifications := make([]Modification, len(r.Modifications))
+	for i, modification := range r.Modifications {
+		t, err := target(modification.Target)
+		if err != nil {
+			return r, err
+		}
+		modifications[i] = Modification{Target: t, Value: modification.Value}
+	}
+	r.Retractions = retractions
+	r.Modifications = modifications
+	return r, nil
+}
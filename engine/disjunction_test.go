@@ -0,0 +1,201 @@
+package engine
+
+import "bytes"
+import "strings"
+import "testing"
+
+func TestDisjunction(t *testing.T) {
+
+	var p Variable = "p"
+	var f Variable = "f"
+
+	testEngine := Engine{}
+	rules := []Rule{
+		//fever and either a cough, or a sneeze and tiredness
+		Rule{
+			Id: "flu",
+			LHS: []Condition{
+				Condition{ObjectId: p, Attribute: "fever", Comparator: EQ, Value: true},
+				Condition{Any: [][]Condition{
+					[]Condition{Condition{ObjectId: p, Attribute: "cough", Comparator: EQ, Value: true}},
+					[]Condition{
+						Condition{ObjectId: p, Attribute: "sneeze", Comparator: EQ, Value: true},
+						Condition{ObjectId: p, Attribute: "tired", Comparator: EQ, Value: true},
+					},
+				}},
+			},
+			RHS: []Inference{Inference{ObjectId: p, Attribute: "suspect", Value: "flu"}},
+		},
+		//nested alternatives, and a retraction of the condition after them by index
+		Rule{
+			Id: "triage",
+			LHS: []Condition{
+				Condition{Any: [][]Condition{
+					[]Condition{Condition{ObjectId: p, Attribute: "pain", Comparator: GT, Value: 7}},
+					[]Condition{Condition{Any: [][]Condition{
+						[]Condition{Condition{ObjectId: p, Attribute: "bleeding", Comparator: EQ, Value: true}},
+						[]Condition{Condition{ObjectId: p, Attribute: "unconscious", Comparator: EQ, Value: true}},
+					}}},
+				}},
+				Condition{Label: f, ObjectId: p, Attribute: "queue", Comparator: EQ, Value: "normal"},
+			},
+			RHS:         []Inference{Inference{ObjectId: p, Attribute: "queue", Value: "urgent"}},
+			Retractions: []Retraction{Retraction{Target: 1}},
+		},
+	}
+	for _, r := range rules {
+		err := testEngine.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+	if len(testEngine.productions) != 5 {
+		t.Fatalf("Test 1: expected 2 + 3 branches, got %d\n", len(testEngine.productions))
+	}
+	defined := testEngine.Rules()
+	if len(defined) != 2 || defined[0].Id != "flu" || defined[1].Id != "triage" {
+		t.Errorf("Test 1: expected the rules once each, got %v\n", defined)
+	}
+
+	//either branch fires the same rule
+	for _, fct := range []Fact{
+		Fact{"ann", "fever", true},
+		Fact{"ann", "cough", true},
+		Fact{"bob", "fever", true},
+		Fact{"bob", "sneeze", true},
+		Fact{"cat", "fever", true},
+		Fact{"cat", "tired", true},
+	} {
+		err := testEngine.Assert(fct)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	result, _ := testEngine.GetInferences("", "suspect")
+	if len(result) != 1 || result[0].ObjectId != "ann" {
+		t.Errorf("Test 2: expected ann only, got %v\n", result)
+	}
+	err := testEngine.Assert(Fact{"bob", "tired", true})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	justifications, err := testEngine.Justify(Fact{"bob", "suspect", "flu"})
+	if err != nil || len(justifications) != 1 || justifications[0].RuleId != "flu" || len(justifications[0].Facts) != 3 {
+		t.Errorf("Test 2: expected bob's flu justified by the three facts of flu, got %v %v\n", justifications, err)
+	}
+	err = testEngine.Retract(Fact{"ann", "cough", true})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	result, _ = testEngine.GetInferences("", "suspect")
+	if len(result) != 1 || result[0].ObjectId != "bob" {
+		t.Errorf("Test 2: expected bob only, got %v\n", result)
+	}
+
+	//both branches matching make the same inference, withdrawn when neither matches
+	err = testEngine.Assert(Fact{"bob", "cough", true})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = testEngine.Retract(Fact{"bob", "sneeze", true})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	result, _ = testEngine.GetInferences("bob", "suspect")
+	if len(result) != 1 {
+		t.Errorf("Test 3: expected bob's flu to remain, got %v\n", result)
+	}
+
+	//the retraction targets the condition after the alternatives in every branch
+	for _, fct := range []Fact{
+		Fact{"dan", "queue", "normal"},
+		Fact{"dan", "unconscious", true},
+		Fact{"eve", "queue", "normal"},
+		Fact{"eve", "pain", 3},
+	} {
+		err := testEngine.Assert(fct)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	facts, _ := testEngine.GetFacts("", "queue")
+	if len(facts) != 2 || facts[0] != (Fact{"eve", "queue", "normal"}) || facts[1] != (Fact{"dan", "queue", "urgent"}) {
+		t.Errorf("Test 4: expected dan to be queued as urgent, got %v\n", facts)
+	}
+
+	diagnosis, err := testEngine.WhyNot("triage")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(diagnosis.Branches) != 3 || diagnosis.Branches[2].Branch != 2 || len(diagnosis.Branches[0].Conditions) != 2 {
+		t.Errorf("Test 5: expected a diagnosis of each of 3 branches, got %+v\n", diagnosis)
+	}
+	if !strings.Contains(diagnosis.String(), "  branch 0\n    [0] ?p pain GT 7: 0 facts\n") {
+		t.Errorf("Test 5: unexpected diagnosis\n%s", diagnosis.String())
+	}
+	if s := rules[1].LHS[0].String(); s != "(?p pain GT 7 or (?p bleeding EQ true or ?p unconscious EQ true))" {
+		t.Errorf("Test 5: unexpected condition %s\n", s)
+	}
+
+	//a snapshot restores the matches of each branch
+	var buf bytes.Buffer
+	err = testEngine.Snapshot(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	restored := Engine{}
+	err = restored.Restore(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(restored.productions) != 5 || len(restored.Rules()) != 2 {
+		t.Errorf("Test 6: expected the rules to be restored with their branches\n")
+	}
+	result, _ = restored.GetInferences("", "")
+	if len(result) != 2 {
+		t.Errorf("Test 6: expected 2 inferences, got %v\n", result)
+	}
+
+	//undefining removes every branch
+	err = testEngine.Undefine("flu")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	result, _ = testEngine.GetInferences("", "suspect")
+	if len(testEngine.productions) != 3 || len(result) != 0 {
+		t.Errorf("Test 7: expected flu to be gone, got %d p-nodes and %v\n", len(testEngine.productions), result)
+	}
+}
+
+func TestDisjunctionErrors(t *testing.T) {
+
+	var p Variable = "p"
+	var x Variable = "x"
+
+	cough := Condition{ObjectId: p, Attribute: "cough", Comparator: EQ, Value: true}
+	sneeze := Condition{ObjectId: x, Attribute: "sneeze", Comparator: EQ, Value: true}
+	either := Condition{Any: [][]Condition{[]Condition{cough}, []Condition{sneeze}}}
+	infer := []Inference{Inference{ObjectId: p, Attribute: "ill", Value: true}}
+
+	for i, test := range []struct {
+		rule Rule
+		msg  string
+	}{
+		{Rule{Id: "unbound", LHS: []Condition{either}, RHS: infer}, "Branch 1 of unbound: Variable p in unbound is not bound by a condition"},
+		{Rule{Id: "negated", LHS: []Condition{cough, Condition{NotExists: true, Any: either.Any}}}, "Alternatives cannot be negated"},
+		{Rule{Id: "labelled", LHS: []Condition{Condition{Label: "f", Any: either.Any}}}, "Label f cannot be used with alternatives"},
+		{Rule{Id: "mixed", LHS: []Condition{Condition{Attribute: "cough", Any: either.Any}}}, "A condition with alternatives cannot also have an object, attribute, value, forall, aggregate or negated group"},
+		{Rule{Id: "empty", LHS: []Condition{Condition{Any: [][]Condition{[]Condition{cough}, nil}}}}, "A group of alternatives has no conditions"},
+		{Rule{Id: "target", LHS: []Condition{either}, Retractions: []Retraction{Retraction{Target: 0}}}, "Branch 0 of target: Target 0 is a condition with alternatives and matches no single fact"},
+		{Rule{Id: "range", LHS: []Condition{either}, Retractions: []Retraction{Retraction{Target: 1}}}, "Branch 0 of range: Target 1 is not a condition of range"},
+	} {
+		testEngine := Engine{}
+		err := testEngine.Define(test.rule)
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("Test %d: expected %q, got %v\n", i+1, test.msg, err)
+		}
+		if len(testEngine.productions) != 0 {
+			t.Errorf("Test %d: expected no branch to be defined\n", i+1)
+		}
+	}
+}
@@ -3,7 +3,10 @@ package engine
 import "container/list"
 import "fmt"
 //import "log"
+import "math/rand"
 import "reflect"
+import "sort"
+import "sync"
 
 type Variable string
 
@@ -41,11 +44,14 @@ func (op Operator) String() string {
 type Fact struct {
 	ObjectId  string
 	Attribute string
-	Value     interface{} //scalars only (in this version)
+	Value     interface{} //a string, number, bool, time.Time, time.Duration or Null
 }
 
 func (fact Fact) String() string {
 //this is primarily for debugging
+	if typed(fact.Value) {
+		return fmt.Sprintf("O %s A %s V %s",fact.ObjectId,fact.Attribute,formatTyped(fact.Value))
+	}
 	reflectedValue := reflect.ValueOf(fact.Value)
 
 	switch reflectedValue.Kind() {
@@ -53,6 +59,8 @@ func (fact Fact) String() string {
 		return fmt.Sprintf("O %s A %s V %s",fact.ObjectId,fact.Attribute,reflectedValue.String())
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		return fmt.Sprintf("O %s A %s V %d",fact.ObjectId,fact.Attribute,reflectedValue.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return fmt.Sprintf("O %s A %s V %d",fact.ObjectId,fact.Attribute,reflectedValue.Uint())
 	case reflect.Float32, reflect.Float64:
 		return fmt.Sprintf("O %s A %s V %f",fact.ObjectId,fact.Attribute,reflectedValue.Float())
 	default:
@@ -61,51 +69,282 @@ func (fact Fact) String() string {
 }
 
 type Condition struct {
-	NotExists  bool        //negation of existential quantification
+	NotExists  bool        //negation of existential quantification: no fact agrees with the variables bound by earlier conditions
 	ObjectId   interface{} //string or Variable
 	Attribute  string
 	Comparator Operator
 	Value      interface{}
+	Label      Variable //optional name for the matched fact itself (see Retraction)
+	Any        [][]Condition //alternatives: if set, the other fields are unused and the condition holds when every condition of any one group does
+	ForAll     []Condition   //if set, the other fields are unused and the condition holds when every fact matching the first of these matches the rest
+	Aggregate  *Aggregate    //if set, the condition holds when the result passes the test of Comparator and Value (which may be nil, for any result); ObjectId and Attribute are unused
+	None       []Condition   //a negated group: if set, the other fields are unused and the condition holds when no facts match all of these together
+}
+
+func (condition Condition) String() string {
+
+	var s string
+	if condition.Any != nil {
+		for i, group := range condition.Any {
+			if i > 0 {
+				s += " or "
+			}
+			for j, c := range group {
+				if j > 0 {
+					s += ", "
+				}
+				s += c.String()
+			}
+		}
+		return "(" + s + ")"
+	}
+	if condition.ForAll != nil {
+		for i, c := range condition.ForAll {
+			switch i {
+			case 0:
+			case 1:
+				s += ": "
+			default:
+				s += ", "
+			}
+			s += c.String()
+		}
+		return "forall (" + s + ")"
+	}
+	if condition.None != nil {
+		for i, c := range condition.None {
+			if i > 0 {
+				s += ", "
+			}
+			s += c.String()
+		}
+		return "not (" + s + ")"
+	}
+	if a := condition.Aggregate; a != nil {
+		s = a.Function
+		if a.Of != "" {
+			s += " ?" + string(a.Of)
+		}
+		for i, c := range a.Conditions {
+			if i == 0 {
+				s += " ("
+			} else {
+				s += ", "
+			}
+			s += c.String()
+		}
+		s += ")"
+		switch v := condition.Value.(type) {
+		case nil:
+		case Variable:
+			s += fmt.Sprintf(" %s ?%s", condition.Comparator.String(), string(v))
+		case string:
+			s += fmt.Sprintf(" %s %q", condition.Comparator.String(), v)
+		default:
+			s += fmt.Sprintf(" %s %v", condition.Comparator.String(), v)
+		}
+		if a.Into != "" {
+			s += " as ?" + string(a.Into)
+		}
+		return s
+	}
+	if condition.Label != "" {
+		s = fmt.Sprintf("?%s <- ", condition.Label)
+	}
+	if condition.NotExists {
+		s += "not "
+	}
+	switch v := condition.ObjectId.(type) {
+	case Variable:
+		s += "?" + string(v)
+	case string:
+		if v == "" {
+			s += "*"
+		} else {
+			s += v
+		}
+	default:
+		s += fmt.Sprintf("%v", v)
+	}
+	switch v := condition.Value.(type) {
+	case Variable:
+		return fmt.Sprintf("%s %s %s ?%s", s, condition.Attribute, condition.Comparator.String(), string(v))
+	case string:
+		return fmt.Sprintf("%s %s %s %q", s, condition.Attribute, condition.Comparator.String(), v)
+	default:
+		return fmt.Sprintf("%s %s %s %v", s, condition.Attribute, condition.Comparator.String(), v)
+	}
 }
 
 type Rule struct {
-	Id  string
-	LHS []Condition
-	RHS []Inference
+	Id       string
+	Salience int //rules with higher salience fire first
+	LHS      []Condition
+	RHS      []Inference
+	Actions  []Action //called after the inferences are made
+	Retractions   []Retraction   //carried out after the actions
+	Modifications []Modification //carried out after the actions
 }
 
 type Inference struct {
-	ObjectId  interface{} //string or Variable
+	ObjectId  interface{} //string, Variable or Expression
 	Attribute string
-	Value     interface{}
+	Value     interface{} //constant, Variable or Expression
 }
 
+//An Engine is safe for concurrent use by multiple goroutines. The methods that change it
+//(Define, Undefine, Assert, Retract, RegisterAction, SetStrategy, SetSeed, Restore and the
+//Commit of a Transaction) run one at a time, each to completion. The methods that only read
+//it (GetInferences, GetFacts, Rules, Justify, Explain, WhyNot and Snapshot) may run in parallel
+//with one another, and each sees the engine as it was between two changes, never part way
+//through one. Action functions are called while a change is in progress, so they must not
+//call the methods of their engine.
 type Engine struct {
 
-	agenda list.List //used as FIFO queue of *Fact
+	lock sync.RWMutex //held exclusively by the methods that change the engine
+	pending list.List //used as FIFO queue of *Fact awaiting propagation
+	queued map[*Fact]*list.Element //the element of each fact in pending
+	agenda []*activation //the conflict set
+	strategy Strategy
+	random *rand.Rand
+	clock uint64 //source of time tags for facts and activations
+	timetags map[*Fact]uint64 //the working memory: every fact asserted or inferred, and not yet retracted
+	workingMemory map[factKey]*Fact //the same facts, indexed by content
 	alphaNetwork map[string][]*alphaNode //keyed by attribute
-	nullFact Fact
+	alphaIndex map[alphaKey][]*alphaNode
+	alphaCount uint64 //alpha nodes created
+	inferred map[factKey]*Fact //inferences, each shared by all of the matches that make it
+	support map[*Fact]int //the number of matches (or kept inferences) making each inference
+	kept map[*Fact][]*keptInference //the kept inferences of every rule, by fact
+	nullFact *Fact //matched by negated, forall and negated group conditions
 	productions []*pNode
+	actions map[string]registeredAction //keyed by name
+	journal *journal //set while a transaction is being committed
 }
 
-func (engine Engine) GetInferences(objectId string, attribute string) ([]Fact, error) {
-	
+func (engine *Engine) GetInferences(objectId string, attribute string) ([]Fact, error) {
+
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
 	var list []Fact
+	seen := make(map[factKey]bool) //several matches may make the same inference
+	add := func(f *Fact) {
+		if f == nil || (objectId != "" && f.ObjectId != objectId) || (attribute != "" && f.Attribute != attribute) {
+			return
+		}
+		k := factKeyOf(f)
+		if !seen[k] {
+			seen[k] = true
+			list = append(list, *f)
+		}
+	}
 	for _, p := range engine.productions {
 		for _, t := range p.tokens {
 			for _, f := range t.outgoing {
-				if f != nil && (objectId == "" || f.ObjectId == objectId) && (attribute == "" || f.Attribute == attribute) {
-					list = append(list, *f)
-				}
+				add(f)
+			}
+		}
+		for _, k := range p.kept {
+			add(k.fact)
+		}
+	}
+	return list, nil
+}
+
+//GetFacts returns the facts held in working memory (asserted and inferred) in the
+//order they arrived, filtered in the same way as GetInferences
+func (engine *Engine) GetFacts(objectId string, attribute string) ([]Fact, error) {
+
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	list := make([]Fact, 0, len(engine.timetags))
+	seen := make(map[factKey]bool, len(engine.timetags)) //an inference equal to an asserted fact is listed once
+	add := func(f *Fact) {
+		if f == nil || (objectId != "" && f.ObjectId != objectId) || (attribute != "" && f.Attribute != attribute) {
+			return
+		}
+		k := factKeyOf(f)
+		if !seen[k] {
+			seen[k] = true
+			list = append(list, *f)
+		}
+	}
+
+	for _, f := range engine.memory() {
+		add(f)
+	}
+	for _, p := range engine.productions {
+		for _, t := range p.tokens {
+			for _, f := range t.outgoing {
+				add(f)
+			}
+		}
+		for _, k := range p.kept {
+			add(k.fact)
+		}
+	}
+	return list, nil
+}
+
+//Rules returns the rules defined in the engine, in the order they were defined
+func (engine *Engine) Rules() []Rule {
+
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	list := make([]Rule, 0, len(engine.productions))
+	for _, p := range engine.productions {
+		if p.branch == 0 { //once for a rule with alternatives
+			list = append(list, p.rule)
+		}
+	}
+	return list
+}
+
+//Justification records a rule firing that inferred a fact
+type Justification struct {
+	RuleId string
+	Facts  []Fact //the facts matching each condition (zero for a negated condition or group, and the function and its result for an aggregate) of the branch that fired
+}
+
+//Justify returns every rule firing that inferred the given fact
+func (engine *Engine) Justify(fct Fact) ([]Justification, error) {
+
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	var list []Justification
+	err := engine.derivations(fct, func(p *pNode, t *token, support []Fact) error {
+		j := Justification{RuleId: p.ruleId}
+		if t == nil {
+			j.Facts = support
+			list = append(list, j)
+			return nil
+		}
+		for _, in := range t.incoming {
+			if in != nil {
+				j.Facts = append(j.Facts, *in)
+			} else {
+				j.Facts = append(j.Facts, Fact{})
 			}
 		}
+		list = append(list, j)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return list, nil
 }
 
-func (engine *Engine) Assert(fct Fact) (err error) {	
+func (engine *Engine) Assert(fct Fact) (err error) {
+
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
 
-	engine.pushAgenda(&fct)
+	engine.pushFact(&fct)
 	err = engine.turn()
 	if err != nil {
 		return err
@@ -115,6 +354,9 @@ func (engine *Engine) Assert(fct Fact) (err error) {
 
 func (engine *Engine) Retract(fct Fact) (err error) {
 
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
 	f, err := engine.find(fct)
 	if err != nil {
 		return err
@@ -125,122 +367,407 @@ func (engine *Engine) Retract(fct Fact) (err error) {
 		return err
 	}
 
+	//retraction may have completed tokens with negated conditions
+	err = engine.turn()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
 func (engine *Engine) Define(r Rule) (err error) {
 
-	var newAlphaNode *alphaNode
-	var newBetaNode *betaNode
-	var newPNode *pNode
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
 
-	/*if this is the first time Define has been run for this engine
-	  then the alpha network must be initialized */
-	if engine.alphaNetwork == nil {
-		engine.nullFact = Fact{} //represents an absence of facts
-		engine.alphaNetwork = make(map[string][]*alphaNode,5) //keyed by attribute
+	return engine.define(r)
+}
+
+func (engine *Engine) define(r Rule) (err error) {
+
+	if len(r.LHS) == 0 {
+		return fmt.Errorf("Rule %s has no conditions", r.Id)
+	}
+	for _, p := range engine.productions {
+		if p.ruleId == r.Id {
+			return fmt.Errorf("Rule %s is already defined", r.Id)
+		}
+	}
+
+	//look up the actions first, so that an unknown one leaves the engine untouched
+	var actions []registeredAction
+	for _, a := range r.Actions {
+		registered, ok := engine.actions[a.Name]
+		if !ok {
+			return fmt.Errorf("Action %s is not registered",a.Name)
+		}
+		actions = append(actions, registered)
+	}
+
+	//a rule with alternatives has a p-node for each branch, all checked before any is added
+	branches, err := expand(r.LHS)
+	if err != nil {
+		return err
+	}
+	var nodes []*pNode
+	for n, b := range branches {
+		br, err := b.rule(r)
+		if err == nil {
+			var node *pNode
+			node, err = engine.compile(br, actions)
+			if err == nil {
+				node.rule = r //as defined, with its alternatives
+				node.branch = n
+				nodes = append(nodes, node)
+				continue
+			}
+		}
+		if len(branches) > 1 {
+			return fmt.Errorf("Branch %d of %s: %w", n, r.Id, err)
+		}
+		return err
+	}
+	for _, node := range nodes {
+		err = engine.build(node)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//compile checks a rule without alternatives and makes its p-node, with the variables
+//processed into its test network, but does not add it to the network
+func (engine *Engine) compile(r Rule, actions []registeredAction) (*pNode, error) {
+
+	changes, err := compileChanges(r)
+	if err != nil {
+		return nil, err
+	}
+	err = checkTerms(r)
+	if err != nil {
+		return nil, err
 	}
 
-	//create the p-node, but do not add inferences, yet
-	newPNode = &pNode{}
+	newPNode := &pNode{}
 	newPNode.parentEngine = engine
 	newPNode.ruleId = r.Id
+	newPNode.lhs = r.LHS
+	newPNode.salience = r.Salience
 	newPNode.testNetwork = make(map[Variable][]betaTest,5)
-	engine.productions = append(engine.productions, newPNode)
+	newPNode.inferences = r.RHS
+	newPNode.actions = actions
+	newPNode.changes = changes
 
-	//iterate over the conditions
+	//process the variables (if any) into the p-node's test network
 	for i, condition := range r.LHS {
-		newAlphaNode = nil
-		//if this attribute hasn't been seen before, add it
-		_, ok := engine.alphaNetwork[condition.Attribute]
-		if !ok {
-			engine.alphaNetwork[condition.Attribute] = make([]*alphaNode,0)
+		if condition.Aggregate != nil {
+			//the value of an aggregate's fact is its result, which the aggregate may bind
+			if condition.Aggregate.Into != "" {
+				tmp := betaTest {
+						tokenIndex: i,
+						objectElseValue: false,
+				}
+				newPNode.testNetwork[condition.Aggregate.Into] = append(newPNode.testNetwork[condition.Aggregate.Into], tmp)
+			}
+			continue
 		}
-		condObjIdType := reflect.TypeOf(condition.ObjectId).Name()
-		condValueType := reflect.TypeOf(condition.Value).Name()
-		//error condition check:
-		if condValueType == "Variable" && condition.Comparator != EQ {
-			return fmt.Errorf("Value variable cannot be used with %s",condition.Comparator.String())
+		objVariable, objIsVariable := condition.ObjectId.(Variable)
+		valueVariable, valueIsVariable := condition.Value.(Variable)
+		if objIsVariable {
+			tmp := betaTest {
+					tokenIndex: i,
+					objectElseValue: true,
+			}
+			newPNode.testNetwork[objVariable] = append(newPNode.testNetwork[objVariable], tmp)
 		}
-		tempNode := alphaNode{}
-		tempNode.parentEngine = engine
-		tempNode.attributeName = condition.Attribute
-		if condObjIdType != "Variable" {
-			tempNode.objConstraint = condition.ObjectId.(string)
+		//a value variable with another operator is a relational test, and binds nothing
+		if valueIsVariable && condition.Comparator == EQ {
+			tmp := betaTest {
+					tokenIndex: i,
+					objectElseValue: false,
+			}
+			newPNode.testNetwork[valueVariable] = append(newPNode.testNetwork[valueVariable], tmp)
 		}
-		tempNode.comparator = condition.Comparator
-		if condValueType != "Variable" {
-			tempNode.compareTo = condition.Value
+	}
+
+	//forall, aggregate and negated group conditions join conditions of their own
+	for i, condition := range r.LHS {
+		var q *quantifier
+		var err error
+		switch {
+		case condition.Aggregate != nil:
+			q, err = compileAggregate(newPNode.testNetwork, r.LHS, i)
+		case condition.ForAll != nil:
+			q, err = compileForAll(newPNode.testNetwork, r.LHS, i)
+		case condition.None != nil:
+			q, err = compileNone(newPNode.testNetwork, r.LHS, i)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if newPNode.quantifiers == nil {
+			newPNode.quantifiers = make(map[int]*quantifier)
+		}
+		newPNode.quantifiers[i] = q
+	}
+
+	//error condition check: a relational test compares with a value bound earlier
+	for i, condition := range r.LHS {
+		valueVariable, ok := condition.Value.(Variable)
+		if !ok || condition.Comparator == EQ || condition.Aggregate != nil {
+			continue
+		}
+		if _, ok := firstBinding(newPNode.testNetwork, r.LHS, valueVariable, i); !ok {
+			return nil, fmt.Errorf("Value variable %s must be bound by an earlier condition to be used with %s",valueVariable,condition.Comparator.String())
 		}
-		//if an alpha node already exists with these features, re-use it
-		for j, compareNode := range engine.alphaNetwork[condition.Attribute] {
-			compareToMatched, err := match(tempNode.compareTo,EQ,compareNode.compareTo)
+	}
+	return newPNode, nil
+}
+
+//build adds the nodes for a compiled p-node to the network and primes it
+func (engine *Engine) build(newPNode *pNode) error {
+
+	var newAlphaNode *alphaNode
+	var newJoinNode *joinNode
+	var fresh []*alphaNode //alpha nodes created for this rule
+	var first *joinNode //the first join node created for this rule
+
+	/*if this is the first time Define has been run for this engine
+	  then the alpha network must be initialized */
+	if engine.alphaNetwork == nil {
+		engine.nullFact = &Fact{} //represents an absence of facts
+		engine.alphaNetwork = make(map[string][]*alphaNode,5) //keyed by attribute
+	}
+
+	//iterate over the conditions
+	var parent *joinNode
+	for i, condition := range newPNode.lhs {
+		var created bool
+		var err error
+		q := newPNode.quantifiers[i]
+		if q != nil {
+			//the alpha nodes of the quantifier's own conditions, the first standing for it
+			for _, c := range q.conditions {
+				aNode, created, err := engine.alphaFor(c)
+				if err != nil {
+					return err
+				}
+				if created {
+					fresh = append(fresh, aNode)
+				}
+				q.alphas = append(q.alphas, aNode)
+			}
+			newAlphaNode = q.alphas[0]
+		} else {
+			newAlphaNode, created, err = engine.alphaFor(condition)
 			if err != nil {
 				return err
 			}
-			if tempNode.objConstraint == compareNode.objConstraint && 
-			   tempNode.comparator == compareNode.comparator && 
-			   compareToMatched {
-				newAlphaNode = engine.alphaNetwork[condition.Attribute][j]
+			if created {
+				fresh = append(fresh, newAlphaNode)
+			}
+		}
+
+		//if a rule with the same leading conditions has a join node for this one, share it
+		//(the join nodes of quantifiers are not shared)
+		tests := compileTests(newPNode.testNetwork, newPNode.lhs, i)
+		newJoinNode = nil
+		for _, jNode := range newAlphaNode.successors {
+			if q == nil && jNode.quantifier == nil && jNode.parent == parent && jNode.negated == condition.NotExists && sameTests(jNode.tests, tests) {
+				newJoinNode = jNode
 				break
 			}
 		}
 		//otherwise, add a new one
-		if newAlphaNode == nil {
-			newAlphaNode = &tempNode
-			engine.alphaNetwork[condition.Attribute] = append(engine.alphaNetwork[condition.Attribute], newAlphaNode)
+		if newJoinNode == nil {
+			newJoinNode = &joinNode{
+				index:      i,
+				negated:    condition.NotExists,
+				tests:      tests,
+				quantifier: q,
+				alpha:      newAlphaNode,
+				parent:     parent,
+			}
+			//newest first, so that a fact reaches the later conditions of a rule before the earlier ones
+			for _, aNode := range newJoinNode.alphas() {
+				if len(aNode.successors) == 0 || aNode.successors[0] != newJoinNode { //once, if conditions share it
+					aNode.successors = append([]*joinNode{newJoinNode}, aNode.successors...)
+				}
+			}
+			if parent != nil {
+				parent.children = append(parent.children, newJoinNode)
+			}
+			if first == nil {
+				first = newJoinNode
+			}
+		}
+		newPNode.joins = append(newPNode.joins, newJoinNode)
+		parent = newJoinNode
+	}
+	parent.products = append(parent.products, newPNode)
+	engine.productions = append(engine.productions, newPNode)
+	newPNode.quantifiers = nil
+
+	return engine.prime(newPNode, fresh, first)
+}
+
+//alphaFor returns the alpha node for the constant tests of a condition, which is created
+//(and reported as such) if no other condition has one
+func (engine *Engine) alphaFor(condition Condition) (*alphaNode, bool, error) {
+
+	tempNode := alphaNode{}
+	tempNode.parentEngine = engine
+	tempNode.attributeName = condition.Attribute
+	if _, ok := condition.ObjectId.(Variable); !ok {
+		tempNode.objConstraint = condition.ObjectId.(string)
+	}
+	tempNode.comparator = EQ //any value, for a variable
+	if _, ok := condition.Value.(Variable); !ok {
+		tempNode.comparator = condition.Comparator
+		tempNode.compareTo = condition.Value
+	}
+	//if an alpha node already exists with these features, re-use it
+	for _, compareNode := range engine.alphaIndex[tempNode.key()] {
+		compareToMatched, err := match(tempNode.compareTo,EQ,compareNode.compareTo)
+		if err != nil {
+			return nil, false, err
 		}
+		if tempNode.objConstraint == compareNode.objConstraint && 
+		   tempNode.comparator == compareNode.comparator && 
+		   compareToMatched {
+			return compareNode, false, nil
+		}
+	}
+	//otherwise, add a new one
+	newAlphaNode := &tempNode
+	engine.alphaNetwork[condition.Attribute] = append(engine.alphaNetwork[condition.Attribute], newAlphaNode)
+	engine.indexAlphaNode(newAlphaNode)
+	return newAlphaNode, true, nil
+}
 
-		/*create an empty beta node
-		  (the alpha nodes are housed in a map, but the
-		   beta nodes just float out there in memory space) */
-		newBetaNode = &betaNode{}
+//Undefine removes a rule from the engine. Its inferences are retracted and its actions
+//undone, as if all of its matches had been broken, so the results of the remaining rules
+//are what they would be had the rule never been defined. Join and alpha nodes that no
+//other rule uses are removed as well.
+func (engine *Engine) Undefine(ruleId string) (err error) {
 
-		//start populating it
-		newAlphaNode.betaNodes = append(newAlphaNode.betaNodes, newBetaNode)
-		newBetaNode.index = i
-		newBetaNode.parentNode = newAlphaNode
-		newBetaNode.product = newPNode
-		newPNode.betaNodes = append(newPNode.betaNodes, newBetaNode)
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
 
-		if condition.NotExists {
-			newBetaNode.alphaNot = true
+	var nodes []*pNode //one for each branch of the rule
+	for _, p := range engine.productions {
+		if p.ruleId == ruleId {
+			nodes = append(nodes, p)
+		}
+	}
+	if len(nodes) == 0 {
+		return fmt.Errorf("Undefine: rule %s is not defined", ruleId)
+	}
+	for _, node := range nodes {
+		err = engine.undefine(node)
+		if err != nil {
+			return err
 		}
+	}
+	return engine.turn()
+}
 
-		//process the variables (if any) into the p-node's test network
-		if condObjIdType == "Variable" {
-			//if this variable hasn't been seen before, add it
-			_, ok := newPNode.testNetwork[condition.ObjectId.(Variable)]
-			if !ok {
-				 newPNode.testNetwork[condition.ObjectId.(Variable)] = make([]betaTest,0)
+//undefine removes the p-node of one branch of a rule, and the nodes that only it used
+func (engine *Engine) undefine(node *pNode) (err error) {
+
+	for i, p := range engine.productions {
+		if p == node {
+			engine.productions = append(engine.productions[:i], engine.productions[i+1:]...)
+			break
+		}
+	}
+
+	//detach the rule first, so that nothing withdrawn below can reach it
+	last := node.joins[len(node.joins)-1]
+	for j, p := range last.products {
+		if p == node {
+			last.products = append(last.products[:j], last.products[j+1:]...)
+			break
+		}
+	}
+	for _, tok := range node.tokens {
+		tokens := tok.source.tokens
+		for j, t := range tokens {
+			if t == tok {
+				tok.source.tokens = append(tokens[:j], tokens[j+1:]...)
+				break
 			}
-			tmp := betaTest {
-					tokenIndex: i,
-					objectElseValue: true,
+		}
+	}
+
+	//then the join nodes that no other rule uses, from the last condition back
+	for i := len(node.joins) - 1; i >= 0; i-- {
+		jNode := node.joins[i]
+		if len(jNode.products) > 0 || len(jNode.children) > 0 {
+			break
+		}
+		jNode.detach()
+	}
+
+	//and the alpha nodes that are no longer used
+	var alphas []*alphaNode
+	for _, jNode := range node.joins {
+		alphas = append(alphas, jNode.alphas()...)
+	}
+	for _, aNode := range alphas {
+		if len(aNode.successors) > 0 {
+			continue
+		}
+		list := engine.alphaNetwork[aNode.attributeName]
+		found := false
+		for j, a := range list {
+			if a == aNode {
+				list = append(list[:j], list[j+1:]...)
+				found = true
+				break
 			}
-			//the beta node will remember where it is
-			newBetaNode.objectVariable = condition.ObjectId.(Variable)
-			newBetaNode.objectIndex = len(newPNode.testNetwork[condition.ObjectId.(Variable)])
-			newPNode.testNetwork[condition.ObjectId.(Variable)] = append(newPNode.testNetwork[condition.ObjectId.(Variable)], tmp)
 		}
-		if condValueType == "Variable" {
-			//if this variable hasn't been seen before, add it
-			_, ok := newPNode.testNetwork[condition.Value.(Variable)]
-			if !ok {
-				 newPNode.testNetwork[condition.Value.(Variable)] = make([]betaTest,0)
+		if !found {
+			continue //already removed (two conditions of the rule shared it)
+		}
+		if len(list) == 0 {
+			delete(engine.alphaNetwork, aNode.attributeName)
+		} else {
+			engine.alphaNetwork[aNode.attributeName] = list
+		}
+		engine.unindexAlphaNode(aNode)
+	}
+
+	for _, tok := range node.tokens {
+		engine.deactivate(tok)
+		for j, f := range tok.outgoing {
+			if f == nil {
+				continue
 			}
-			tmp := betaTest {
-					tokenIndex: i,
-					objectElseValue: false,
+			err = engine.withdraw(f)
+			if err != nil {
+				return err
 			}
-			newBetaNode.valueVariable = condition.Value.(Variable)
-			newBetaNode.valueIndex = len(newPNode.testNetwork[condition.Value.(Variable)])
-			newPNode.testNetwork[condition.Value.(Variable)] = append(newPNode.testNetwork[condition.Value.(Variable)], tmp)
+			tok.outgoing[j] = nil
+		}
+		err = tok.undoActions()
+		if err != nil {
+			return err
+		}
+	}
+	node.tokens = nil
+	node.positions = nil
+	for _, k := range append([]*keptInference(nil), node.kept...) {
+		engine.unkeep(k)
+		err = engine.withdraw(k.fact)
+		if err != nil {
+			return err
 		}
 	}
-
-	//add inferences to p-node
-	newPNode.inferences = r.RHS
 
 	return nil
 }
@@ -251,20 +778,77 @@ func (engine *Engine) Define(r Rule) (err error) {
 
 func (engine *Engine) find(fct Fact) (*Fact, error) {
 
-	for _, node := range engine.alphaNetwork[fct.Attribute] {
-		for _, fptr := range node.facts {
-			matched, err := match(fptr.Value,EQ,fct.Value)
+	k := factKeyOf(&fct)
+	if f, ok := engine.workingMemory[k]; ok {
+		return f, nil
+	}
+	//a kept inference need not be in working memory (an equal fact may have been asserted first)
+	if f, ok := engine.inferred[k]; ok && len(engine.kept[f]) > 0 {
+		return f, nil
+	}
+	return nil, nil
+}
+
+//memory returns the working memory in time tag order
+func (engine *Engine) memory() []*Fact {
+
+	type tagged struct {
+		fact *Fact
+		tag  uint64
+	}
+	byTag := make([]tagged, 0, len(engine.timetags))
+	for f, tag := range engine.timetags {
+		byTag = append(byTag, tagged{f, tag})
+	}
+	sort.Slice(byTag, func(i, j int) bool { return byTag[i].tag < byTag[j].tag })
+	list := make([]*Fact, len(byTag))
+	for i, t := range byTag {
+		list[i] = t.fact
+	}
+	return list
+}
+
+//derivations calls found for every token that inferred the given fact,
+//and for every kept inference (with a nil token and the copied support)
+func (engine *Engine) derivations(fct Fact, found func(p *pNode, t *token, support []Fact) error) error {
+
+	for _, p := range engine.productions {
+		for _, t := range p.tokens {
+			for _, f := range t.outgoing {
+				if f == nil || f.ObjectId != fct.ObjectId || f.Attribute != fct.Attribute {
+					continue
+				}
+				matched, err := match(f.Value, EQ, fct.Value)
+				if err != nil {
+					return err
+				}
+				if !matched {
+					continue
+				}
+				err = found(p, t, nil)
+				if err != nil {
+					return err
+				}
+				break
+			}
+		}
+		for _, k := range p.kept {
+			if k.fact.ObjectId != fct.ObjectId || k.fact.Attribute != fct.Attribute {
+				continue
+			}
+			matched, err := match(k.fact.Value, EQ, fct.Value)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			if fptr.ObjectId == fct.ObjectId &&
-			   fptr.Attribute == fct.Attribute &&
-			   matched {
-				return fptr, nil
+			if matched {
+				err = found(p, nil, k.support)
+				if err != nil {
+					return err
+				}
 			}
 		}
 	}
-	return nil, nil
+	return nil
 }
 
 func (engine *Engine) retract(f *Fact) (err error) {
@@ -272,18 +856,111 @@ func (engine *Engine) retract(f *Fact) (err error) {
 	if f == nil {
 		return fmt.Errorf("Cannot retract nil")
 	}
+	engine.record(f)
 
-	for i, node := range engine.alphaNetwork[f.Attribute] {
-		for j, v := range node.facts {
-			if v == f {
-				engine.alphaNetwork[f.Attribute][i].removeFact(j)
+	for _, node := range engine.alphaCandidates(f) {
+		if i, ok := node.positions[f]; ok {
+			err = node.removeFact(i)
+			if err != nil {
+				return err
 			}
 		}
 	}
+	delete(engine.timetags, f)
+	if k := factKeyOf(f); engine.workingMemory[k] == f {
+		delete(engine.workingMemory, k)
+	}
+
+	//a fact may have been kept by rules that consumed their match
+	for _, k := range append([]*keptInference(nil), engine.kept[f]...) {
+		engine.unkeep(k)
+		engine.support[f]--
+	}
+	//an inference made again from now on is a new fact
+	if k := factKeyOf(f); engine.inferred[k] == f {
+		delete(engine.inferred, k)
+	}
+	if engine.support[f] <= 0 {
+		delete(engine.support, f)
+	}
+
+	//a fact may also be waiting to be propagated
+	if e, ok := engine.queued[f]; ok {
+		delete(engine.queued, f)
+		engine.pending.Remove(e)
+	}
 
 	return nil
 }
 
+//prime brings a newly defined rule up to date with the facts already in working memory:
+//the alpha nodes created for it are filled, and then every combination of facts that
+//matches the rule is found, as if the rule had been defined first. The join nodes shared
+//with other rules already hold their partial matches, so only the rest are filled.
+func (engine *Engine) prime(node *pNode, fresh []*alphaNode, first *joinNode) error {
+
+	memory := engine.memory()
+	for _, aNode := range fresh {
+		for _, f := range memory {
+			matched, err := aNode.matches(f)
+			if err != nil {
+				return err
+			}
+			if matched {
+				aNode.addFact(f)
+			}
+		}
+	}
+	if first != nil {
+		for _, left := range first.leftInputs() {
+			err := first.leftActivate(left)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		//every condition is shared, so the partial matches of the last are complete matches
+		for _, t := range node.joins[len(node.joins)-1].memory {
+			err := node.addToken(t)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return engine.turn()
+}
+
+//infer returns the fact to record as an inference. If another match has already made an
+//equal inference the two share it; otherwise f is new, and is queued for propagation.
+func (engine *Engine) infer(f *Fact) *Fact {
+
+	if engine.inferred == nil {
+		engine.inferred = make(map[factKey]*Fact)
+		engine.support = make(map[*Fact]int)
+	}
+	k := factKeyOf(f)
+	if g, ok := engine.inferred[k]; ok {
+		engine.support[g]++
+		return g
+	}
+	engine.inferred[k] = f
+	engine.support[f] = 1
+	engine.pushFact(f)
+	return f
+}
+
+//withdraw takes away one match's support for an inference, and retracts the inference
+//when no match supports it any more
+func (engine *Engine) withdraw(f *Fact) error {
+
+	if engine.support[f] > 1 {
+		engine.support[f]--
+		return nil
+	}
+	delete(engine.support, f)
+	return engine.retract(f)
+}
+
 func (engine *Engine) printAlphaNetwork() {
 	//this is for debugging
 	for k, nodeList := range engine.alphaNetwork {
@@ -295,7 +972,7 @@ func (engine *Engine) printAlphaNetwork() {
 			fmt.Printf("\tcomparator: %s\n",node.comparator.String())
 			fmt.Printf("\tcompareTo: %v\n", node.compareTo)
 			fmt.Printf("\tNo.Facts: %d\n", len(node.facts))
-			fmt.Printf("\tNo.Betas: %d\n", len(node.betaNodes))
+			fmt.Printf("\tNo.Betas: %d\n", len(node.successors))
 			for _, f := range node.facts {
 				fmt.Printf("\t\t%s\t%s\t%v\n", f.ObjectId, f.Attribute, f.Value)
 			}
@@ -307,14 +984,13 @@ func (engine *Engine) printBetaNetwork() {
 	//this is for debugging
 	for _, p := range engine.productions{
 		fmt.Printf("%s\n",p.ruleId)
-		for _, b := range p.betaNodes {
-			fmt.Printf("\tBeta Node %d, negation %t\n",b.index,b.alphaNot)
+		for _, j := range p.joins {
+			fmt.Printf("\tJoin Node %d, negation %t, tests %d, matches %d, rules %d\n",j.index,j.negated,len(j.tests),len(j.memory),len(j.products))
 		}
-		/* unfinished */
 	}
 }
 
-func (engine Engine) printTokens() error {
+func (engine *Engine) printTokens() error {
 	//this is for debugging	
 	for _, p := range engine.productions {
 		fmt.Println(p.ruleId)
@@ -340,385 +1016,204 @@ func (engine Engine) printTokens() error {
 	return nil
 }
 
-func (engine *Engine) pushAgenda(f *Fact) (err error) {
+func (engine *Engine) pushFact(f *Fact) (err error) {
 
-	_ = engine.agenda.PushFront(f)
+	if engine.queued == nil {
+		engine.queued = make(map[*Fact]*list.Element)
+	}
+	engine.queued[f] = engine.pending.PushFront(f)
 
 	return nil
 }
 
-func (engine *Engine) popAgenda() (f *Fact, err error) {
+func (engine *Engine) popFact() (f *Fact, err error) {
 
-	pop := engine.agenda.Back()
+	pop := engine.pending.Back()
 
 	if pop == nil {
 		return nil, nil
 	} else {
-		f = engine.agenda.Remove(pop).(*Fact)
+		f = engine.pending.Remove(pop).(*Fact)
+		if engine.queued[f] == pop {
+			delete(engine.queued, f)
+		}
 		return f, nil
 	}
 }
 
 //this is the main action loop: 
-//the engine "turns" until the agenda is empty
+//the engine "turns" until there are no pending facts and the agenda is empty
 func (engine *Engine) turn() error {
 
-	var duplicateAssertion bool
-
 	for {
-		duplicateAssertion = false
-		f, err := engine.popAgenda()
+		f, err := engine.popFact()
 		if err != nil {
 			return err
 		}
-		if f == nil {
+		if f != nil {
+			err = engine.propagate(f)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		//all facts have been propagated, so let the strategy pick a rule to fire
+		act := engine.selectActivation()
+		if act == nil {
 			break
 		}
-		//propagate f into the alpha network
-		alphaList, ok := engine.alphaNetwork[f.Attribute]
-		if ok {
-			for i, aNode := range alphaList {
-				if len(aNode.objConstraint) > 0 && f.ObjectId != aNode.objConstraint {
-					continue
-				}
-				if aNode.compareTo != nil {
-					matched, err := match(f.Value, aNode.comparator, aNode.compareTo)
-					if err != nil {
-						return err
-					}
-					if !matched {
-						continue
-					}
-				}
-				//check for duplication (this is inefficient)
-				for _, existing := range alphaList[i].facts {
-					valuesMatch, err := match(f.Value,EQ,existing.Value)
-					if err != nil {
-						return err
-					}
-					if f.ObjectId == existing.ObjectId && valuesMatch {
-						duplicateAssertion = true
-						break	
-					}
-				}
-				if duplicateAssertion {
-					break
-				}
-				//f hasn't been disqualified, so add it to the alpha node
-				alphaList[i].facts = append(alphaList[i].facts, f)
-				//right activate all of the beta nodes
-				for _, bNode := range aNode.betaNodes {
-					err = bNode.rightActivate(f)
-					if err != nil {
-						return err
-					}
-				}
-			}
-		} //else f is an irrelevant or duplicate fact
+		err = act.tok.containedBy.fire(act.tok)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-type alphaNode struct {
-
-	parentEngine *Engine
-
-	attributeName string
-	objConstraint string //object id equals
-
-	comparator Operator
-	compareTo  interface{} //scalars only (in this version)
-
-	facts []*Fact
-	betaNodes []*betaNode
-}
-
-func (node *alphaNode) removeFact(i int) error {
+//propagate adds a single fact to working memory and passes it into the alpha network
+func (engine *Engine) propagate(f *Fact) error {
 
-	if node == nil {
-		return fmt.Errorf("removeFact: node is nil\n")
+	//check for duplication
+	existing, err := engine.find(*f)
+	if err != nil {
+		return err
 	}
-
-	if i >= len(node.facts) {
-		return fmt.Errorf("removeFact: index is out of range\n")
+	if existing != nil {
+		return nil //f is a duplicate fact
 	}
-
-	node.facts[i] = node.facts[len(node.facts)-1]
-	node.facts[len(node.facts)-1] = nil
-	node.facts = node.facts[:len(node.facts)-1]
-
-	for _, bNode := range node.betaNodes {
-		for _, t := range bNode.product.tokens {
-			if len(node.facts) == 0 && bNode.alphaNot {//existential negation
-				t.incoming[bNode.index] = &node.parentEngine.nullFact
-				err := bNode.leftActivate(t)
-				if err != nil {
-					return err
-				}
-			} else {
-				t.damage(bNode.index)
-			}
+	if engine.timetags == nil {
+		engine.timetags = make(map[*Fact]uint64)
+		engine.workingMemory = make(map[factKey]*Fact)
+	}
+	engine.clock++
+	engine.timetags[f] = engine.clock
+	engine.workingMemory[factKeyOf(f)] = f
+
+	//add f to every alpha node it satisfies, and right activate the join nodes of each in turn
+	for _, aNode := range engine.alphaCandidates(f) {
+		if _, ok := engine.timetags[f]; !ok {
+			return nil //f was withdrawn by a rule that it blocked
 		}
-		if len(node.facts) == 0 && bNode.alphaNot && len(bNode.product.tokens) == 0 {
-			t, err := bNode.product.addToken(nil,0) //existential negation
-			if err != nil {
-				return err
-			}
-			err = bNode.leftActivate(t)
+		matched, err := aNode.matches(f)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			continue
+		}
+		//f hasn't been disqualified, so add it to the alpha node
+		aNode.addFact(f)
+		for _, jNode := range aNode.successors {
+			err = jNode.rightActivate(f)
 			if err != nil {
 				return err
 			}
 		}
 	}
-
 	return nil
 }
 
-func (node alphaNode) String() string {
-//this is primarily for debugging
-	reflectedValue := reflect.ValueOf(node.compareTo)
-
-	switch reflectedValue.Kind() {
-	case reflect.String:
-		return fmt.Sprintf("A %s O %s %s V %s F %d B %d",node.attributeName,node.objConstraint,node.comparator.String(),reflectedValue.String(),len(node.facts),len(node.betaNodes))
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return fmt.Sprintf("A %s O %s %s V %d F %d B %d",node.attributeName,node.objConstraint,node.comparator.String(),reflectedValue.Int(),len(node.facts),len(node.betaNodes))
-	case reflect.Float32, reflect.Float64:
-		return fmt.Sprintf("A %s O %s %s V %f F %d B %d",node.attributeName,node.objConstraint,node.comparator.String(),reflectedValue.Float(),len(node.facts),len(node.betaNodes))
-	default:
-		return fmt.Sprintf("A %s O %s V.Kind %s F %d B %d",node.attributeName,node.objConstraint, reflectedValue.Kind().String(), len(node.facts),len(node.betaNodes))
-	}
-}
-
-type betaNode struct {
-
-	index int //condition number
+type alphaNode struct {
 
-	alphaNot bool //existential negation
+	parentEngine *Engine
 
-	objectVariable Variable
-	objectIndex int
+	attributeName string
+	objConstraint string //object id equals
 
-	valueVariable Variable
-	valueIndex int
+	comparator Operator
+	compareTo  interface{} //scalars only (in this version)
 
-	//these must not be nil:
-	parentNode *alphaNode
-	product *pNode
+	facts []*Fact
+	positions map[*Fact]int //index of each fact in facts
+	successors []*joinNode //newest first
+	seq uint64 //creation order
 }
 
-//rightActivate handles the arrival of a single new fact
-func (node *betaNode) rightActivate(newFact *Fact) (err error) {
+//matches runs the constant tests of the alpha node on a fact
+func (node *alphaNode) matches(f *Fact) (bool, error) {
 
-	if node == nil {
-		return fmt.Errorf("rightActivate: node is nil\n")
+	if f.Attribute != node.attributeName {
+		return false, nil
 	}
-
-	if newFact == nil {
-		return fmt.Errorf("rightActivate: received nil Fact pointer\n")
+	if len(node.objConstraint) > 0 && f.ObjectId != node.objConstraint {
+		return false, nil
 	}
-
-	var tokenFound bool
-
-	for i, _ := range node.product.tokens {
-		success, err := node.product.tokens[i].inject(newFact, node)
-		if err != nil {
-			return err
-		}
-		if success {
-			tokenFound = true
-			node.leftActivate(node.product.tokens[i])
+	if node.compareTo != nil {
+		if unordered(f.Value, node.comparator, node.compareTo) {
+			return false, nil
 		}
+		return match(f.Value, node.comparator, node.compareTo)
 	}
+	return true, nil
+}
 
-	if tokenFound {
-		return nil
-	}
-
-	//restrict new token creation to right activation
-	//new token creation should only occur here
-	tok, err := node.product.addToken(newFact, node.index)
-	if err != nil {
-		return err
-	}
+func (node *alphaNode) addFact(f *Fact) {
 
-	err = node.leftActivate(tok)
-	if err != nil {
-		return err
+	if node.positions == nil {
+		node.positions = make(map[*Fact]int)
 	}
-
-	return nil
+	node.positions[f] = len(node.facts)
+	node.facts = append(node.facts, f)
 }
 
-//leftActivate tries to fill out the rest of a single token with multiple facts, 
-//skipping the location that belongs to this node because it is assumed to have 
-//just been populated prior to this method being called
-func (node *betaNode) leftActivate(tok *token) (err error) {
+func (node *alphaNode) removeFact(i int) error {
 
 	if node == nil {
-		return fmt.Errorf("leftActivate: node is nil\n")
+		return fmt.Errorf("removeFact: node is nil\n")
 	}
 
-	if tok == nil {
-		return fmt.Errorf("leftActivate: received nil token\n")
+	if i >= len(node.facts) {
+		return fmt.Errorf("removeFact: index is out of range\n")
 	}
 
-	for i := 0; i < len(tok.incoming); i++ {
-		//this statement is unnecessary, but helps make the
-		if i == node.index {//concept of left activation clear
-			continue
-		}
-		if tok.incoming[i] == nil {
-			for _, f := range node.product.betaNodes[i].parentNode.facts {
-				success, err := tok.inject(f, node.product.betaNodes[i])
-				if err  != nil {
-					return err
-				}
-				if success {
-					break
-				}
-			}
-		}
+	removed := node.facts[i]
+	delete(node.positions, removed)
+	node.facts[i] = node.facts[len(node.facts)-1]
+	node.facts[len(node.facts)-1] = nil
+	node.facts = node.facts[:len(node.facts)-1]
+	if i < len(node.facts) {
+		node.positions[node.facts[i]] = i
 	}
 
-	err = node.product.activate(tok)
-	if err != nil {
-		return err
+	for _, jNode := range node.successors {
+		err := jNode.rightRemove(removed)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-//inject tries to add a single fact to a single token
-func (tok *token) inject(newFact *Fact, node *betaNode) (bool, error) {
-
-	if newFact == nil {
-		return false, fmt.Errorf("inject: received nil Fact pointer")
-	}
-
-	if tok == nil {
-		return false, fmt.Errorf("inject: received nil token pointer")
-	}
-
-	if node == nil {
-		return false, fmt.Errorf("inject: node is nil")
-	}
-
-	existing := tok.incoming[node.index]
-
-	if node.alphaNot {
-		if existing == &node.product.parentEngine.nullFact {
-			//existential negation is backwards
-			tok.damage(node.index)
-			return true, nil
-		} else if existing != nil {
-			return false, fmt.Errorf("inject: invalid token")
-		} else {
-			return true, nil
-		}
-	}
-
-	if existing != nil {
-
-		valuesMatch, err := match(newFact.Value,EQ,existing.Value)
-
-		if err != nil {
-			return false, err
-		}
-
-		if newFact.ObjectId == existing.ObjectId && newFact.Attribute == existing.Attribute && valuesMatch {
-			return true, nil
-		}
-		return false, nil
-	}
-
-	//if the beta node has an object variable, run through the test network
-	if node.objectVariable != "" {
-		for key, slc := range node.product.testNetwork {
-			for _, tst := range slc {
-				if tok.incoming[tst.tokenIndex] == nil {
-					continue
-				}
-				if node.objectVariable == key {//EQ
-					if tst.objectElseValue {
-						if newFact.ObjectId != tok.incoming[tst.tokenIndex].ObjectId {
-							return false, nil
-						}
-					} else {
-						val, ok := tok.incoming[tst.tokenIndex].Value.(string)
-						if !ok || newFact.ObjectId != val {
-							return false, nil
-						}
-					}
-				} else {//NE
-					if tst.objectElseValue {
-						if newFact.ObjectId == tok.incoming[tst.tokenIndex].ObjectId {
-							return false, nil
-						}
-					} else {
-						val, ok := tok.incoming[tst.tokenIndex].Value.(string)
-						if ok && newFact.ObjectId == val {
-							return false, nil
-						}
-					}
-				}
-			}
-		}
+func (node alphaNode) String() string {
+//this is primarily for debugging
+	if typed(node.compareTo) {
+		return fmt.Sprintf("A %s O %s %s V %s F %d B %d",node.attributeName,node.objConstraint,node.comparator.String(),formatTyped(node.compareTo),len(node.facts),len(node.successors))
 	}
+	reflectedValue := reflect.ValueOf(node.compareTo)
 
-	//if the beta node has a value variable, run through the test network
-	if node.valueVariable != "" {
-		for key, slc := range node.product.testNetwork {
-			for _, tst := range slc {
-				if tok.incoming[tst.tokenIndex] == nil {
-					continue
-				}
-				if node.valueVariable == key {//EQ
-					if tst.objectElseValue {
-						val, ok := newFact.Value.(string)
-						if !ok || val != tok.incoming[tst.tokenIndex].ObjectId {
-							return false, nil
-						}
-					} else {
-						notMatched, err := match(newFact.Value, NE, tok.incoming[tst.tokenIndex].Value)
-						if err != nil {
-							return false, err
-						}
-						if notMatched {
-							return false, nil
-						}
-					}
-				} else {//NE
-					if tst.objectElseValue {
-						val, ok := newFact.Value.(string)
-						if ok && val == tok.incoming[tst.tokenIndex].ObjectId {
-							return false, nil
-						}
-					} else {
-						matched, err := match(newFact.Value, EQ, tok.incoming[tst.tokenIndex].Value)
-						if err != nil {
-							return false, err
-						}
-						if matched {
-							return false, nil
-						}
-					}
-				}
-			}
-		}
+	switch reflectedValue.Kind() {
+	case reflect.String:
+		return fmt.Sprintf("A %s O %s %s V %s F %d B %d",node.attributeName,node.objConstraint,node.comparator.String(),reflectedValue.String(),len(node.facts),len(node.successors))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fmt.Sprintf("A %s O %s %s V %d F %d B %d",node.attributeName,node.objConstraint,node.comparator.String(),reflectedValue.Int(),len(node.facts),len(node.successors))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return fmt.Sprintf("A %s O %s %s V %d F %d B %d",node.attributeName,node.objConstraint,node.comparator.String(),reflectedValue.Uint(),len(node.facts),len(node.successors))
+	case reflect.Float32, reflect.Float64:
+		return fmt.Sprintf("A %s O %s %s V %f F %d B %d",node.attributeName,node.objConstraint,node.comparator.String(),reflectedValue.Float(),len(node.facts),len(node.successors))
+	default:
+		return fmt.Sprintf("A %s O %s V.Kind %s F %d B %d",node.attributeName,node.objConstraint, reflectedValue.Kind().String(), len(node.facts),len(node.successors))
 	}
-
-	//the fact has successfully run the gauntlet, so add it
-	tok.incoming[node.index] = newFact
-	//newFact.tokens = append(newFact.tokens,tok)
-	return true, nil
 }
 
 type token struct {
 
 	containedBy *pNode
+	source *betaToken //the partial match of the rule's last condition
 	incoming []*Fact
 	outgoing []*Fact
+	activation *activation //set while the token is complete
+	bindings Bindings //as passed to the actions when the token fired
 }
 
 func (t token) print() {
@@ -743,37 +1238,30 @@ func (t token) print() {
 	return
 }
 
-func (t *token) damage(i int) error {
+//remove takes a token off the agenda, withdraws its inferences, undoes its actions
+//and removes it from its p-node
+func (t *token) remove() error {
 
-	fct := t.incoming[i]
+	//the token is no longer complete, so it must not fire (again)
+	t.containedBy.parentEngine.deactivate(t)
 
-	if fct == nil {
-		return fmt.Errorf("damage: token is not nil at index")
-	}
-
-	//take out the requested location
-	t.incoming[i] = nil
-
-	//now retract all inferences
+	//now withdraw all inferences
 	for j, f := range t.outgoing {
-		err := t.containedBy.parentEngine.retract(f)
+		if f == nil {
+			continue //not fired, or already withdrawn
+		}
+		err := t.containedBy.parentEngine.withdraw(f)
 		if err != nil {
 			return err
 		}
 		t.outgoing[j] = nil
 	}
-	//check if token is now empty
-	for _, f := range t.incoming {
-		if f != nil {
-			return nil
-		}
-	}
-	//if so, self-destruct
-	err := t.containedBy.removeToken(t)
+	//and undo any actions
+	err := t.undoActions()
 	if err != nil {
 		return err
 	}
-	return nil
+	return t.containedBy.removeToken(t)
 }
 
 type betaTest struct {
@@ -784,62 +1272,64 @@ type betaTest struct {
 type pNode struct {
 
 	ruleId string
+	rule Rule //as defined
+	branch int //of a rule with alternatives; every branch has its own p-node
+	lhs []Condition //the conditions of the branch, one per join node
+	salience int
 
 	parentEngine *Engine
 
-	betaNodes  []*betaNode //ordered
+	joins      []*joinNode //one per condition, ordered
 	tokens     []*token
+	positions  map[*token]int //index of each token in tokens
 	inferences []Inference
+	actions    []registeredAction
+	changes    []change //retractions and modifications
+	kept       []*keptInference //inferences of tokens that consumed their own match
+	keptPositions map[*keptInference]int //index of each in kept
 
 	testNetwork map[Variable][]betaTest
+	quantifiers map[int]*quantifier //of the forall, aggregate and negated group conditions, by condition number, until the rule is built
 }
 
-func (node *pNode) addToken(f *Fact, i int) (t *token, err error) {
+//addToken makes a token for a complete match of the rule
+func (node *pNode) addToken(t *betaToken) error {
 
-	if node.betaNodes[i].alphaNot && f != nil {
-		//existential negation is backwards
-		return nil, nil
+	tok := node.newToken()
+	tok.source = t
+	tok.incoming = t.facts(len(node.joins))
+	t.tokens = append(t.tokens, tok)
+	if node.positions == nil {
+		node.positions = make(map[*token]int)
 	}
+	node.positions[tok] = len(node.tokens)
+	node.tokens = append(node.tokens, tok)
+	return node.activate(tok)
+}
 
-	t = &token{}
-	node.tokens = append(node.tokens, t)
-	t.containedBy = node
-	t.incoming = make([]*Fact,len(node.betaNodes))
-	t.outgoing = make([]*Fact,len(node.inferences))
-
-	for j, beta := range node.betaNodes {
-		if beta.alphaNot && len(beta.parentNode.facts) == 0 {
-			t.incoming[j] = &node.parentEngine.nullFact
-		}
-	}
+func (node *pNode) newToken() *token {
 
-	if f != nil {
-		t.incoming[i] = f
+	return &token{
+		containedBy: node,
+		incoming:    make([]*Fact,len(node.joins)),
+		outgoing:    make([]*Fact,len(node.inferences)),
 	}
-
-	return t, nil
 }
 
 func (node *pNode) removeToken(tok *token) (err error) {
 
-	var i int
-	var t *token
-	var found bool
-
-	for i, t = range node.tokens{
-
-		if t == tok {
-			found = true
-			break
-		}
-	}
-	if found {
-		node.tokens[i] = node.tokens[len(node.tokens)-1]
-		node.tokens[len(node.tokens)-1] = nil
-		node.tokens = node.tokens[:len(node.tokens)-1]
-	} else {
+	i, found := node.positions[tok]
+	if !found {
 		return fmt.Errorf("removeToken: token not found")
 	}
+	delete(node.positions, tok)
+	last := len(node.tokens) - 1
+	node.tokens[i] = node.tokens[last]
+	node.tokens[last] = nil
+	node.tokens = node.tokens[:last]
+	if i < last {
+		node.positions[node.tokens[i]] = i
+	}
 	return nil
 }
 
@@ -852,14 +1342,37 @@ func (node *pNode) activate(tok *token) (err error) {
 		}
 	}
 
-	//if so, fire off all inferences
+	//if so, put it on the agenda (unless it is already there or has fired)
+	if tok.activation == nil {
+		node.parentEngine.addActivation(tok)
+	}
+	return nil
+}
+
+//fire makes the inferences of a complete token that has been selected from the agenda
+func (node *pNode) fire(tok *token) (err error) {
+
+	var bindings Bindings //for expressions, collected when first needed
+
 	for i, inf := range node.inferences {
 
 		f := Fact{}
 
 		obj, ok := inf.ObjectId.(Variable)
-		if ok { //then it's a variable
-			tst := node.testNetwork[obj][0]
+		if expr, isExpression := inf.ObjectId.(Expression); isExpression {
+			if bindings == nil {
+				bindings = node.bindings(tok)
+			}
+			value, err := evaluate(expr, bindings)
+			if err != nil {
+				return fmt.Errorf("Inference failure in %s: %w",node.ruleId,err)
+			}
+			f.ObjectId, ok = value.(string)
+			if !ok {
+				return fmt.Errorf("Inference failure in %s: %T cannot be an ObjectId",node.ruleId,value)
+			}
+		} else if ok { //then it's a variable
+			tst, _ := firstBinding(node.testNetwork, node.lhs, obj, len(node.lhs))
 			if tst.objectElseValue {
 				f.ObjectId = tok.incoming[tst.tokenIndex].ObjectId
 			} else {
@@ -878,8 +1391,16 @@ func (node *pNode) activate(tok *token) (err error) {
 		f.Attribute = inf.Attribute
 
 		val, ok := inf.Value.(Variable)
-		if ok { //then it's a variable
-			tst := node.testNetwork[val][0]
+		if expr, isExpression := inf.Value.(Expression); isExpression {
+			if bindings == nil {
+				bindings = node.bindings(tok)
+			}
+			f.Value, err = evaluate(expr, bindings)
+			if err != nil {
+				return fmt.Errorf("Inference failure in %s: %w",node.ruleId,err)
+			}
+		} else if ok { //then it's a variable
+			tst, _ := firstBinding(node.testNetwork, node.lhs, val, len(node.lhs))
 			if tst.objectElseValue {
 				f.Value = tok.incoming[tst.tokenIndex].ObjectId
 			} else {
@@ -889,10 +1410,15 @@ func (node *pNode) activate(tok *token) (err error) {
 			f.Value = inf.Value
 		}
 
-		node.parentEngine.pushAgenda(&f)
-		tok.outgoing[i] = &f
+		tok.outgoing[i] = node.parentEngine.infer(&f)
 	}
-	return nil
+
+	err = node.callActions(tok)
+	if err != nil {
+		return err
+	}
+
+	return node.consume(tok)
 }
 
 func match(left interface{}, op Operator, right interface{}) (bool, error) {
@@ -906,6 +1432,15 @@ func match(left interface{}, op Operator, right interface{}) (bool, error) {
 			return false, fmt.Errorf("match: cannot compare nil to nil using %s",op.String())
 		}
 	}
+	if typed(left) || typed(right) {
+		return matchTyped(left, op, right)
+	}
+	//integers, unsigned integers and floats compare by numeric value
+	if leftNumber, ok := numberOf(left); ok {
+		if rightNumber, ok := numberOf(right); ok {
+			return matchNumbers(leftNumber, op, rightNumber)
+		}
+	}
 
 	leftValue := reflect.ValueOf(left)
 	rightValue := reflect.ValueOf(right)
@@ -948,60 +1483,6 @@ func match(left interface{}, op Operator, right interface{}) (bool, error) {
 				return true, nil
 			}
 		}
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		switch op {
-		case EQ:
-			if leftValue.Int() == rightValue.Int() {
-				return true, nil
-			}
-		case GE:
-			if leftValue.Int() >= rightValue.Int() {
-				return true, nil
-			}
-		case GT:
-			if leftValue.Int() > rightValue.Int() {
-				return true, nil
-			}
-		case LE:
-			if leftValue.Int() <= rightValue.Int() {
-				return true, nil
-			}
-		case LT:
-			if leftValue.Int() < rightValue.Int() {
-				return true, nil
-			}
-		case NE:
-			if leftValue.Int() != rightValue.Int() {
-				return true, nil
-			}
-		}
-	case reflect.Float32, reflect.Float64:
-		switch op {
-		case EQ:
-			if leftValue.Float() == rightValue.Float() {
-				return true, nil
-			}
-		case GE:
-			if leftValue.Float() >= rightValue.Float() {
-				return true, nil
-			}
-		case GT:
-			if leftValue.Float() > rightValue.Float() {
-				return true, nil
-			}
-		case LE:
-			if leftValue.Float() <= rightValue.Float() {
-				return true, nil
-			}
-		case LT:
-			if leftValue.Float() < rightValue.Float() {
-				return true, nil
-			}
-		case NE:
-			if leftValue.Float() != rightValue.Float() {
-				return true, nil
-			}
-		}
 	default:
 		return false, fmt.Errorf("match: cannot compare %s",leftValue.Kind())
 	}
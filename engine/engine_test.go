@@ -60,7 +60,7 @@ func TestDefine(t *testing.T) {
 
 		for _, a := range slc {
 			alphaCount++
-			betaCount += len(a.betaNodes)
+			betaCount += len(a.successors)
 		}
 	}
 	if alphaCount != 3 {
@@ -789,8 +789,10 @@ func TestEngine(t *testing.T) {
 		}
 	}
 
+	//every combination of facts matching a rule now fires, and the two fact sets mix:
+	//L3R1 matches four ways, inferring passed for set1obj1 and set2obj1
 	test = "6 Fact Set 2"
-	expected = 3
+	expected = 2
 	result, err = testEngine.GetInferences("","passed")
 	if err != nil{
 		t.Errorf(err.Error())
@@ -799,3 +801,248 @@ func TestEngine(t *testing.T) {
 		t.Errorf("Test %s: expected %d, got %d\n",test,expected,len(result))
 	}
 }
+
+func TestIncrementalDefine(t *testing.T) {
+
+	var p Variable = "p"
+	var c Variable = "c"
+
+	rules := []Rule{
+		Rule{
+			Id:  "adult",
+			LHS: []Condition{Condition{ObjectId: p, Attribute: "age", Comparator: GE, Value: 18}},
+			RHS: []Inference{Inference{ObjectId: p, Attribute: "adult", Value: "yes"}},
+		},
+		Rule{
+			Id: "drive",
+			LHS: []Condition{
+				Condition{ObjectId: p, Attribute: "adult", Comparator: EQ, Value: "yes"},
+				Condition{ObjectId: p, Attribute: "licence", Comparator: EQ, Value: "valid"},
+				Condition{NotExists: true, ObjectId: "", Attribute: "curfew", Comparator: EQ, Value: "on"},
+			},
+			RHS: []Inference{Inference{ObjectId: p, Attribute: "may-drive", Value: "yes"}},
+		},
+		Rule{
+			Id: "insure",
+			LHS: []Condition{
+				Condition{ObjectId: p, Attribute: "may-drive", Comparator: EQ, Value: "yes"},
+				Condition{ObjectId: p, Attribute: "car", Comparator: EQ, Value: c},
+			},
+			RHS: []Inference{Inference{ObjectId: c, Attribute: "insured", Value: "yes"}},
+		},
+	}
+	facts := []Fact{
+		Fact{"ann", "age", 21},
+		Fact{"ann", "licence", "valid"},
+		Fact{"ann", "car", "car1"},
+		Fact{"bob", "age", 12},
+		Fact{"bob", "licence", "valid"},
+		Fact{"cat", "age", 30},
+	}
+
+	snapshot := func(testEngine *Engine) map[string]bool {
+		result, err := testEngine.GetFacts("", "")
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		m := make(map[string]bool)
+		for _, f := range result {
+			m[f.String()] = true
+		}
+		return m
+	}
+	compare := func(test string, expected map[string]bool, got map[string]bool) {
+		if len(expected) != len(got) {
+			t.Errorf("Test %s: expected %d facts, got %d\n", test, len(expected), len(got))
+		}
+		for k := range expected {
+			if !got[k] {
+				t.Errorf("Test %s: missing %s\n", test, k)
+			}
+		}
+	}
+
+	upFront := Engine{}
+	for _, r := range rules {
+		err := upFront.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+	for _, f := range facts {
+		err := upFront.Assert(f)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+	}
+	expected := snapshot(&upFront)
+	if !expected["O car1 A insured V yes"] {
+		t.Fatalf("Test 1 up front: expected car1 to be insured\n")
+	}
+
+	//rules defined after the facts, last rule first
+	later := Engine{}
+	for _, f := range facts {
+		err := later.Assert(f)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+	}
+	for i := len(rules) - 1; i >= 0; i-- {
+		err := later.Define(rules[i])
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", rules[i].Id, err)
+		}
+	}
+	compare("2 defined later", expected, snapshot(&later))
+
+	//and interleaved with the facts
+	mixed := Engine{}
+	for i, f := range facts {
+		if i%2 == 0 {
+			err := mixed.Define(rules[i/2])
+			if err != nil {
+				t.Fatalf("Error defining rule %s: %s\n", rules[i/2].Id, err)
+			}
+		}
+		err := mixed.Assert(f)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+	}
+	compare("3 interleaved", expected, snapshot(&mixed))
+
+	//a negated condition is blocked by a fact that was already there
+	blocked := Engine{}
+	err := blocked.Assert(Fact{"town", "curfew", "on"})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	for _, f := range facts {
+		err = blocked.Assert(f)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+	}
+	for _, r := range rules {
+		err = blocked.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+	result, err := blocked.GetInferences("", "may-drive")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(result) != 0 {
+		t.Errorf("Test 4 blocked: expected 0, got %d\n", len(result))
+	}
+	err = blocked.Retract(Fact{"town", "curfew", "on"})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	compare("4 unblocked", expected, snapshot(&blocked))
+}
+
+func TestCombinations(t *testing.T) {
+
+	var x Variable = "x"
+	var y Variable = "y"
+	fired := 0
+	undone := 0
+
+	testEngine := Engine{}
+	err := testEngine.RegisterAction("count", func(ruleId string, bindings Bindings) error {
+		fired++
+		return nil
+	}, func(ruleId string, bindings Bindings) error {
+		undone++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	rules := []Rule{
+		Rule{
+			Id: "pairs",
+			LHS: []Condition{
+				Condition{ObjectId: x, Attribute: "side", Comparator: EQ, Value: "left"},
+				Condition{ObjectId: y, Attribute: "side", Comparator: EQ, Value: "right"},
+			},
+			RHS: []Inference{
+				Inference{ObjectId: x, Attribute: "paired", Value: y},
+				Inference{ObjectId: "board", Attribute: "has", Value: "pairs"},
+			},
+			Actions: []Action{Action{Name: "count"}},
+		},
+		//the same fact may satisfy two conditions
+		Rule{
+			Id: "twice",
+			LHS: []Condition{
+				Condition{ObjectId: x, Attribute: "size", Comparator: GT, Value: 1},
+				Condition{ObjectId: x, Attribute: "size", Comparator: LT, Value: 10},
+			},
+			RHS: []Inference{Inference{ObjectId: x, Attribute: "medium", Value: "yes"}},
+		},
+	}
+	for _, r := range rules {
+		err = testEngine.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+
+	for _, f := range []Fact{
+		Fact{"a", "side", "left"},
+		Fact{"b", "side", "left"},
+		Fact{"c", "side", "right"},
+		Fact{"d", "side", "right"},
+		Fact{"e", "size", 5},
+	} {
+		err = testEngine.Assert(f)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	count := func(test string, objectId string, attribute string, expected int) {
+		result, err := testEngine.GetInferences(objectId, attribute)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		if len(result) != expected {
+			t.Errorf("Test %s: expected %d, got %d %v\n", test, expected, len(result), result)
+		}
+	}
+
+	if fired != 4 {
+		t.Errorf("Test 1 fired: expected 4, got %d\n", fired)
+	}
+	count("1 paired", "", "paired", 4)
+	count("1 shared inference", "board", "has", 1)
+	count("1 same fact twice", "e", "medium", 1)
+
+	//only the combinations with c are withdrawn
+	err = testEngine.Retract(Fact{"c", "side", "right"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if undone != 2 {
+		t.Errorf("Test 2 undone: expected 2, got %d\n", undone)
+	}
+	count("2 paired", "", "paired", 2)
+	count("2 paired a", "a", "paired", 1)
+	count("2 shared inference", "board", "has", 1)
+	facts, err := testEngine.GetFacts("board", "has")
+	if err != nil || len(facts) != 1 {
+		t.Errorf("Test 2 shared inference: expected it to stay in working memory, got %v\n", facts)
+	}
+
+	err = testEngine.Retract(Fact{"d", "side", "right"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	count("3 paired", "", "paired", 0)
+	count("3 shared inference", "board", "has", 0)
+}
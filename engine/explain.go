@@ -0,0 +1,171 @@
+package engine
+
+import "encoding/json"
+import "fmt"
+import "strings"
+
+//Explanation is the derivation tree of a fact: how it came to be in working memory
+type Explanation struct {
+	Fact        Fact         `json:"fact"`
+	Asserted    bool         `json:"asserted,omitempty"`  //the fact was asserted (it may also have been inferred)
+	Retracted   bool         `json:"retracted,omitempty"` //the fact supported a rule that then retracted or modified it
+	Circular    bool         `json:"circular,omitempty"`  //the fact is already being explained further up the tree
+	Derivations []Derivation `json:"derivations,omitempty"`
+}
+
+//Derivation is one rule firing that inferred a fact
+type Derivation struct {
+	RuleId  string    `json:"rule"`
+	Support []Support `json:"support"` //one per condition of the rule
+}
+
+//Support shows how one condition of a rule was satisfied
+type Support struct {
+	Condition   Condition    `json:"-"`
+	Pattern     string       `json:"condition"`             //the condition in text form
+	Negated     bool         `json:"negated,omitempty"`     //satisfied because no fact matched
+	ForAll      bool         `json:"forall,omitempty"`      //satisfied because every fact matching the first condition of forall matched the rest
+	Aggregate   bool         `json:"aggregate,omitempty"`   //satisfied by the result of an aggregate
+	Result      interface{}  `json:"result,omitempty"`      //of the aggregate
+	Explanation *Explanation `json:"explanation,omitempty"` //of the fact that matched
+}
+
+//Explain returns the derivation tree of a fact in working memory: whether it was asserted,
+//every rule firing that inferred it, and for each of them the fact matching each condition
+//(explained in turn), the negated conditions that no fact matched or the result of an aggregate
+func (engine *Engine) Explain(fct Fact) (*Explanation, error) {
+
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	return engine.explain(fct, make(map[Fact]bool))
+}
+
+//JSON renders the explanation as indented JSON
+func (e *Explanation) JSON() ([]byte, error) {
+
+	return json.MarshalIndent(e, "", "  ")
+}
+
+//String renders the explanation as an indented text tree
+func (e *Explanation) String() string {
+
+	var b strings.Builder
+	e.write(&b, "")
+	return b.String()
+}
+
+func (e *Explanation) write(b *strings.Builder, indent string) {
+
+	b.WriteString(e.Fact.String())
+	switch {
+	case e.Circular:
+		b.WriteString(" (see above)")
+	case e.Retracted:
+		b.WriteString(" (since retracted)")
+	case e.Asserted:
+		b.WriteString(" (asserted)")
+	}
+	b.WriteString("\n")
+	for _, d := range e.Derivations {
+		fmt.Fprintf(b, "%s  inferred by %s\n", indent, d.RuleId)
+		for i, s := range d.Support {
+			fmt.Fprintf(b, "%s    [%d] %s: ", indent, i, s.Pattern)
+			if s.Negated {
+				b.WriteString("no matching fact\n")
+				continue
+			}
+			if s.ForAll {
+				b.WriteString("holds for every fact\n")
+				continue
+			}
+			if s.Aggregate {
+				fmt.Fprintf(b, "%s is %v\n", s.Condition.Aggregate.Function, s.Result)
+				continue
+			}
+			s.Explanation.write(b, indent+"      ")
+		}
+	}
+}
+
+//explain builds the tree for one fact; path holds the facts being explained
+//further up the tree, so that circular support ends the recursion
+func (engine *Engine) explain(fct Fact, path map[Fact]bool) (*Explanation, error) {
+
+	e := &Explanation{Fact: fct}
+	if path[fct] {
+		e.Circular = true
+		return e, nil
+	}
+
+	stored, err := engine.find(fct)
+	if err != nil {
+		return nil, err
+	}
+	asserted := stored != nil
+
+	path[fct] = true
+	defer delete(path, fct)
+
+	err = engine.derivations(fct, func(p *pNode, t *token, support []Fact) error {
+		d := Derivation{RuleId: p.ruleId, Support: make([]Support, len(p.lhs))}
+		for i, condition := range p.lhs {
+			s := Support{Condition: condition, Pattern: condition.String()}
+			switch {
+			case condition.NotExists || condition.None != nil:
+				s.Negated = true
+			case condition.ForAll != nil:
+				s.ForAll = true
+			case condition.Aggregate != nil:
+				s.Aggregate = true
+				if t == nil {
+					s.Result = support[i].Value
+				} else {
+					s.Result = t.incoming[i].Value
+				}
+			case t == nil:
+				//kept inference: its support may since have been consumed
+				found, err := engine.find(support[i])
+				if err != nil {
+					return err
+				}
+				if found == nil {
+					s.Explanation = &Explanation{Fact: support[i], Retracted: true}
+					break
+				}
+				s.Explanation, err = engine.explain(support[i], path)
+				if err != nil {
+					return err
+				}
+			default:
+				s.Explanation, err = engine.explain(*t.incoming[i], path)
+				if err != nil {
+					return err
+				}
+			}
+			d.Support[i] = s
+		}
+		e.Derivations = append(e.Derivations, d)
+
+		//the stored fact was inferred rather than asserted
+		if t != nil {
+			for _, f := range t.outgoing {
+				if f == stored {
+					asserted = false
+				}
+			}
+		}
+		if len(engine.kept[stored]) > 0 {
+			asserted = false
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil && len(e.Derivations) == 0 {
+		return nil, fmt.Errorf("Explain: %s is not in working memory", fct.String())
+	}
+	e.Asserted = asserted
+	return e, nil
+}
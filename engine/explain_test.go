@@ -0,0 +1,124 @@
+package engine
+
+import "encoding/json"
+import "testing"
+
+func TestExplain(t *testing.T) {
+
+	var o Variable = "o"
+	var f Variable = "f"
+
+	testEngine := Engine{}
+	rules := []Rule{
+		Rule{
+			Id: "approve",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "score", Comparator: GE, Value: 700},
+				Condition{ObjectId: o, Attribute: "verified", Comparator: EQ, Value: "yes"},
+				Condition{NotExists: true, ObjectId: "", Attribute: "freeze", Comparator: EQ, Value: "on"},
+			},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "approved", Value: "yes"}},
+		},
+		Rule{
+			Id:  "verify",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "id-checked", Comparator: EQ, Value: "yes"}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "verified", Value: "yes"}},
+		},
+		//two rules supporting each other
+		Rule{
+			Id:  "there",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "a", Comparator: EQ, Value: "x"}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "b", Value: "y"}},
+		},
+		Rule{
+			Id:  "back",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "b", Comparator: EQ, Value: "y"}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "a", Value: "x"}},
+		},
+		Rule{
+			Id:          "close",
+			LHS:         []Condition{Condition{Label: f, ObjectId: o, Attribute: "ticket", Comparator: EQ, Value: "open"}},
+			RHS:         []Inference{Inference{ObjectId: o, Attribute: "handled", Value: "yes"}},
+			Retractions: []Retraction{Retraction{Target: f}},
+		},
+	}
+	for _, r := range rules {
+		err := testEngine.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+	for _, fct := range []Fact{
+		Fact{"c1", "score", 720},
+		Fact{"c1", "id-checked", "yes"},
+		Fact{"c2", "a", "x"},
+		Fact{"c3", "ticket", "open"},
+	} {
+		err := testEngine.Assert(fct)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	e, err := testEngine.Explain(Fact{"c1", "approved", "yes"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := `O c1 A approved V yes
+  inferred by approve
+    [0] ?o score GE 700: O c1 A score V 720 (asserted)
+    [1] ?o verified EQ "yes": O c1 A verified V yes
+        inferred by verify
+          [0] ?o id-checked EQ "yes": O c1 A id-checked V yes (asserted)
+    [2] not * freeze EQ "on": no matching fact
+`
+	if e.String() != expected {
+		t.Errorf("Test 1 chain: expected\n%s\ngot\n%s", expected, e.String())
+	}
+
+	b, err := e.JSON()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var decoded Explanation
+	err = json.Unmarshal(b, &decoded)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(decoded.Derivations) != 1 || decoded.Derivations[0].RuleId != "approve" ||
+		!decoded.Derivations[0].Support[2].Negated ||
+		decoded.Derivations[0].Support[1].Explanation.Derivations[0].Support[0].Pattern != `?o id-checked EQ "yes"` {
+		t.Errorf("Test 2 JSON: unexpected %s\n", b)
+	}
+
+	e, err = testEngine.Explain(Fact{"c2", "a", "x"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected = `O c2 A a V x (asserted)
+  inferred by back
+    [0] ?o b EQ "y": O c2 A b V y
+        inferred by there
+          [0] ?o a EQ "x": O c2 A a V x (see above)
+`
+	if e.String() != expected {
+		t.Errorf("Test 3 circular: expected\n%s\ngot\n%s", expected, e.String())
+	}
+
+	e, err = testEngine.Explain(Fact{"c3", "handled", "yes"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected = `O c3 A handled V yes
+  inferred by close
+    [0] ?f <- ?o ticket EQ "open": O c3 A ticket V open (since retracted)
+`
+	if e.String() != expected {
+		t.Errorf("Test 4 consumed: expected\n%s\ngot\n%s", expected, e.String())
+	}
+
+	_, err = testEngine.Explain(Fact{"c1", "approved", "no"})
+	if err == nil {
+		t.Errorf("Test 5 unknown fact: expected an error")
+	}
+}
@@ -0,0 +1,478 @@
+package engine
+
+import "fmt"
+import "math"
+import "math/big"
+import "reflect"
+import "strconv"
+import "strings"
+import "time"
+import "unicode/utf8"
+
+//An Expression computes the ObjectId or Value of an Inference (or the Value of a
+//Modification) from the values bound by a match, when its rule fires. Args are constants,
+//Variables bound by the LHS and other Expressions. The functions are:
+//
+//	add, sub, mul, div    arithmetic on two numbers; add and sub also take a time and a
+//	                      duration (or two durations), and sub takes two times
+//	mod                   the remainder of dividing two integers
+//	neg, abs              the negation and the absolute value of a number or a duration
+//	round, floor, ceil    a number rounded to a whole number
+//	min, max              the least and the greatest of one or more numbers (or strings,
+//	                      times or durations, all of the same type)
+//	concat                one or more strings joined together
+//	upper, lower, trim    a string in upper or lower case, or without surrounding space
+//	length                the number of characters in a string
+//	replace               a string with every instance of the second replaced by the third
+//	string                any value written as a string
+//	int, float            a number or a numeric string converted to an int or a float64
+//
+//Integers (of any kind) give an int unless either operand of add, sub, mul, div or mod
+//is a float, when the result is a float64; div truncates a quotient of integers.
+type Expression struct {
+	Function string
+	Args     []interface{}
+}
+
+//Call returns an Expression applying a function to the arguments
+func Call(function string, args ...interface{}) Expression {
+
+	return Expression{Function: function, Args: args}
+}
+
+func (e Expression) String() string {
+
+	args := make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		switch v := arg.(type) {
+		case Variable:
+			args[i] = "?" + string(v)
+		case string:
+			args[i] = strconv.Quote(v)
+		default:
+			args[i] = fmt.Sprintf("%v", v)
+		}
+	}
+	return fmt.Sprintf("%s(%s)", e.Function, strings.Join(args, ", "))
+}
+
+//An ExpressionError reports an argument that a function cannot take, because it is of the
+//wrong type (a string where a number is needed, say) or has a value out of range. It is
+//returned, wrapped, by the method (such as Assert) during which the rule fired.
+type ExpressionError struct {
+	Function string
+	Arg      int //index of the argument
+	Value    interface{}
+	Msg      string
+}
+
+func (err *ExpressionError) Error() string {
+
+	return fmt.Sprintf("%s: argument %d (%v): %s", err.Function, err.Arg, err.Value, err.Msg)
+}
+
+type function struct {
+	min, max int //number of arguments (max -1 for any number)
+	apply func(args []interface{}) (interface{}, error)
+}
+
+var functions map[string]function
+
+func init() {
+
+	functions = map[string]function{
+		"add": {2, 2, func(args []interface{}) (interface{}, error) { return arithmetic("add", args) }},
+		"sub": {2, 2, func(args []interface{}) (interface{}, error) { return arithmetic("sub", args) }},
+		"mul": {2, 2, func(args []interface{}) (interface{}, error) { return arithmetic("mul", args) }},
+		"div": {2, 2, func(args []interface{}) (interface{}, error) { return arithmetic("div", args) }},
+		"mod": {2, 2, func(args []interface{}) (interface{}, error) { return arithmetic("mod", args) }},
+		"neg": {1, 1, func(args []interface{}) (interface{}, error) { return sign("neg", args[0]) }},
+		"abs": {1, 1, func(args []interface{}) (interface{}, error) { return sign("abs", args[0]) }},
+		"round": {1, 1, func(args []interface{}) (interface{}, error) { return rounding("round", args[0], math.Round) }},
+		"floor": {1, 1, func(args []interface{}) (interface{}, error) { return rounding("floor", args[0], math.Floor) }},
+		"ceil": {1, 1, func(args []interface{}) (interface{}, error) { return rounding("ceil", args[0], math.Ceil) }},
+		"min": {1, -1, func(args []interface{}) (interface{}, error) { return extreme("min", args, LT) }},
+		"max": {1, -1, func(args []interface{}) (interface{}, error) { return extreme("max", args, GT) }},
+		"concat": {1, -1, concat},
+		"upper": {1, 1, func(args []interface{}) (interface{}, error) { return stringFunction("upper", args[0], strings.ToUpper) }},
+		"lower": {1, 1, func(args []interface{}) (interface{}, error) { return stringFunction("lower", args[0], strings.ToLower) }},
+		"trim": {1, 1, func(args []interface{}) (interface{}, error) { return stringFunction("trim", args[0], strings.TrimSpace) }},
+		"length": {1, 1, length},
+		"replace": {3, 3, replace},
+		"string": {1, 1, toString},
+		"int": {1, 1, toInt},
+		"float": {1, 1, toFloat},
+	}
+}
+
+//checkTerms validates the expressions (and variables) of the RHS of a rule
+func checkTerms(r Rule) error {
+
+	bound := make(map[Variable]bool)
+	for _, condition := range r.LHS {
+		if _, ok := condition.Value.(Expression); ok {
+			return fmt.Errorf("Expression %s cannot be used in a condition", condition.Value)
+		}
+		if condition.NotExists {
+			continue //binds nothing
+		}
+		if v, ok := condition.ObjectId.(Variable); ok {
+			bound[v] = true
+		}
+		if v, ok := condition.Value.(Variable); ok {
+			bound[v] = true
+		}
+		if condition.Aggregate != nil && condition.Aggregate.Into != "" {
+			bound[condition.Aggregate.Into] = true
+		}
+	}
+	var terms []interface{}
+	for _, inf := range r.RHS {
+		terms = append(terms, inf.ObjectId, inf.Value)
+	}
+	for _, m := range r.Modifications {
+		terms = append(terms, m.Value)
+	}
+	for _, term := range terms {
+		switch v := term.(type) {
+		case Variable:
+			if !bound[v] {
+				return fmt.Errorf("Variable %s in %s is not bound by a condition", v, r.Id)
+			}
+		case Expression:
+			err := v.check(bound)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//check validates an expression when its rule is defined: the functions must exist, with
+//the right number of arguments, and the variables must be bound by the LHS
+func (e Expression) check(bound map[Variable]bool) error {
+
+	f, ok := functions[e.Function]
+	if !ok {
+		return fmt.Errorf("Expression %s: unknown function %s", e.String(), e.Function)
+	}
+	if len(e.Args) < f.min || (f.max >= 0 && len(e.Args) > f.max) {
+		return fmt.Errorf("Expression %s: wrong number of arguments to %s", e.String(), e.Function)
+	}
+	for _, arg := range e.Args {
+		switch v := arg.(type) {
+		case Variable:
+			if !bound[v] {
+				return fmt.Errorf("Variable %s in expression is not bound by a condition", v)
+			}
+		case Expression:
+			err := v.check(bound)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//evaluate returns the value of a term of the RHS (a constant, Variable or Expression)
+func evaluate(term interface{}, bindings Bindings) (interface{}, error) {
+
+	switch v := term.(type) {
+	case Variable:
+		value, ok := bindings[v]
+		if !ok {
+			return nil, fmt.Errorf("Variable %s is not bound", v)
+		}
+		return value, nil
+	case Expression:
+		args := make([]interface{}, len(v.Args))
+		for i, arg := range v.Args {
+			value, err := evaluate(arg, bindings)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = value
+		}
+		return functions[v.Function].apply(args)
+	}
+	return term, nil
+}
+
+//arithmetic applies an operator to two numbers, or to times and durations
+func arithmetic(name string, args []interface{}) (interface{}, error) {
+
+	if result, ok, err := timeArithmetic(name, args[0], args[1]); ok {
+		return result, err
+	}
+	var numbers [2]number
+	for i, arg := range args {
+		n, ok := numberOf(arg)
+		if !ok {
+			return nil, &ExpressionError{Function: name, Arg: i, Value: arg, Msg: "not a number"}
+		}
+		numbers[i] = n
+	}
+
+	if numbers[0].kind == reflect.Float64 || numbers[1].kind == reflect.Float64 {
+		a, b := numbers[0].float(), numbers[1].float()
+		switch name {
+		case "add":
+			return a + b, nil
+		case "sub":
+			return a - b, nil
+		case "mul":
+			return a * b, nil
+		case "div":
+			if b == 0 {
+				return nil, &ExpressionError{Function: name, Arg: 1, Value: args[1], Msg: "division by zero"}
+			}
+			return a / b, nil
+		}
+		i := 0
+		if numbers[1].kind == reflect.Float64 {
+			i = 1
+		}
+		return nil, &ExpressionError{Function: name, Arg: i, Value: args[i], Msg: "not an integer"}
+	}
+
+	//integers are computed exactly, and the result must fit an int
+	a, b := numbers[0].bigInt(), numbers[1].bigInt()
+	result := new(big.Int)
+	switch name {
+	case "add":
+		result.Add(a, b)
+	case "sub":
+		result.Sub(a, b)
+	case "mul":
+		result.Mul(a, b)
+	case "div", "mod":
+		if b.Sign() == 0 {
+			return nil, &ExpressionError{Function: name, Arg: 1, Value: args[1], Msg: "division by zero"}
+		}
+		if name == "div" {
+			result.Quo(a, b)
+		} else {
+			result.Rem(a, b)
+		}
+	}
+	return intResult(name, args[0], result)
+}
+
+//timeArithmetic adds and subtracts times and durations; ok is false if neither
+//argument is a time or a duration
+func timeArithmetic(name string, left interface{}, right interface{}) (result interface{}, ok bool, err error) {
+
+	lt, leftTime := left.(time.Time)
+	ld, leftDuration := left.(time.Duration)
+	rt, rightTime := right.(time.Time)
+	rd, rightDuration := right.(time.Duration)
+	if !leftTime && !leftDuration && !rightTime && !rightDuration {
+		return nil, false, nil
+	}
+
+	switch {
+	case name == "add" && leftTime && rightDuration:
+		return lt.Add(rd), true, nil
+	case name == "add" && leftDuration && rightTime:
+		return rt.Add(ld), true, nil
+	case name == "add" && leftDuration && rightDuration:
+		return ld + rd, true, nil
+	case name == "sub" && leftTime && rightDuration:
+		return lt.Add(-rd), true, nil
+	case name == "sub" && leftTime && rightTime:
+		return lt.Sub(rt), true, nil
+	case name == "sub" && leftDuration && rightDuration:
+		return ld - rd, true, nil
+	}
+	if leftTime || leftDuration {
+		return nil, true, &ExpressionError{Function: name, Arg: 1, Value: right, Msg: fmt.Sprintf("cannot %s with %T", name, left)}
+	}
+	return nil, true, &ExpressionError{Function: name, Arg: 0, Value: left, Msg: fmt.Sprintf("cannot %s with %T", name, right)}
+}
+
+func (n number) bigInt() *big.Int {
+
+	if n.kind == reflect.Uint64 {
+		return new(big.Int).SetUint64(n.u)
+	}
+	return big.NewInt(n.i)
+}
+
+//intResult returns an integer result as an int, if it fits
+func intResult(name string, arg interface{}, result *big.Int) (interface{}, error) {
+
+	if !result.IsInt64() || int64(int(result.Int64())) != result.Int64() {
+		return nil, &ExpressionError{Function: name, Arg: 0, Value: arg, Msg: "result overflows int"}
+	}
+	return int(result.Int64()), nil
+}
+
+//sign applies neg or abs to a number or a duration
+func sign(name string, arg interface{}) (interface{}, error) {
+
+	if d, ok := arg.(time.Duration); ok {
+		if name == "neg" || d < 0 {
+			return -d, nil
+		}
+		return d, nil
+	}
+	n, ok := numberOf(arg)
+	if !ok {
+		return nil, &ExpressionError{Function: name, Arg: 0, Value: arg, Msg: "not a number"}
+	}
+	if n.kind == reflect.Float64 {
+		if name == "neg" {
+			return -n.f, nil
+		}
+		return math.Abs(n.f), nil
+	}
+	result := n.bigInt()
+	if name == "neg" {
+		result.Neg(result)
+	} else {
+		result.Abs(result)
+	}
+	return intResult(name, arg, result)
+}
+
+//rounding rounds a float to a whole float64; integers are returned as ints
+func rounding(name string, arg interface{}, round func(float64) float64) (interface{}, error) {
+
+	n, ok := numberOf(arg)
+	if !ok {
+		return nil, &ExpressionError{Function: name, Arg: 0, Value: arg, Msg: "not a number"}
+	}
+	if n.kind == reflect.Float64 {
+		return round(n.f), nil
+	}
+	return intResult(name, arg, n.bigInt())
+}
+
+//extreme returns the argument that is less (op LT) or greater (op GT) than all the others
+func extreme(name string, args []interface{}, op Operator) (interface{}, error) {
+
+	best := args[0]
+	for i, arg := range args {
+		_, isNumber := numberOf(arg)
+		_, isTime := arg.(time.Time)
+		_, isDuration := arg.(time.Duration)
+		_, isString := arg.(string)
+		if !isNumber && !isTime && !isDuration && !isString {
+			return nil, &ExpressionError{Function: name, Arg: i, Value: arg, Msg: "cannot be ordered"}
+		}
+		better, err := match(arg, op, best)
+		if err != nil {
+			return nil, &ExpressionError{Function: name, Arg: i, Value: arg, Msg: err.Error()}
+		}
+		if better {
+			best = arg
+		}
+	}
+	return best, nil
+}
+
+func concat(args []interface{}) (interface{}, error) {
+
+	var b strings.Builder
+	for i, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, &ExpressionError{Function: "concat", Arg: i, Value: arg, Msg: "not a string"}
+		}
+		b.WriteString(s)
+	}
+	return b.String(), nil
+}
+
+func stringFunction(name string, arg interface{}, f func(string) string) (interface{}, error) {
+
+	s, ok := arg.(string)
+	if !ok {
+		return nil, &ExpressionError{Function: name, Arg: 0, Value: arg, Msg: "not a string"}
+	}
+	return f(s), nil
+}
+
+func length(args []interface{}) (interface{}, error) {
+
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, &ExpressionError{Function: "length", Arg: 0, Value: args[0], Msg: "not a string"}
+	}
+	return utf8.RuneCountInString(s), nil
+}
+
+func replace(args []interface{}) (interface{}, error) {
+
+	var s [3]string
+	for i, arg := range args {
+		var ok bool
+		s[i], ok = arg.(string)
+		if !ok {
+			return nil, &ExpressionError{Function: "replace", Arg: i, Value: arg, Msg: "not a string"}
+		}
+	}
+	return strings.ReplaceAll(s[0], s[1], s[2]), nil
+}
+
+func toString(args []interface{}) (interface{}, error) {
+
+	switch v := args[0].(type) {
+	case string:
+		return v, nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case nil:
+		return nil, &ExpressionError{Function: "string", Arg: 0, Value: v, Msg: "no value"}
+	}
+	if typed(args[0]) {
+		return formatTyped(args[0]), nil
+	}
+	if _, ok := numberOf(args[0]); ok {
+		return fmt.Sprintf("%d", args[0]), nil
+	}
+	return nil, &ExpressionError{Function: "string", Arg: 0, Value: args[0], Msg: fmt.Sprintf("cannot write %T", args[0])}
+}
+
+func toInt(args []interface{}) (interface{}, error) {
+
+	if s, ok := args[0].(string); ok {
+		i, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, &ExpressionError{Function: "int", Arg: 0, Value: s, Msg: "not an integer"}
+		}
+		return i, nil
+	}
+	n, ok := numberOf(args[0])
+	if !ok {
+		return nil, &ExpressionError{Function: "int", Arg: 0, Value: args[0], Msg: "not a number or a string"}
+	}
+	if n.kind == reflect.Float64 {
+		f := math.Trunc(n.f)
+		if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 || int64(int(f)) != int64(f) {
+			return nil, &ExpressionError{Function: "int", Arg: 0, Value: args[0], Msg: "out of range"}
+		}
+		return int(f), nil
+	}
+	return intResult("int", args[0], n.bigInt())
+}
+
+func toFloat(args []interface{}) (interface{}, error) {
+
+	if s, ok := args[0].(string); ok {
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return nil, &ExpressionError{Function: "float", Arg: 0, Value: s, Msg: "not a number"}
+		}
+		return f, nil
+	}
+	n, ok := numberOf(args[0])
+	if !ok {
+		return nil, &ExpressionError{Function: "float", Arg: 0, Value: args[0], Msg: "not a number or a string"}
+	}
+	return n.float(), nil
+}
@@ -0,0 +1,167 @@
+package engine
+
+import "errors"
+import "math"
+import "testing"
+import "time"
+
+func TestExpressions(t *testing.T) {
+
+	noon := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	bindings := Bindings{"price": 10, "rate": 1.5, "first": "Ada", "last": "Lovelace", "when": noon, "count": uint8(7)}
+
+	tests := []struct {
+		expression Expression
+		expected   interface{}
+	}{
+		{Call("mul", Variable("price"), 3), 30},
+		{Call("mul", Variable("price"), Variable("rate")), 15.0},
+		{Call("add", Variable("count"), int64(1)), 8},
+		{Call("div", 7, 2), 3},
+		{Call("div", 7, 2.0), 3.5},
+		{Call("mod", -7, 2), -1},
+		{Call("sub", Variable("price"), Call("mul", 2, 3)), 4},
+		{Call("neg", Variable("price")), -10},
+		{Call("abs", -2.5), 2.5},
+		{Call("round", 2.5), 3.0},
+		{Call("floor", Variable("count")), 7},
+		{Call("min", 3, 1.5, Variable("price")), 1.5},
+		{Call("max", "pear", "apple"), "pear"},
+		{Call("concat", Variable("first"), " ", Variable("last")), "Ada Lovelace"},
+		{Call("upper", Variable("first")), "ADA"},
+		{Call("trim", "  x "), "x"},
+		{Call("length", "héllo"), 5},
+		{Call("replace", "a-b-c", "-", "+"), "a+b+c"},
+		{Call("string", Variable("rate")), "1.5"},
+		{Call("string", Variable("count")), "7"},
+		{Call("string", true), "true"},
+		{Call("concat", "#", Call("string", Variable("price"))), "#10"},
+		{Call("int", "42"), 42},
+		{Call("int", -2.7), -2},
+		{Call("float", Variable("price")), 10.0},
+		{Call("float", "2.5"), 2.5},
+		{Call("add", Variable("when"), time.Hour), noon.Add(time.Hour)},
+		{Call("sub", Call("add", Variable("when"), time.Hour), Variable("when")), time.Hour},
+		{Call("neg", time.Minute), -time.Minute},
+	}
+	for i, tst := range tests {
+		err := tst.expression.check(map[Variable]bool{"price": true, "rate": true, "first": true, "last": true, "when": true, "count": true})
+		if err != nil {
+			t.Errorf("Test %d %s: %s\n", i, tst.expression, err)
+			continue
+		}
+		result, err := evaluate(tst.expression, bindings)
+		if err != nil {
+			t.Errorf("Test %d %s: %s\n", i, tst.expression, err)
+			continue
+		}
+		if result != tst.expected {
+			t.Errorf("Test %d %s: expected %#v, got %#v\n", i, tst.expression, tst.expected, result)
+		}
+	}
+
+	for i, tst := range []struct {
+		expression Expression
+		arg        int
+	}{
+		{Call("mul", Variable("first"), 2), 0},
+		{Call("add", 1, true), 1},
+		{Call("div", Variable("price"), 0), 1},
+		{Call("mod", 7, 2.0), 1},
+		{Call("concat", Variable("first"), Variable("price")), 1},
+		{Call("upper", 3), 0},
+		{Call("int", "x"), 0},
+		{Call("int", math.Inf(1)), 0},
+		{Call("mul", math.MaxInt64, 2), 0},
+		{Call("add", Variable("when"), 5), 1},
+		{Call("min", 1, "a"), 1},
+		{Call("string", nil), 0},
+	} {
+		_, err := evaluate(tst.expression, bindings)
+		var exprErr *ExpressionError
+		if !errors.As(err, &exprErr) {
+			t.Errorf("Test error %d %s: expected an ExpressionError, got %v\n", i, tst.expression, err)
+			continue
+		}
+		if exprErr.Arg != tst.arg {
+			t.Errorf("Test error %d %s: expected argument %d, got %s\n", i, tst.expression, tst.arg, err)
+		}
+	}
+
+	var o Variable = "o"
+	var p Variable = "p"
+	var first Variable = "first"
+	var last Variable = "last"
+	var f Variable = "f"
+
+	testEngine := Engine{}
+	rules := []Rule{
+		Rule{
+			Id:  "gross",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "price", Comparator: EQ, Value: p}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "gross", Value: Call("mul", p, 1.2)}},
+		},
+		Rule{
+			Id: "name",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "first", Comparator: EQ, Value: first},
+				Condition{ObjectId: o, Attribute: "last", Comparator: EQ, Value: last},
+			},
+			RHS: []Inference{Inference{ObjectId: Call("concat", "person:", Call("lower", last)), Attribute: "name", Value: Call("concat", first, " ", last)}},
+		},
+		Rule{
+			Id:            "count",
+			LHS:           []Condition{Condition{Label: f, ObjectId: o, Attribute: "remaining", Comparator: GT, Value: 0}, Condition{ObjectId: o, Attribute: "remaining", Comparator: EQ, Value: p}},
+			Modifications: []Modification{Modification{Target: f, Value: Call("sub", p, 1)}},
+		},
+	}
+	for _, r := range rules {
+		err := testEngine.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+	for _, fct := range []Fact{
+		Fact{"item1", "price", 10},
+		Fact{"p1", "first", "Ada"},
+		Fact{"p1", "last", "Lovelace"},
+		Fact{"timer", "remaining", 3},
+	} {
+		err := testEngine.Assert(fct)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	result, err := testEngine.GetInferences("item1", "gross")
+	if err != nil || len(result) != 1 || result[0].Value != 12.0 {
+		t.Errorf("Test gross: expected 12.0, got %v %v\n", result, err)
+	}
+	result, err = testEngine.GetInferences("person:lovelace", "name")
+	if err != nil || len(result) != 1 || result[0].Value != "Ada Lovelace" {
+		t.Errorf("Test name: expected Ada Lovelace, got %v %v\n", result, err)
+	}
+	facts, err := testEngine.GetFacts("timer", "remaining")
+	if err != nil || len(facts) != 1 || facts[0].Value != 0 {
+		t.Errorf("Test count down: expected 0, got %v %v\n", facts, err)
+	}
+
+	//an operand of the wrong kind is reported when the rule fires
+	err = testEngine.Assert(Fact{"item2", "price", "cheap"})
+	var exprErr *ExpressionError
+	if !errors.As(err, &exprErr) || exprErr.Function != "mul" || exprErr.Value != "cheap" {
+		t.Errorf("Test typed error: expected an ExpressionError, got %v\n", err)
+	}
+
+	for i, r := range []Rule{
+		Rule{Id: "unknown", LHS: rules[0].LHS, RHS: []Inference{Inference{ObjectId: o, Attribute: "x", Value: Call("pow", p, 2)}}},
+		Rule{Id: "arity", LHS: rules[0].LHS, RHS: []Inference{Inference{ObjectId: o, Attribute: "x", Value: Call("mul", p)}}},
+		Rule{Id: "unbound", LHS: rules[0].LHS, RHS: []Inference{Inference{ObjectId: o, Attribute: "x", Value: Call("mul", p, Variable("q"))}}},
+		Rule{Id: "nested", LHS: rules[0].LHS, RHS: []Inference{Inference{ObjectId: o, Attribute: "x", Value: Call("abs", Call("upper"))}}},
+		Rule{Id: "condition", LHS: []Condition{Condition{ObjectId: o, Attribute: "price", Comparator: GT, Value: Call("add", 1, 2)}}},
+	} {
+		err = (&Engine{}).Define(r)
+		if err == nil {
+			t.Errorf("Test define %d %s: expected an error\n", i, r.Id)
+		}
+	}
+}
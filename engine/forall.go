@@ -0,0 +1,666 @@
+package engine
+
+import "fmt"
+
+//a quantifier tests a partial match against conditions of its own, which are joined with
+//each other and with the variables that the partial match binds. It is not a chain of join
+//nodes: for each partial match reaching it, it keeps the matches of its conditions up to each
+//of them, so that a fact entering or leaving the alpha memory of one of its conditions is
+//joined only with the matches up to the condition before, and only the partial matches whose
+//matches changed are tested again.
+type quantifier struct {
+	conditions []Condition
+	alphas     []*alphaNode          //one per condition
+	outer      map[Variable]betaTest //where the variables bound before the quantifier are bound
+	aggregate  *Aggregate            //nil for forall and a negated group
+	none       bool                  //a negated group
+	comparator Operator              //the test of an aggregate's result,
+	compareTo  interface{}           //against a constant or an outer variable (nil for none)
+
+	levels []*innerLevel              //one per condition, nil until the quantifier is first used
+	owners map[*betaToken]*quantified //by partial match reaching the join node
+	dirty  []*quantified              //whose matches have changed since they were last tested
+}
+
+//an innerLevel holds the facts that a condition of a quantifier has taken in from its alpha
+//memory, and the matches of the conditions up to it
+type innerLevel struct {
+	facts     []*Fact
+	positions map[*Fact]int //index of each fact in facts
+	matches   []*innerMatch
+	byFact    map[*Fact][]*innerMatch //the matches ending with each fact
+}
+
+//an innerMatch is a match of the conditions of a quantifier up to one of them, for one
+//partial match reaching its join node
+type innerMatch struct {
+	owner        *quantified
+	parent       *innerMatch //nil at the first condition
+	level        int         //condition number, within the quantifier
+	fact         *Fact       //nil for a negated condition
+	bindings     Bindings
+	children     []*innerMatch
+	position     int  //index in the children of parent (or the roots of owner)
+	index        int  //index in the matches of the level
+	factPosition int  //index in the matches of the level ending with fact
+	blockers     int  //facts blocking it at the next condition, if that is negated
+	complete     int  //forall: complete matches extending it, at the first condition
+	removed      bool
+}
+
+//quantified holds the matches of a quantifier's conditions for one partial match reaching its
+//join node, and what they add up to
+type quantified struct {
+	left        *betaToken
+	bindings    Bindings      //of the outer variables
+	roots       []*innerMatch //matches of the first condition
+	complete    int           //matches of all the conditions
+	unsatisfied int           //forall: matches of the first condition that no complete match extends
+	dirty       bool
+	removed     bool
+}
+
+//compileForAll checks forall condition i of a rule and makes its quantifier, which still
+//needs its alpha nodes
+func compileForAll(testNetwork map[Variable][]betaTest, lhs []Condition, i int) (*quantifier, error) {
+
+	condition := lhs[i]
+	if condition.NotExists {
+		return nil, fmt.Errorf("A forall condition cannot be negated")
+	}
+	if condition.Label != "" {
+		return nil, fmt.Errorf("Label %s cannot be used with a forall condition", condition.Label)
+	}
+	if condition.ObjectId != nil || condition.Attribute != "" || condition.Value != nil || condition.Any != nil || condition.Aggregate != nil || condition.None != nil {
+		return nil, fmt.Errorf("A forall condition cannot also have an object, attribute, value, alternatives, aggregate or negated group")
+	}
+	if len(condition.ForAll) < 2 {
+		return nil, fmt.Errorf("A forall condition needs a condition and at least one more that each of its facts must match")
+	}
+
+	q := &quantifier{conditions: condition.ForAll}
+	_, err := q.compileConditions(testNetwork, lhs, i, "forall")
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+//compileConditions checks the conditions of a quantifier (within says which kind, for the
+//errors), finds where its outer variables are bound and returns the variables it binds itself
+func (q *quantifier) compileConditions(testNetwork map[Variable][]betaTest, lhs []Condition, i int, within string) (map[Variable]bool, error) {
+
+	q.outer = make(map[Variable]betaTest)
+	local := make(map[Variable]bool) //bound by the conditions of the quantifier
+	for j, c := range q.conditions {
+		if c.Any != nil || c.ForAll != nil || c.Aggregate != nil || c.None != nil {
+			return nil, fmt.Errorf("Conditions within %s cannot have alternatives, forall, aggregates or negated groups of their own", within)
+		}
+		if c.Label != "" {
+			return nil, fmt.Errorf("Label %s cannot be used within %s", c.Label, within)
+		}
+		if j == 0 && c.NotExists {
+			return nil, fmt.Errorf("The first condition of %s cannot be negated", within)
+		}
+		switch c.ObjectId.(type) {
+		case string, Variable:
+		default:
+			return nil, fmt.Errorf("ObjectId must be string or Variable, not %T", c.ObjectId)
+		}
+		if _, ok := c.Value.(Expression); ok {
+			return nil, fmt.Errorf("Expression %s cannot be used in a condition", c.Value)
+		}
+
+		var variables []Variable
+		if v, ok := c.ObjectId.(Variable); ok {
+			variables = append(variables, v)
+		}
+		if v, ok := c.Value.(Variable); ok {
+			variables = append(variables, v)
+		}
+		for _, v := range variables {
+			tst, bound := firstBinding(testNetwork, lhs, v, i)
+			if bound {
+				q.outer[v] = tst
+			}
+			if v == c.Value && c.Comparator != EQ && !bound && !local[v] {
+				return nil, fmt.Errorf("Value variable %s must be bound by an earlier condition to be used with %s", v, c.Comparator.String())
+			}
+			if !bound && !c.NotExists {
+				local[v] = true
+			}
+		}
+	}
+	return local, nil
+}
+
+//bindings returns the values of the outer variables in a partial match
+func (q *quantifier) bindings(left *betaToken) Bindings {
+
+	b := make(Bindings, len(q.outer))
+	for v, tst := range q.outer {
+		f := left.factAt(tst.tokenIndex)
+		if tst.objectElseValue {
+			b[v] = f.ObjectId
+		} else {
+			b[v] = f.Value
+		}
+	}
+	return b
+}
+
+//unify matches a fact (which has passed the constant tests of the condition) against the
+//variables of the condition. Bound variables must have the same value (or, for a relational
+//test, pass it) and, as in join nodes, newly bound variables must differ from the others.
+//The bindings are copied if any are added, once the fact is known to match.
+func unify(c Condition, f *Fact, b Bindings) (Bindings, bool, error) {
+
+	var added [2]Variable //at most the object and the value
+	var values [2]interface{}
+	n := 0
+	lookup := func(v Variable) (interface{}, bool) {
+		for i := 0; i < n; i++ {
+			if added[i] == v {
+				return values[i], true
+			}
+		}
+		bound, ok := b[v]
+		return bound, ok
+	}
+	bind := func(v Variable, value interface{}) (bool, error) {
+		if bound, ok := lookup(v); ok {
+			return sameValue(value, bound)
+		}
+		for _, other := range b {
+			same, err := sameValue(value, other)
+			if err != nil || same {
+				return false, err
+			}
+		}
+		for i := 0; i < n; i++ {
+			same, err := sameValue(value, values[i])
+			if err != nil || same {
+				return false, err
+			}
+		}
+		added[n], values[n] = v, value
+		n++
+		return true, nil
+	}
+
+	if v, ok := c.ObjectId.(Variable); ok {
+		ok, err := bind(v, f.ObjectId)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+	}
+	if v, ok := c.Value.(Variable); ok {
+		if c.Comparator != EQ {
+			bound, _ := lookup(v)
+			passed, err := match(f.Value, c.Comparator, bound)
+			if err != nil || !passed {
+				return nil, false, err
+			}
+		} else {
+			ok, err := bind(v, f.Value)
+			if err != nil || !ok {
+				return nil, false, err
+			}
+		}
+	}
+	if n == 0 {
+		return b, true, nil
+	}
+	copied := make(Bindings, len(b)+n)
+	for k, val := range b {
+		copied[k] = val
+	}
+	for i := 0; i < n; i++ {
+		copied[added[i]] = values[i]
+	}
+	return copied, true, nil
+}
+
+//sameValue compares values as join tests do: an object id is only ever equal to a string
+func sameValue(a interface{}, b interface{}) (bool, error) {
+
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	if aok || bok {
+		return aok && bok && as == bs, nil
+	}
+	return match(a, EQ, b)
+}
+
+//result returns the fact that a partial match is extended with at a quantifier's join node: the
+//null fact if a forall condition holds or nothing matches a negated group, a fact holding the
+//result of an aggregate that passes its test, or nil if there is none
+func (q *quantifier) result(o *quantified) (*Fact, error) {
+
+	switch {
+	case q.aggregate != nil:
+		var values []interface{}
+		if q.aggregate.Of != "" {
+			values = q.values(o.roots, values)
+		}
+		return q.aggregated(o.bindings, values, o.complete)
+	case q.none && o.complete > 0:
+		return nil, nil
+	case !q.none && o.unsatisfied > 0:
+		return nil, nil
+	}
+	return q.alphas[0].parentEngine.nullFact, nil
+}
+
+//forAll reports whether the quantifier is that of a forall condition
+func (q *quantifier) forAll() bool {
+
+	return q.aggregate == nil && !q.none
+}
+
+//load fills the levels of a quantifier from its alpha memories when it is first used, as they
+//may hold facts from before its join node was built
+func (q *quantifier) load() {
+
+	if q.levels != nil {
+		return
+	}
+	q.owners = make(map[*betaToken]*quantified)
+	q.levels = make([]*innerLevel, len(q.conditions))
+	for j, a := range q.alphas {
+		q.levels[j] = &innerLevel{positions: make(map[*Fact]int), byFact: make(map[*Fact][]*innerMatch)}
+		for _, f := range a.facts {
+			q.levels[j].addFact(f)
+		}
+	}
+}
+
+//unload drops the matches of a quantifier whose join node is taken out of the network
+func (q *quantifier) unload() {
+
+	q.levels = nil
+	q.owners = nil
+	q.dirty = nil
+}
+
+//quantify tests a new partial match reaching a quantifier's join node
+func (node *joinNode) quantify(left *betaToken) error {
+
+	q := node.quantifier
+	q.load()
+	q.leave(left) //if it has reached the node before
+	o := &quantified{left: left, bindings: q.bindings(left)}
+	q.owners[left] = o
+	q.mark(o)
+	err := q.grow(o, nil, 0)
+	if err != nil {
+		return err
+	}
+	return node.settle()
+}
+
+//requantify brings a quantifier up to date with a fact that has entered or left the alpha
+//memory of one (or more) of its conditions, and tests again the partial matches it affects
+func (node *joinNode) requantify(f *Fact) error {
+
+	q := node.quantifier
+	q.load()
+	for j, a := range q.alphas {
+		_, held := q.levels[j].positions[f]
+		_, present := a.positions[f]
+		var err error
+		switch {
+		case present && !held:
+			err = q.takeIn(node.leftInputs(), j, f)
+		case held && !present:
+			err = q.letGo(j, f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return node.settle()
+}
+
+//settle extends each partial match whose matches have changed with the new result of the
+//quantifier, removing the extension with the old one
+func (node *joinNode) settle() error {
+
+	q := node.quantifier
+	dirty := q.dirty
+	q.dirty = nil
+	for _, o := range dirty {
+		o.dirty = false
+		if o.removed {
+			continue
+		}
+		f, err := q.result(o)
+		if err != nil {
+			return err
+		}
+		child := node.childOf(o.left)
+		if child != nil {
+			if f != nil && child.fact == f {
+				continue //a forall condition or a negated group still holds
+			}
+			if f != nil && f.Attribute == child.fact.Attribute {
+				same, err := sameValue(f.Value, child.fact.Value)
+				if err != nil {
+					return err
+				}
+				if same {
+					continue //the aggregate is unchanged
+				}
+			}
+			err = child.remove()
+			if err != nil {
+				return err
+			}
+		}
+		if f != nil {
+			err = node.extend(o.left, f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//leave drops the matches of a partial match that no longer reaches the join node
+func (q *quantifier) leave(left *betaToken) {
+
+	o := q.owners[left]
+	if o == nil {
+		return
+	}
+	delete(q.owners, left)
+	o.removed = true
+	for _, m := range append([]*innerMatch(nil), o.roots...) {
+		q.remove(m)
+	}
+}
+
+//mark notes that the matches of a partial match have changed
+func (q *quantifier) mark(o *quantified) {
+
+	if !o.dirty {
+		o.dirty = true
+		q.dirty = append(q.dirty, o)
+	}
+}
+
+//takeIn adds a fact to condition j, extending the matches up to the condition before
+//(or, for the first, the partial matches reaching the join node) or, if the condition is
+//negated, blocking them
+func (q *quantifier) takeIn(lefts []*betaToken, j int, f *Fact) error {
+
+	q.levels[j].addFact(f)
+	c := q.conditions[j]
+	if j == 0 {
+		for _, left := range lefts {
+			o := q.owners[left]
+			if o == nil {
+				continue
+			}
+			b, ok, err := unify(c, f, o.bindings)
+			if err != nil {
+				return err
+			}
+			if ok {
+				err = q.add(o, nil, 0, f, b)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, m := range q.levels[j-1].matches {
+		b, ok, err := unify(c, f, m.bindings)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if c.NotExists {
+			m.blockers++
+			if m.blockers == 1 && len(m.children) > 0 {
+				q.remove(m.children[0])
+			}
+			continue
+		}
+		err = q.add(m.owner, m, j, f, b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//letGo removes a fact from condition j, with the matches ending with it or, if the condition
+//is negated, unblocking the matches up to the condition before
+func (q *quantifier) letGo(j int, f *Fact) error {
+
+	level := q.levels[j]
+	c := q.conditions[j]
+	if !c.NotExists {
+		for _, m := range append([]*innerMatch(nil), level.byFact[f]...) {
+			q.remove(m)
+		}
+		level.removeFact(f)
+		return nil
+	}
+	level.removeFact(f)
+	for _, m := range q.levels[j-1].matches {
+		_, ok, err := unify(c, f, m.bindings)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		m.blockers--
+		if m.blockers == 0 {
+			err = q.add(m.owner, m, j, nil, m.bindings)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//grow extends a match up to condition j-1 (or, for j = 0, the partial match of o) with the
+//facts that condition j has taken in
+func (q *quantifier) grow(o *quantified, parent *innerMatch, j int) error {
+
+	if j == len(q.conditions) {
+		return nil
+	}
+	b := o.bindings
+	if parent != nil {
+		b = parent.bindings
+	}
+	c := q.conditions[j]
+	if c.NotExists {
+		parent.blockers = 0
+		for _, f := range q.levels[j].facts {
+			_, ok, err := unify(c, f, b)
+			if err != nil {
+				return err
+			}
+			if ok {
+				parent.blockers++
+			}
+		}
+		if parent.blockers > 0 {
+			return nil
+		}
+		return q.add(o, parent, j, nil, b)
+	}
+	for _, f := range q.levels[j].facts {
+		b1, ok, err := unify(c, f, b)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		err = q.add(o, parent, j, f, b1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//add makes a match up to condition j and extends it with the conditions after
+func (q *quantifier) add(o *quantified, parent *innerMatch, j int, f *Fact, b Bindings) error {
+
+	m := &innerMatch{owner: o, parent: parent, level: j, fact: f, bindings: b}
+	if parent == nil {
+		m.position = len(o.roots)
+		o.roots = append(o.roots, m)
+	} else {
+		m.position = len(parent.children)
+		parent.children = append(parent.children, m)
+	}
+	q.levels[j].remember(m)
+	q.mark(o)
+	if j == 0 && q.forAll() {
+		o.unsatisfied++
+	}
+	if j == len(q.conditions)-1 {
+		q.completed(m, 1)
+	}
+	return q.grow(o, m, j+1)
+}
+
+//remove takes a match out, with the matches extending it
+func (q *quantifier) remove(m *innerMatch) {
+
+	if m.removed {
+		return
+	}
+	m.removed = true
+	children := m.children
+	m.children = nil
+	for _, c := range children {
+		q.remove(c)
+	}
+	o := m.owner
+	if m.level == len(q.conditions)-1 {
+		q.completed(m, -1)
+	}
+	if m.level == 0 && q.forAll() && m.complete == 0 {
+		o.unsatisfied--
+	}
+	if m.parent == nil {
+		o.roots = unlinkMatch(o.roots, m)
+	} else {
+		m.parent.children = unlinkMatch(m.parent.children, m)
+	}
+	q.levels[m.level].forget(m)
+	q.mark(o)
+}
+
+//completed counts a complete match in (delta 1) or out (delta -1)
+func (q *quantifier) completed(m *innerMatch, delta int) {
+
+	o := m.owner
+	o.complete += delta
+	if !q.forAll() {
+		return
+	}
+	root := m
+	for root.parent != nil {
+		root = root.parent
+	}
+	root.complete += delta
+	switch {
+	case delta > 0 && root.complete == 1:
+		o.unsatisfied--
+	case delta < 0 && root.complete == 0:
+		o.unsatisfied++
+	}
+}
+
+//values returns the values of the aggregated variable in the complete matches extending the given ones
+func (q *quantifier) values(matches []*innerMatch, values []interface{}) []interface{} {
+
+	for _, m := range matches {
+		if m.level == len(q.conditions)-1 {
+			values = append(values, m.bindings[q.aggregate.Of])
+			continue
+		}
+		values = q.values(m.children, values)
+	}
+	return values
+}
+
+func unlinkMatch(list []*innerMatch, m *innerMatch) []*innerMatch {
+
+	last := len(list) - 1
+	if m.position > last || list[m.position] != m {
+		return list
+	}
+	list[m.position] = list[last]
+	list[m.position].position = m.position
+	list[last] = nil
+	return list[:last]
+}
+
+func (level *innerLevel) addFact(f *Fact) {
+
+	level.positions[f] = len(level.facts)
+	level.facts = append(level.facts, f)
+}
+
+func (level *innerLevel) removeFact(f *Fact) {
+
+	i, ok := level.positions[f]
+	if !ok {
+		return
+	}
+	delete(level.positions, f)
+	last := len(level.facts) - 1
+	level.facts[i] = level.facts[last]
+	level.facts[last] = nil
+	level.facts = level.facts[:last]
+	if i < last {
+		level.positions[level.facts[i]] = i
+	}
+}
+
+func (level *innerLevel) remember(m *innerMatch) {
+
+	m.index = len(level.matches)
+	level.matches = append(level.matches, m)
+	if m.fact != nil {
+		m.factPosition = len(level.byFact[m.fact])
+		level.byFact[m.fact] = append(level.byFact[m.fact], m)
+	}
+}
+
+func (level *innerLevel) forget(m *innerMatch) {
+
+	last := len(level.matches) - 1
+	level.matches[m.index] = level.matches[last]
+	level.matches[m.index].index = m.index
+	level.matches[last] = nil
+	level.matches = level.matches[:last]
+	if m.fact != nil {
+		list := level.byFact[m.fact]
+		last = len(list) - 1
+		list[m.factPosition] = list[last]
+		list[m.factPosition].factPosition = m.factPosition
+		list[last] = nil
+		if last == 0 {
+			delete(level.byFact, m.fact)
+		} else {
+			level.byFact[m.fact] = list[:last]
+		}
+	}
+}
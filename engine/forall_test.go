@@ -0,0 +1,167 @@
+package engine
+
+import "strings"
+import "testing"
+
+func TestForAll(t *testing.T) {
+
+	var p Variable = "p"
+	var r Variable = "r"
+	var limit Variable = "limit"
+
+	testEngine := Engine{}
+	rules := []Rule{
+		//every result of the patient is normal
+		Rule{
+			Id: "cleared",
+			LHS: []Condition{
+				Condition{ObjectId: p, Attribute: "kind", Comparator: EQ, Value: "patient"},
+				Condition{ForAll: []Condition{
+					Condition{ObjectId: r, Attribute: "patient", Comparator: EQ, Value: p},
+					Condition{ObjectId: r, Attribute: "status", Comparator: EQ, Value: "normal"},
+				}},
+			},
+			RHS: []Inference{Inference{ObjectId: p, Attribute: "cleared", Value: true}},
+		},
+		//every reading is within the limit and has not been flagged
+		Rule{
+			Id: "within",
+			LHS: []Condition{
+				Condition{ObjectId: "ward", Attribute: "limit", Comparator: EQ, Value: limit},
+				Condition{ForAll: []Condition{
+					Condition{ObjectId: r, Attribute: "reading", Comparator: EQ, Value: nil},
+					Condition{ObjectId: r, Attribute: "reading", Comparator: LE, Value: limit},
+					Condition{NotExists: true, ObjectId: r, Attribute: "flagged", Comparator: EQ, Value: true},
+				}},
+			},
+			RHS: []Inference{Inference{ObjectId: "ward", Attribute: "within", Value: limit}},
+		},
+	}
+	for _, rule := range rules {
+		err := testEngine.Define(rule)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", rule.Id, err)
+		}
+	}
+
+	cleared := func(test string, expected ...string) {
+		result, err := testEngine.GetInferences("", "cleared")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		var got []string
+		for _, f := range result {
+			got = append(got, f.ObjectId)
+		}
+		if strings.Join(got, " ") != strings.Join(expected, " ") {
+			t.Errorf("Test %s: expected %v cleared, got %v\n", test, expected, got)
+		}
+	}
+	change := func(retract bool, facts ...Fact) {
+		for _, f := range facts {
+			var err error
+			if retract {
+				err = testEngine.Retract(f)
+			} else {
+				err = testEngine.Assert(f)
+			}
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+	}
+
+	//with no results at all, forall holds
+	change(false, Fact{"ann", "kind", "patient"})
+	cleared("1", "ann")
+	change(false, Fact{"r1", "patient", "ann"})
+	cleared("2")
+	change(false, Fact{"r1", "status", "normal"})
+	cleared("3", "ann")
+	change(false, Fact{"r2", "patient", "ann"}, Fact{"r2", "status", "high"})
+	cleared("4")
+	change(true, Fact{"r2", "status", "high"})
+	cleared("5")
+	change(false, Fact{"r2", "status", "normal"})
+	cleared("6", "ann")
+
+	//the results of another patient are joined with that patient only
+	change(false, Fact{"bob", "kind", "patient"}, Fact{"r3", "patient", "bob"}, Fact{"r3", "status", "high"})
+	cleared("7", "ann")
+	change(true, Fact{"r3", "patient", "bob"})
+	cleared("8", "ann bob")
+
+	//a relational test against an outer variable, and a negated condition
+	within := func(test string, expected bool) {
+		result, _ := testEngine.GetInferences("ward", "within")
+		if (len(result) == 1) != expected {
+			t.Errorf("Test %s: expected within to be %v, got %v\n", test, expected, result)
+		}
+	}
+	change(false, Fact{"ward", "limit", 40}, Fact{"x1", "reading", 38})
+	within("9", true)
+	change(false, Fact{"x2", "reading", 41})
+	within("10", false)
+	change(false, Fact{"ward", "limit", 41})
+	within("11", true) //for the second limit
+	change(false, Fact{"x1", "flagged", true})
+	within("12", false)
+
+	diagnosis, err := testEngine.WhyNot("cleared")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	s := diagnosis.String()
+	if !strings.Contains(s, "[1] forall (?r patient EQ ?p: ?r status EQ \"normal\"): 2 facts\n") || !strings.Contains(s, "[1] holds for every fact\n") {
+		t.Errorf("Test 13: unexpected diagnosis\n%s", s)
+	}
+	explanation, err := testEngine.Explain(Fact{"ann", "cleared", true})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(explanation.Derivations) != 1 || !explanation.Derivations[0].Support[1].ForAll {
+		t.Errorf("Test 13: unexpected explanation\n%s", explanation.String())
+	}
+
+	//the alpha nodes of the conditions within forall go with the rules
+	for _, rule := range rules {
+		err = testEngine.Undefine(rule.Id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if len(testEngine.alphaNetwork) != 0 {
+		t.Errorf("Test 14: expected no alpha nodes, got %d attributes\n", len(testEngine.alphaNetwork))
+	}
+}
+
+func TestForAllErrors(t *testing.T) {
+
+	var p Variable = "p"
+	var r Variable = "r"
+	var v Variable = "v"
+
+	patient := Condition{ObjectId: p, Attribute: "kind", Comparator: EQ, Value: "patient"}
+	result := Condition{ObjectId: r, Attribute: "patient", Comparator: EQ, Value: p}
+	normal := Condition{ObjectId: r, Attribute: "status", Comparator: EQ, Value: "normal"}
+	forall := Condition{ForAll: []Condition{result, normal}}
+
+	for i, test := range []struct {
+		rule Rule
+		msg  string
+	}{
+		{Rule{Id: "short", LHS: []Condition{patient, Condition{ForAll: []Condition{result}}}}, "A forall condition needs a condition and at least one more that each of its facts must match"},
+		{Rule{Id: "negated", LHS: []Condition{patient, Condition{NotExists: true, ForAll: forall.ForAll}}}, "A forall condition cannot be negated"},
+		{Rule{Id: "first", LHS: []Condition{patient, Condition{ForAll: []Condition{Condition{NotExists: true, ObjectId: r, Attribute: "patient", Value: p}, normal}}}}, "The first condition of forall cannot be negated"},
+		{Rule{Id: "relational", LHS: []Condition{patient, Condition{ForAll: []Condition{result, Condition{ObjectId: r, Attribute: "level", Comparator: GT, Value: v}}}}}, "Value variable v must be bound by an earlier condition to be used with GT"},
+		{Rule{Id: "labelled", LHS: []Condition{patient, Condition{ForAll: []Condition{result, Condition{Label: "f", ObjectId: r, Attribute: "status", Value: "normal"}}}}}, "Label f cannot be used within forall"},
+		{Rule{Id: "local", LHS: []Condition{patient, forall}, RHS: []Inference{Inference{ObjectId: r, Attribute: "ok", Value: true}}}, "Variable r in local is not bound by a condition"},
+		{Rule{Id: "target", LHS: []Condition{patient, forall}, Retractions: []Retraction{Retraction{Target: 1}}}, "Target 1 is a forall condition and matches no single fact"},
+	} {
+		testEngine := Engine{}
+		err := testEngine.Define(test.rule)
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("Test %d: expected %q, got %v\n", i+1, test.msg, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package engine
+
+import "fmt"
+import "reflect"
+import "sort"
+import "time"
+
+//a valueKey normalizes a value so that values that match EQ have equal keys
+//(numbers compare by value, so int8(1), uint(1) and 1.0 are equal; typed values are
+//compared by type, so a duration is not equal to any integer)
+type valueKey struct {
+	kind  reflect.Kind
+	value interface{}
+}
+
+func keyOf(v interface{}) valueKey {
+
+	switch t := v.(type) {
+	case time.Time:
+		//equal instants in any location, with or without a monotonic clock reading
+		return valueKey{reflect.Struct, t.Round(0).UTC()}
+	case time.Duration:
+		return valueKey{reflect.Int64, t}
+	}
+	if n, ok := numberOf(v); ok {
+		n = n.normalize()
+		switch n.kind {
+		case reflect.Int64:
+			return valueKey{reflect.Int64, n.i}
+		case reflect.Uint64:
+			return valueKey{reflect.Uint64, n.u}
+		}
+		return valueKey{reflect.Float64, n.f}
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return valueKey{}
+	case reflect.String:
+		return valueKey{reflect.String, rv.String()}
+	}
+	if rv.Type().Comparable() {
+		return valueKey{rv.Kind(), v}
+	}
+	return valueKey{rv.Kind(), fmt.Sprintf("%#v", v)}
+}
+
+//a factKey indexes working memory, which holds no two facts that match EQ
+type factKey struct {
+	objectId  string
+	attribute string
+	value     valueKey
+}
+
+func factKeyOf(f *Fact) factKey {
+
+	return factKey{f.ObjectId, f.Attribute, keyOf(f.Value)}
+}
+
+//an alphaKey indexes the alpha network. Alpha nodes that test for equality with a
+//constant are found from the value of a fact; all others (comparisons, and conditions
+//with a value variable) are found from the attribute and object constraint alone.
+type alphaKey struct {
+	attribute string
+	objectId  string //"" if the node has no object constraint
+	constant  bool
+	value     valueKey
+}
+
+func (node *alphaNode) key() alphaKey {
+
+	k := alphaKey{attribute: node.attributeName, objectId: node.objConstraint}
+	if node.comparator == EQ && node.compareTo != nil {
+		k.constant = true
+		k.value = keyOf(node.compareTo)
+	}
+	return k
+}
+
+func (engine *Engine) indexAlphaNode(node *alphaNode) {
+
+	if engine.alphaIndex == nil {
+		engine.alphaIndex = make(map[alphaKey][]*alphaNode)
+	}
+	engine.alphaCount++
+	node.seq = engine.alphaCount
+	k := node.key()
+	engine.alphaIndex[k] = append(engine.alphaIndex[k], node)
+}
+
+func (engine *Engine) unindexAlphaNode(node *alphaNode) {
+
+	k := node.key()
+	list := engine.alphaIndex[k]
+	for i, n := range list {
+		if n == node {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(engine.alphaIndex, k)
+	} else {
+		engine.alphaIndex[k] = list
+	}
+}
+
+//alphaCandidates returns the alpha nodes that may match a fact, in the order they were created
+func (engine *Engine) alphaCandidates(f *Fact) []*alphaNode {
+
+	value := keyOf(f.Value)
+	keys := [4]alphaKey{
+		{attribute: f.Attribute, objectId: f.ObjectId, constant: true, value: value},
+		{attribute: f.Attribute, constant: true, value: value},
+		{attribute: f.Attribute, objectId: f.ObjectId},
+		{attribute: f.Attribute},
+	}
+	var list []*alphaNode
+	for i, k := range keys {
+		if i%2 == 0 && f.ObjectId == "" {
+			continue //the same key follows
+		}
+		list = append(list, engine.alphaIndex[k]...)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].seq < list[j].seq })
+	return list
+}
@@ -0,0 +1,155 @@
+package engine
+
+import "fmt"
+import "math"
+import "testing"
+import "time"
+
+func TestValueKeys(t *testing.T) {
+
+	tests := []struct {
+		left  interface{}
+		right interface{}
+	}{
+		{"a", "a"},
+		{"a", "b"},
+		{int8(1), int64(1)},
+		{1, 1.0},
+		{float32(0.5), 0.5},
+		{3.14, 3.14},
+		{uint8(1), 1.0},
+		{uint64(1 << 63), float64(1 << 63)},
+		{uint64(1<<63 + 1), float64(1 << 63)},
+		{int64(-1), uint64(1<<64 - 1)},
+		{-0.0, 0},
+		{1<<53 + 1, float64(1 << 53)},
+		{math.NaN(), math.NaN()},
+		{nil, nil},
+		{nil, ""},
+		{true, true},
+		{true, false},
+		{time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 13, 0, 0, 0, time.FixedZone("CET", 3600))},
+		{time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 12, 0, 0, 1, time.UTC)},
+		{time.Second, time.Second},
+		{time.Duration(5), int64(5)},
+		{Null, Null},
+		{Null, nil},
+	}
+	for i, tst := range tests {
+		matched, err := match(tst.left, EQ, tst.right)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		if equal := keyOf(tst.left) == keyOf(tst.right); equal != matched {
+			t.Errorf("Test %d: expected keys equal %t, got %t\n", i, matched, equal)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+
+	var o Variable = "o"
+	var v Variable = "v"
+
+	testEngine := Engine{}
+	rules := []Rule{
+		Rule{
+			Id:  "red",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "colour", Comparator: EQ, Value: "red"}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "warm", Value: "yes"}},
+		},
+		Rule{
+			Id:  "heavy",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "weight", Comparator: GT, Value: 100}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "heavy", Value: "yes"}},
+		},
+		Rule{
+			Id:  "special",
+			LHS: []Condition{Condition{ObjectId: "item7", Attribute: "colour", Comparator: EQ, Value: v}},
+			RHS: []Inference{Inference{ObjectId: "item7", Attribute: "noted", Value: v}},
+		},
+	}
+	for _, r := range rules {
+		err := testEngine.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+
+	n := 5000
+	for i := 0; i < n; i++ {
+		colour := "blue"
+		if i%2 == 0 {
+			colour = "red"
+		}
+		for _, f := range []Fact{
+			Fact{fmt.Sprintf("item%d", i), "colour", colour},
+			Fact{fmt.Sprintf("item%d", i), "weight", i},
+			Fact{fmt.Sprintf("item%d", i), "colour", colour}, //a duplicate
+		} {
+			err := testEngine.Assert(f)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+	}
+
+	count := func(test string, objectId string, attribute string, expected int) {
+		result, err := testEngine.GetInferences(objectId, attribute)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		if len(result) != expected {
+			t.Errorf("Test %s: expected %d, got %d\n", test, expected, len(result))
+		}
+	}
+	count("1 warm", "", "warm", n/2)
+	count("1 heavy", "", "heavy", n-101)
+	count("1 noted", "item7", "noted", 1)
+	if len(testEngine.workingMemory) != len(testEngine.timetags) {
+		t.Errorf("Test 1 working memory: index has %d facts, memory %d\n", len(testEngine.workingMemory), len(testEngine.timetags))
+	}
+
+	for i := 0; i < n; i += 2 {
+		err := testEngine.Retract(Fact{fmt.Sprintf("item%d", i), "colour", "red"})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	count("2 warm", "", "warm", 0)
+	for _, node := range testEngine.alphaNetwork["colour"] {
+		if len(node.positions) != len(node.facts) {
+			t.Errorf("Test 2 positions: expected %d, got %d\n", len(node.facts), len(node.positions))
+		}
+		for i, f := range node.facts {
+			if node.positions[f] != i {
+				t.Errorf("Test 2 positions: %s is at %d, not %d\n", f.String(), i, node.positions[f])
+			}
+		}
+	}
+	for _, p := range testEngine.productions {
+		if len(p.positions) != len(p.tokens) {
+			t.Errorf("Test 2 tokens: expected %d, got %d\n", len(p.tokens), len(p.positions))
+		}
+		for i, tok := range p.tokens {
+			if p.positions[tok] != i {
+				t.Errorf("Test 2 tokens: token of %s is at %d, not %d\n", p.ruleId, i, p.positions[tok])
+			}
+		}
+	}
+	for i, act := range testEngine.agenda {
+		if act.index != i {
+			t.Errorf("Test 2 agenda: activation is at %d, not %d\n", i, act.index)
+		}
+	}
+
+	for _, r := range rules {
+		err := testEngine.Undefine(r.Id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if len(testEngine.alphaIndex) != 0 {
+		t.Errorf("Test 3 undefined: expected an empty index, got %d keys\n", len(testEngine.alphaIndex))
+	}
+}
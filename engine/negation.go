@@ -0,0 +1,26 @@
+package engine
+
+import "fmt"
+
+//compileNone checks negated group i of a rule (see Condition.None) and makes its quantifier,
+//which still needs its alpha nodes
+func compileNone(testNetwork map[Variable][]betaTest, lhs []Condition, i int) (*quantifier, error) {
+
+	condition := lhs[i]
+	if condition.NotExists {
+		return nil, fmt.Errorf("A negated group cannot be negated again")
+	}
+	if condition.Label != "" {
+		return nil, fmt.Errorf("Label %s cannot be used with a negated group", condition.Label)
+	}
+	if condition.ObjectId != nil || condition.Attribute != "" || condition.Value != nil || condition.Any != nil || condition.ForAll != nil || condition.Aggregate != nil {
+		return nil, fmt.Errorf("A negated group cannot also have an object, attribute, value, alternatives, forall or aggregate")
+	}
+
+	q := &quantifier{conditions: condition.None, none: true}
+	_, err := q.compileConditions(testNetwork, lhs, i, "a negated group")
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
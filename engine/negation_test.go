@@ -0,0 +1,150 @@
+package engine
+
+import "sort"
+import "strings"
+import "testing"
+
+func TestNegatedGroup(t *testing.T) {
+
+	var o Variable = "o"
+	var s Variable = "s"
+	var r Variable = "r"
+
+	testEngine := Engine{}
+	rules := []Rule{
+		//no shipment of the order has a signed receipt
+		Rule{
+			Id: "chase",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "kind", Comparator: EQ, Value: "order"},
+				Condition{None: []Condition{
+					Condition{ObjectId: s, Attribute: "shipment-of", Comparator: EQ, Value: o},
+					Condition{ObjectId: r, Attribute: "receipt-for", Comparator: EQ, Value: s},
+					Condition{ObjectId: r, Attribute: "signed", Comparator: EQ, Value: true},
+				}},
+			},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "chase", Value: true}},
+		},
+	}
+	for _, rule := range rules {
+		err := testEngine.Define(rule)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", rule.Id, err)
+		}
+	}
+
+	chased := func(test string, expected ...string) {
+		result, err := testEngine.GetInferences("", "chase")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		var got []string
+		for _, f := range result {
+			got = append(got, f.ObjectId)
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(expected, " ") {
+			t.Errorf("Test %s: expected %v chased, got %v\n", test, expected, got)
+		}
+	}
+	change := func(retract bool, facts ...Fact) {
+		for _, f := range facts {
+			var err error
+			if retract {
+				err = testEngine.Retract(f)
+			} else {
+				err = testEngine.Assert(f)
+			}
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+	}
+
+	//only all of the facts together, for this order, block it
+	change(false, Fact{"o1", "kind", "order"}, Fact{"o2", "kind", "order"})
+	chased("1", "o1", "o2")
+	change(false, Fact{"s1", "shipment-of", "o1"}, Fact{"r1", "receipt-for", "s1"})
+	chased("2", "o1", "o2")
+	change(false, Fact{"r2", "signed", true})
+	chased("3", "o1", "o2")
+	change(false, Fact{"r1", "signed", true})
+	chased("4", "o2")
+	change(true, Fact{"r1", "receipt-for", "s1"})
+	chased("5", "o1", "o2")
+	change(false, Fact{"r2", "receipt-for", "s1"})
+	chased("6", "o2")
+	change(true, Fact{"s1", "shipment-of", "o1"})
+	chased("7", "o1", "o2")
+	change(false, Fact{"s1", "shipment-of", "o2"})
+	chased("8", "o1")
+
+	diagnosis, err := testEngine.WhyNot("chase")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	text := diagnosis.String()
+	if !strings.Contains(text, "[1] not (?s shipment-of EQ ?o, ?r receipt-for EQ ?s, ?r signed EQ true): 1 fact\n") || !strings.Contains(text, "    [1] satisfied\n") {
+		t.Errorf("Test 9: unexpected diagnosis\n%s", text)
+	}
+	explanation, err := testEngine.Explain(Fact{"o1", "chase", true})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(explanation.Derivations) != 1 || !explanation.Derivations[0].Support[1].Negated {
+		t.Errorf("Test 9: unexpected explanation\n%s", explanation.String())
+	}
+
+	//an order that is retracted takes the matches of the group for it along
+	none := testEngine.productions[0].joins[1].quantifier
+	change(false, Fact{"s2", "shipment-of", "o1"})
+	change(true, Fact{"o1", "kind", "order"})
+	chased("10")
+	if len(none.owners) != 1 {
+		t.Errorf("Test 10: expected the matches of one order, got %d\n", len(none.owners))
+	}
+	for j, level := range none.levels {
+		for _, m := range level.matches {
+			if m.owner.removed {
+				t.Errorf("Test 10: a match of condition %d belongs to a retracted order\n", j)
+			}
+		}
+	}
+
+	//the alpha nodes of the conditions in the group go with the rule
+	err = testEngine.Undefine("chase")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(testEngine.alphaNetwork) != 0 {
+		t.Errorf("Test 11: expected no alpha nodes, got %d attributes\n", len(testEngine.alphaNetwork))
+	}
+}
+
+func TestNegatedGroupErrors(t *testing.T) {
+
+	var o Variable = "o"
+	var s Variable = "s"
+
+	order := Condition{ObjectId: o, Attribute: "kind", Comparator: EQ, Value: "order"}
+	shipment := Condition{ObjectId: s, Attribute: "shipment-of", Comparator: EQ, Value: o}
+	none := Condition{None: []Condition{shipment}}
+
+	for i, test := range []struct {
+		rule Rule
+		msg  string
+	}{
+		{Rule{Id: "twice", LHS: []Condition{order, Condition{NotExists: true, None: none.None}}}, "A negated group cannot be negated again"},
+		{Rule{Id: "labelled", LHS: []Condition{order, Condition{Label: "f", None: none.None}}}, "Label f cannot be used with a negated group"},
+		{Rule{Id: "mixed", LHS: []Condition{order, Condition{Attribute: "x", None: none.None}}}, "A negated group cannot also have an object, attribute, value, alternatives, forall or aggregate"},
+		{Rule{Id: "nested", LHS: []Condition{order, Condition{None: []Condition{Condition{None: none.None}}}}}, "Conditions within a negated group cannot have alternatives, forall, aggregates or negated groups of their own"},
+		{Rule{Id: "local", LHS: []Condition{order, none}, RHS: []Inference{Inference{ObjectId: s, Attribute: "late", Value: true}}}, "Variable s in local is not bound by a condition"},
+		{Rule{Id: "target", LHS: []Condition{order, none}, Retractions: []Retraction{Retraction{Target: 1}}}, "Target 1 is a negated group and matches no fact"},
+	} {
+		testEngine := Engine{}
+		err := testEngine.Define(test.rule)
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("Test %d: expected %q, got %v\n", i+1, test.msg, err)
+		}
+	}
+}
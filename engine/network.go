@@ -0,0 +1,548 @@
+package engine
+
+import "sort"
+
+//a joinNode tests the facts of one condition against the partial matches of the conditions
+//before it. Its memory holds the partial matches that pass, which the join nodes of the next
+//condition extend in turn. Rules whose leading conditions are identical share join nodes.
+type joinNode struct {
+
+	index int //condition number
+	negated bool //existential negation
+	tests []joinTest
+	quantifier *quantifier //for a forall, aggregate or negated group condition, which has no tests
+
+	//alpha must not be nil (for a forall condition, it is that of the first of its conditions):
+	alpha *alphaNode
+	parent *joinNode //nil for the first condition
+	children []*joinNode
+	products []*pNode //rules whose LHS ends here
+
+	memory []*betaToken
+	positions map[*betaToken]int //index of each partial match in memory
+	byFact map[*Fact][]*betaToken //the partial matches in memory holding each fact (if the node joins facts)
+	byLeft map[*betaToken]*betaToken //the partial match in memory extending each left input (if not)
+	blockers map[*betaToken]int //negated: the facts blocking each left input
+}
+
+//a joinTest compares a variable of the fact joining a node with a variable bound by an
+//earlier condition. The values must be equal if the variables are the same and must
+//differ if they are not. A relational test instead compares the value of the joining
+//fact with the value bound to the same variable, using its comparator.
+type joinTest struct {
+	variable Variable
+	objectElseValue bool //the slot of variable in the joining fact
+	other Variable
+	otherIndex int //condition number
+	otherObjectElseValue bool
+	relational bool
+	comparator Operator //of a relational test
+}
+
+//a betaToken is a partial match: a fact for each condition up to its join node
+type betaToken struct {
+
+	parent *betaToken //nil at the first condition
+	fact *Fact //the null fact for a negated, negated group or forall condition, and a fact holding the result for an aggregate
+	node *joinNode
+	children []*betaToken
+	tokens []*token //complete matches of the rules ending at node
+	removed bool
+	position int //index in the children of parent
+	factPosition int //index in node.byFact[fact]
+}
+
+//compileTests turns the test network of a rule into the tests of the join node for condition i,
+//against the conditions before it, ordered by slot and then by condition
+func compileTests(testNetwork map[Variable][]betaTest, lhs []Condition, i int) []joinTest {
+
+	if lhs[i].ForAll != nil || lhs[i].Aggregate != nil || lhs[i].None != nil {
+		return nil
+	}
+
+	var slots []betaTest
+	if _, ok := lhs[i].ObjectId.(Variable); ok {
+		slots = append(slots, betaTest{tokenIndex: i, objectElseValue: true})
+	}
+	if _, ok := lhs[i].Value.(Variable); ok && lhs[i].Comparator == EQ {
+		slots = append(slots, betaTest{tokenIndex: i, objectElseValue: false})
+	}
+
+	var tests []joinTest
+	for _, slot := range slots {
+		variable := variableAt(lhs, slot)
+		var list []joinTest
+		for key, slc := range testNetwork {
+			for _, tst := range slc {
+				if tst.tokenIndex >= i || lhs[tst.tokenIndex].NotExists {
+					continue
+				}
+				list = append(list, joinTest{
+					variable: variable,
+					objectElseValue: slot.objectElseValue,
+					other: key,
+					otherIndex: tst.tokenIndex,
+					otherObjectElseValue: tst.objectElseValue,
+				})
+			}
+		}
+		sort.Slice(list, func(a, b int) bool {
+			if list[a].otherIndex != list[b].otherIndex {
+				return list[a].otherIndex < list[b].otherIndex
+			}
+			return list[a].otherObjectElseValue && !list[b].otherObjectElseValue
+		})
+		tests = append(tests, list...)
+	}
+	if variable, ok := lhs[i].Value.(Variable); ok && lhs[i].Comparator != EQ {
+		bound, _ := firstBinding(testNetwork, lhs, variable, i)
+		tests = append(tests, joinTest{
+			variable: variable,
+			other: variable,
+			otherIndex: bound.tokenIndex,
+			otherObjectElseValue: bound.objectElseValue,
+			relational: true,
+			comparator: lhs[i].Comparator,
+		})
+	}
+	return tests
+}
+
+//firstBinding finds where a variable is first bound by a condition before condition i
+//(negated conditions bind nothing)
+func firstBinding(testNetwork map[Variable][]betaTest, lhs []Condition, variable Variable, i int) (betaTest, bool) {
+
+	for _, tst := range testNetwork[variable] {
+		if tst.tokenIndex < i && !lhs[tst.tokenIndex].NotExists {
+			return tst, true
+		}
+	}
+	return betaTest{}, false
+}
+
+func variableAt(lhs []Condition, slot betaTest) Variable {
+
+	if slot.objectElseValue {
+		return lhs[slot.tokenIndex].ObjectId.(Variable)
+	}
+	return lhs[slot.tokenIndex].Value.(Variable)
+}
+
+//passes runs the test on a joining fact f and the fact bound by the earlier condition
+func (tst joinTest) passes(f *Fact, other *Fact) (bool, error) {
+
+	if tst.relational {
+		var bound interface{} = other.Value
+		if tst.otherObjectElseValue {
+			bound = other.ObjectId
+		}
+		return match(f.Value, tst.comparator, bound)
+	}
+	same := tst.variable == tst.other
+	switch {
+	case tst.objectElseValue && tst.otherObjectElseValue:
+		return (f.ObjectId == other.ObjectId) == same, nil
+	case tst.objectElseValue:
+		val, ok := other.Value.(string)
+		return (ok && f.ObjectId == val) == same, nil
+	case tst.otherObjectElseValue:
+		val, ok := f.Value.(string)
+		return (ok && val == other.ObjectId) == same, nil
+	default:
+		equal, err := match(f.Value, EQ, other.Value)
+		if err != nil {
+			return false, err
+		}
+		return equal == same, nil
+	}
+}
+
+func sameTests(a []joinTest, b []joinTest) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//joinTest runs the tests of the join node on a fact for a partial match of the earlier
+//conditions; it returns the first test that fails, or nil if the fact can join
+func (node *joinNode) joinTest(left *betaToken, f *Fact) (*JoinFailure, error) {
+
+	for _, tst := range node.tests {
+		passed, err := tst.passes(f, left.factAt(tst.otherIndex))
+		if err != nil {
+			return nil, err
+		}
+		if !passed {
+			return &JoinFailure{Condition: node.index, Fact: *f, Variable: tst.variable, Other: tst.other, OtherCondition: tst.otherIndex, Relational: tst.relational, Comparator: tst.comparator}, nil
+		}
+	}
+	return nil, nil
+}
+
+//countBlockers counts the facts of a negated condition that pass the tests for a partial match
+func (node *joinNode) countBlockers(left *betaToken) (int, error) {
+
+	n := 0
+	for _, f := range node.alpha.facts {
+		failure, err := node.joinTest(left, f)
+		if err != nil {
+			return 0, err
+		}
+		if failure == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+//leftInputs returns the partial matches that the node extends
+//(a single nil partial match for the first condition)
+func (node *joinNode) leftInputs() []*betaToken {
+
+	if node.parent == nil {
+		return []*betaToken{nil}
+	}
+	return node.parent.memory
+}
+
+//childOf returns the partial match extending left at a negated node or the node of a
+//quantifier (which extend each partial match at most once), or nil
+func (node *joinNode) childOf(left *betaToken) *betaToken {
+
+	return node.byLeft[left]
+}
+
+//alphas returns the alpha nodes that the node joins
+func (node *joinNode) alphas() []*alphaNode {
+
+	if node.quantifier != nil {
+		return node.quantifier.alphas
+	}
+	return []*alphaNode{node.alpha}
+}
+
+//leftActivate extends a new partial match of the earlier conditions with every fact of the
+//node's condition that passes the tests (or, for a negated condition, if none does)
+func (node *joinNode) leftActivate(left *betaToken) error {
+
+	if node.quantifier != nil {
+		return node.quantify(left)
+	}
+	if node.negated {
+		n, err := node.countBlockers(left)
+		if err != nil {
+			return err
+		}
+		if node.blockers == nil {
+			node.blockers = make(map[*betaToken]int)
+		}
+		node.blockers[left] = n
+		if n > 0 {
+			return nil
+		}
+		return node.extend(left, node.alpha.parentEngine.nullFact)
+	}
+	for _, f := range node.alpha.facts {
+		failure, err := node.joinTest(left, f)
+		if err != nil {
+			return err
+		}
+		if failure != nil {
+			continue
+		}
+		err = node.extend(left, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//rightActivate joins a fact that has just been added to the node's alpha memory
+//with every partial match of the earlier conditions
+func (node *joinNode) rightActivate(f *Fact) error {
+
+	if node.quantifier != nil {
+		return node.requantify(f)
+	}
+	if node.negated {
+		//the fact blocks the partial matches it passes the tests for
+		for _, left := range node.leftInputs() {
+			failure, err := node.joinTest(left, f)
+			if err != nil {
+				return err
+			}
+			if failure != nil {
+				continue
+			}
+			node.blockers[left]++
+			if child := node.childOf(left); child != nil {
+				err = child.remove()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, left := range node.leftInputs() {
+		failure, err := node.joinTest(left, f)
+		if err != nil {
+			return err
+		}
+		if failure != nil {
+			continue
+		}
+		err = node.extend(left, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//rightRemove handles a fact that has just been removed from the node's alpha memory
+func (node *joinNode) rightRemove(f *Fact) error {
+
+	if node.quantifier != nil {
+		return node.requantify(f)
+	}
+	if node.negated {
+		//partial matches that the fact alone was blocking now pass
+		for _, left := range node.leftInputs() {
+			failure, err := node.joinTest(left, f)
+			if err != nil {
+				return err
+			}
+			if failure != nil {
+				continue
+			}
+			node.blockers[left]--
+			if node.blockers[left] == 0 && node.childOf(left) == nil {
+				err = node.extend(left, node.alpha.parentEngine.nullFact)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	//only the partial matches holding the fact; remove works from a copy
+	for _, t := range append([]*betaToken(nil), node.byFact[f]...) {
+		if !t.removed {
+			err := t.remove()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//extend adds a partial match to the node's memory and passes it on
+//to the rules that end here and to the join nodes of the next condition
+func (node *joinNode) extend(left *betaToken, f *Fact) error {
+
+	t := &betaToken{parent: left, fact: f, node: node}
+	if left != nil {
+		t.position = len(left.children)
+		left.children = append(left.children, t)
+	}
+	node.remember(t)
+
+	for _, p := range node.products {
+		err := p.addToken(t)
+		if err != nil {
+			return err
+		}
+	}
+	for _, child := range node.children {
+		err := child.leftActivate(t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (node *joinNode) remember(t *betaToken) {
+
+	if node.positions == nil {
+		node.positions = make(map[*betaToken]int)
+	}
+	node.positions[t] = len(node.memory)
+	node.memory = append(node.memory, t)
+	if node.joinsFacts() {
+		if node.byFact == nil {
+			node.byFact = make(map[*Fact][]*betaToken)
+		}
+		t.factPosition = len(node.byFact[t.fact])
+		node.byFact[t.fact] = append(node.byFact[t.fact], t)
+	} else {
+		if node.byLeft == nil {
+			node.byLeft = make(map[*betaToken]*betaToken)
+		}
+		node.byLeft[t.parent] = t
+	}
+}
+
+//joinsFacts reports whether the partial matches of the node hold the facts of its alpha
+//memory (rather than the null fact, or the result of an aggregate)
+func (node *joinNode) joinsFacts() bool {
+
+	return !node.negated && node.quantifier == nil
+}
+
+func (node *joinNode) forget(t *betaToken) {
+
+	i, ok := node.positions[t]
+	if !ok {
+		return
+	}
+	delete(node.positions, t)
+	last := len(node.memory) - 1
+	node.memory[i] = node.memory[last]
+	node.memory[last] = nil
+	node.memory = node.memory[:last]
+	if i < last {
+		node.positions[node.memory[i]] = i
+	}
+	if node.joinsFacts() {
+		list := node.byFact[t.fact]
+		last = len(list) - 1
+		list[t.factPosition] = list[last]
+		list[t.factPosition].factPosition = t.factPosition
+		list[last] = nil
+		if last == 0 {
+			delete(node.byFact, t.fact)
+		} else {
+			node.byFact[t.fact] = list[:last]
+		}
+	} else if node.byLeft[t.parent] == t {
+		delete(node.byLeft, t.parent)
+	}
+}
+
+//leftRemove lets go of a partial match that the node extended (or tested), which has been
+//taken out of the network
+func (node *joinNode) leftRemove(left *betaToken) {
+
+	switch {
+	case node.quantifier != nil:
+		node.quantifier.leave(left)
+	case node.negated:
+		delete(node.blockers, left)
+	}
+}
+
+//detach takes an unused join node out of the network
+func (node *joinNode) detach() {
+
+	for _, a := range node.alphas() {
+		list := a.successors
+		for i, j := range list {
+			if j == node {
+				a.successors = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+	}
+	if node.parent != nil {
+		list := node.parent.children
+		for i, j := range list {
+			if j == node {
+				node.parent.children = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, t := range node.memory {
+		t.removed = true
+		if t.parent != nil {
+			t.parent.unlink(t)
+		}
+	}
+	node.memory = nil
+	node.positions = nil
+	node.byFact = nil
+	node.byLeft = nil
+	node.blockers = nil
+	if node.quantifier != nil {
+		node.quantifier.unload()
+	}
+}
+
+//factAt returns the fact of the partial match for condition i
+func (t *betaToken) factAt(i int) *Fact {
+
+	for ; t != nil; t = t.parent {
+		if t.node.index == i {
+			return t.fact
+		}
+	}
+	return nil
+}
+
+//facts returns the facts of the partial match per condition, for a rule of n conditions
+func (t *betaToken) facts(n int) []*Fact {
+
+	list := make([]*Fact, n)
+	for ; t != nil; t = t.parent {
+		list[t.node.index] = t.fact
+	}
+	return list
+}
+
+func (t *betaToken) unlink(child *betaToken) {
+
+	last := len(t.children) - 1
+	if child.position > last || t.children[child.position] != child {
+		return
+	}
+	t.children[child.position] = t.children[last]
+	t.children[child.position].position = child.position
+	t.children[last] = nil
+	t.children = t.children[:last]
+}
+
+//remove takes a partial match out of the network, along with the partial matches
+//extended from it and the tokens of the rules that it completed
+func (t *betaToken) remove() error {
+
+	if t.removed {
+		return nil
+	}
+	t.removed = true
+	t.node.forget(t)
+	if t.parent != nil {
+		t.parent.unlink(t)
+	}
+
+	children := t.children
+	t.children = nil
+	for _, c := range children {
+		err := c.remove()
+		if err != nil {
+			return err
+		}
+	}
+	for _, next := range t.node.children {
+		next.leftRemove(t)
+	}
+	tokens := t.tokens
+	t.tokens = nil
+	for _, tok := range tokens {
+		err := tok.remove()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
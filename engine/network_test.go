@@ -0,0 +1,419 @@
+package engine
+
+import "strings"
+import "testing"
+
+func TestJoinNetwork(t *testing.T) {
+
+	var o Variable = "o"
+	var x Variable = "x"
+
+	testEngine := Engine{}
+	rules := []Rule{
+		Rule{
+			Id: "pair",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "a", Comparator: EQ, Value: 1},
+				Condition{ObjectId: o, Attribute: "b", Comparator: EQ, Value: 2},
+			},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "pair", Value: "yes"}},
+		},
+		Rule{
+			Id: "unhalted",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "a", Comparator: EQ, Value: 1},
+				Condition{ObjectId: o, Attribute: "b", Comparator: EQ, Value: 2},
+				Condition{NotExists: true, ObjectId: "", Attribute: "halt", Comparator: EQ, Value: "yes"},
+			},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "unhalted", Value: "yes"}},
+		},
+		//with another variable, only the first condition (which has no tests) is identical
+		Rule{
+			Id: "renamed",
+			LHS: []Condition{
+				Condition{ObjectId: x, Attribute: "a", Comparator: EQ, Value: 1},
+				Condition{ObjectId: x, Attribute: "b", Comparator: EQ, Value: 2},
+			},
+			RHS: []Inference{Inference{ObjectId: x, Attribute: "renamed", Value: "yes"}},
+		},
+		//two conditions on the same alpha node
+		Rule{
+			Id: "sizes",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "size", Comparator: GT, Value: 1},
+				Condition{ObjectId: o, Attribute: "size", Comparator: GT, Value: 1},
+			},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "sized", Value: "yes"}},
+		},
+	}
+	for _, r := range rules {
+		err := testEngine.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+
+	pair := testEngine.productions[0]
+	unhalted := testEngine.productions[1]
+	renamed := testEngine.productions[2]
+	if pair.joins[0] != unhalted.joins[0] || pair.joins[1] != unhalted.joins[1] {
+		t.Errorf("Test 1 sharing: expected the leading join nodes to be shared\n")
+	}
+	if renamed.joins[0] != pair.joins[0] || renamed.joins[1] == pair.joins[1] {
+		t.Errorf("Test 1 sharing: expected renamed variables to share the first join node only\n")
+	}
+	if len(pair.joins[1].children) != 1 || len(pair.joins[1].products) != 1 {
+		t.Errorf("Test 1 sharing: unexpected successors of the shared join node\n")
+	}
+	if len(pair.joins[0].tests) != 0 || len(pair.joins[1].tests) != 1 {
+		t.Errorf("Test 1 tests: expected 0 and 1, got %d and %d\n", len(pair.joins[0].tests), len(pair.joins[1].tests))
+	}
+
+	for _, f := range []Fact{
+		Fact{"o1", "a", 1},
+		Fact{"o1", "b", 2},
+		Fact{"o2", "a", 1},
+		Fact{"o3", "size", 5},
+		Fact{"o3", "size", 6},
+	} {
+		err := testEngine.Assert(f)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	count := func(test string, attribute string, expected int) {
+		result, err := testEngine.GetInferences("", attribute)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		if len(result) != expected {
+			t.Errorf("Test %s: expected %d, got %d %v\n", test, expected, len(result), result)
+		}
+	}
+	count("2 pair", "pair", 1)
+	count("2 unhalted", "unhalted", 1)
+	if len(pair.joins[0].memory) != 2 || len(pair.joins[1].memory) != 1 {
+		t.Errorf("Test 2 memories: expected 2 and 1, got %d and %d\n", len(pair.joins[0].memory), len(pair.joins[1].memory))
+	}
+	sizes := testEngine.productions[3]
+	if len(sizes.tokens) != 4 {
+		t.Errorf("Test 2 same alpha node: expected 4 tokens, got %d\n", len(sizes.tokens))
+	}
+
+	err := testEngine.Assert(Fact{"control", "halt", "yes"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	count("3 unhalted", "unhalted", 0)
+	count("3 pair", "pair", 1)
+	err = testEngine.Retract(Fact{"control", "halt", "yes"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	count("4 unhalted", "unhalted", 1)
+
+	err = testEngine.Retract(Fact{"o1", "a", 1})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	count("5 pair", "pair", 0)
+	count("5 unhalted", "unhalted", 0)
+	if len(pair.joins[0].memory) != 1 || len(pair.joins[1].memory) != 0 || len(unhalted.joins[2].memory) != 0 {
+		t.Errorf("Test 5 memories: expected the partial matches with the fact to be removed\n")
+	}
+
+	//the shared join nodes stay until the last rule using them is removed
+	err = testEngine.Undefine("pair")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	shared := unhalted.joins[1]
+	if len(shared.alpha.successors) != 2 || len(shared.products) != 0 || len(shared.children) != 1 {
+		t.Errorf("Test 6 undefine: expected the shared join node to remain\n")
+	}
+	err = testEngine.Undefine("unhalted")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(shared.alpha.successors) != 1 || shared.alpha.successors[0] != renamed.joins[1] {
+		t.Errorf("Test 7 undefine: expected only the renamed rule's join node to remain\n")
+	}
+	if _, ok := testEngine.alphaNetwork["halt"]; ok {
+		t.Errorf("Test 7 undefine: expected the halt alpha node to be removed\n")
+	}
+}
+
+func TestRelationalTests(t *testing.T) {
+
+	var p Variable = "p"
+	var limit Variable = "limit"
+	var a Variable = "a"
+	var b Variable = "b"
+
+	testEngine := Engine{}
+	rules := []Rule{
+		Rule{
+			Id: "fever",
+			LHS: []Condition{
+				Condition{ObjectId: "threshold", Attribute: "fever", Comparator: EQ, Value: limit},
+				Condition{ObjectId: p, Attribute: "temperature", Comparator: GT, Value: limit},
+			},
+			RHS: []Inference{Inference{ObjectId: p, Attribute: "feverish", Value: limit}},
+		},
+		//a variable bound as an object id is compared as a string
+		Rule{
+			Id: "before",
+			LHS: []Condition{
+				Condition{ObjectId: a, Attribute: "kind", Comparator: EQ, Value: "name"},
+				Condition{ObjectId: b, Attribute: "name", Comparator: LT, Value: a},
+			},
+			RHS: []Inference{Inference{ObjectId: b, Attribute: "before", Value: a}},
+		},
+	}
+	for _, r := range rules {
+		err := testEngine.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+	//?p must differ from ?limit, and the temperature must exceed it
+	tests := testEngine.productions[0].joins[1].tests
+	if len(tests) != 2 || tests[0].relational || !tests[1].relational || tests[1].comparator != GT {
+		t.Errorf("Test 1 tests: expected a distinct variable test and a relational test, got %v\n", tests)
+	}
+
+	for _, f := range []Fact{
+		Fact{"threshold", "fever", 38},
+		Fact{"ann", "temperature", 39.5},
+		Fact{"bob", "temperature", 37.0},
+		Fact{"cat", "temperature", 38},
+		Fact{"m", "kind", "name"},
+		Fact{"x", "name", "k"},
+		Fact{"y", "name", "q"},
+	} {
+		err := testEngine.Assert(f)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	check := func(test string, attribute string, expected []string) {
+		result, err := testEngine.GetInferences("", attribute)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		var objects []string
+		for _, f := range result {
+			objects = append(objects, f.ObjectId)
+		}
+		if len(objects) != len(expected) || (len(objects) > 0 && objects[0] != expected[0]) {
+			t.Errorf("Test %s: expected %v, got %v\n", test, expected, result)
+		}
+	}
+	check("2 fever", "feverish", []string{"ann"})
+	check("2 before", "before", []string{"x"})
+
+	err := testEngine.Retract(Fact{"ann", "temperature", 39.5})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d, err := testEngine.WhyNot("fever")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	failed := 0
+	for _, m := range d.Matches {
+		for _, j := range m.Failures {
+			if j.Relational && j.Comparator == GT && j.Variable == limit && j.OtherCondition == 0 {
+				failed++
+			}
+		}
+	}
+	if failed != 2 {
+		t.Errorf("Test 3 WhyNot: expected 2 relational failures\n%s", d.String())
+	}
+
+	//a lower threshold lets more patients join
+	err = testEngine.Retract(Fact{"threshold", "fever", 38})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	check("4 retracted", "feverish", nil)
+	err = testEngine.Assert(Fact{"threshold", "fever", 37.5})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	check("4 lower threshold", "feverish", []string{"cat"})
+
+	//values that cannot be ordered are an error
+	err = testEngine.Assert(Fact{"dan", "temperature", "high"})
+	if err == nil {
+		t.Errorf("Test 5 mismatched: expected an error\n")
+	}
+
+	for i, r := range []Rule{
+		//bound later
+		Rule{Id: "later", LHS: []Condition{
+			Condition{ObjectId: p, Attribute: "temperature", Comparator: GT, Value: limit},
+			Condition{ObjectId: "threshold", Attribute: "fever", Comparator: EQ, Value: limit},
+		}},
+		//bound only in a negated condition
+		Rule{Id: "negated", LHS: []Condition{
+			Condition{NotExists: true, ObjectId: "threshold", Attribute: "fever", Comparator: EQ, Value: limit},
+			Condition{ObjectId: p, Attribute: "temperature", Comparator: GT, Value: limit},
+		}},
+		//never bound
+		Rule{Id: "unbound", LHS: []Condition{
+			Condition{ObjectId: p, Attribute: "temperature", Comparator: GE, Value: limit},
+		}},
+	} {
+		err = (&Engine{}).Define(r)
+		if err == nil {
+			t.Errorf("Test 6.%d %s: expected an error\n", i+1, r.Id)
+		}
+	}
+}
+
+func TestNegatedJoin(t *testing.T) {
+
+	var o Variable = "o"
+	var a Variable = "a"
+	var p Variable = "p"
+	var limit Variable = "limit"
+
+	testEngine := Engine{}
+	rules := []Rule{
+		//no approval of this order, by anyone
+		Rule{
+			Id: "unapproved",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "kind", Comparator: EQ, Value: "order"},
+				Condition{NotExists: true, ObjectId: o, Attribute: "approved-by", Comparator: EQ, Value: a},
+			},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "hold", Value: true}},
+		},
+		//no temperature of this patient above the threshold
+		Rule{
+			Id: "normal",
+			LHS: []Condition{
+				Condition{ObjectId: "threshold", Attribute: "fever", Comparator: EQ, Value: limit},
+				Condition{ObjectId: p, Attribute: "kind", Comparator: EQ, Value: "patient"},
+				Condition{NotExists: true, ObjectId: p, Attribute: "temperature", Comparator: GT, Value: limit},
+			},
+			RHS: []Inference{Inference{ObjectId: p, Attribute: "normal", Value: true}},
+		},
+	}
+
+	//an approval that is already there blocks its own order only
+	err := testEngine.Assert(Fact{"o1", "approved-by", "bob"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, r := range rules {
+		err = testEngine.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+	check := func(test string, attribute string, expected ...string) {
+		result, err := testEngine.GetInferences("", attribute)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		var got []string
+		for _, f := range result {
+			got = append(got, f.ObjectId)
+		}
+		if strings.Join(got, " ") != strings.Join(expected, " ") {
+			t.Errorf("Test %s: expected %v, got %v\n", test, expected, got)
+		}
+	}
+	change := func(retract bool, facts ...Fact) {
+		for _, f := range facts {
+			var err error
+			if retract {
+				err = testEngine.Retract(f)
+			} else {
+				err = testEngine.Assert(f)
+			}
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+	}
+
+	change(false, Fact{"o1", "kind", "order"}, Fact{"o2", "kind", "order"})
+	check("1", "hold", "o2")
+	change(false, Fact{"o2", "approved-by", "cat"}, Fact{"o2", "approved-by", "dan"})
+	check("2", "hold")
+	change(true, Fact{"o2", "approved-by", "cat"})
+	check("3", "hold")
+	change(true, Fact{"o2", "approved-by", "dan"})
+	check("4", "hold", "o2")
+
+	diagnosis, err := testEngine.WhyNot("unapproved")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(diagnosis.Matches) != 1 || !diagnosis.Matches[0].Complete {
+		t.Errorf("Test 5: expected the complete match of o2, got %+v\n", diagnosis.Matches)
+	}
+	change(false, Fact{"o2", "approved-by", "eve"})
+	diagnosis, err = testEngine.WhyNot("unapproved")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(diagnosis.Matches) != 2 || len(diagnosis.Matches[1].Blockers) != 1 || diagnosis.Matches[1].Blockers[0] != (Fact{"o2", "approved-by", "eve"}) {
+		t.Errorf("Test 5: expected each order blocked by its approval, got %+v\n", diagnosis.Matches)
+	}
+	if !strings.Contains(diagnosis.String(), "    blocked by (O o1 A approved-by V bob)\n") {
+		t.Errorf("Test 5: unexpected diagnosis\n%s", diagnosis.String())
+	}
+
+	//a relational test against a variable bound earlier
+	change(false, Fact{"threshold", "fever", 38}, Fact{"ann", "kind", "patient"}, Fact{"bob", "kind", "patient"})
+	change(false, Fact{"ann", "temperature", 37}, Fact{"bob", "temperature", 39})
+	check("6", "normal", "ann")
+	change(true, Fact{"threshold", "fever", 38})
+	change(false, Fact{"threshold", "fever", 36.5})
+	check("7", "normal")
+	change(true, Fact{"ann", "temperature", 37}, Fact{"bob", "temperature", 39})
+	check("8", "normal", "ann", "bob")
+
+	//the facts blocking each order are counted, and the count goes with the order
+	unapproved := testEngine.productions[0].joins[1]
+	change(true, Fact{"o2", "kind", "order"})
+	if len(unapproved.blockers) != 1 || unapproved.blockers[unapproved.parent.memory[0]] != 1 {
+		t.Errorf("Test 8 blockers: expected o1 blocked once, got %v\n", unapproved.blockers)
+	}
+	change(true, Fact{"o1", "approved-by", "bob"})
+	check("8 blockers", "hold", "o1")
+
+	//a variable of a negated condition binds nothing
+	err = (&Engine{}).Define(Rule{Id: "approver", LHS: rules[0].LHS, RHS: []Inference{Inference{ObjectId: a, Attribute: "idle", Value: true}}})
+	if err == nil || err.Error() != "Variable a in approver is not bound by a condition" {
+		t.Errorf("Test 9: expected an unbound variable, got %v\n", err)
+	}
+
+	//the variables of the RHS are bound by the conditions after a negated condition that comes first
+	testEngine = Engine{}
+	err = testEngine.Define(Rule{
+		Id: "flag",
+		LHS: []Condition{
+			Condition{NotExists: true, ObjectId: o, Attribute: "approved", Comparator: EQ, Value: "yes"},
+			Condition{ObjectId: o, Attribute: "order", Comparator: EQ, Value: "x"},
+		},
+		RHS: []Inference{Inference{ObjectId: o, Attribute: "flagged", Value: o}},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	change(false, Fact{"o3", "order", "x"})
+	result, err := testEngine.GetInferences("", "flagged")
+	if err != nil || len(result) != 1 || result[0] != (Fact{"o3", "flagged", "o3"}) {
+		t.Errorf("Test 10: expected o3 flagged, got %v %v\n", result, err)
+	}
+	change(false, Fact{"o4", "approved", "yes"})
+	check("10", "flagged")
+}
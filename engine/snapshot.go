@@ -0,0 +1,271 @@
+package engine
+
+import "encoding/gob"
+import "fmt"
+import "io"
+import "time"
+
+//the version of the snapshot format, written first; Restore reads no other
+const snapshotVersion = 1
+
+func init() {
+	gob.Register(Variable(""))
+	gob.Register(Null)
+	gob.Register(Expression{})
+	gob.Register(time.Time{})
+	gob.Register(time.Duration(0))
+}
+
+type snapshotHeader struct {
+	Version int
+}
+
+type snapshot struct {
+	Strategy Strategy
+	Rules    []Rule          //in the order defined
+	Facts    []snapshotFact  //working memory, in time tag order
+	Matches  []snapshotMatch //tokens that have fired
+	Kept     []snapshotKept
+}
+
+type snapshotFact struct {
+	Fact     Fact
+	Inferred bool
+}
+
+type snapshotMatch struct {
+	RuleId     string
+	Branch     int
+	Facts      []Fact //per condition (zero for a negated condition)
+	Inferences []Fact
+	Unmade     []int //inferences that the match does not hold (zero in Inferences), as when firing failed part way
+}
+
+type snapshotKept struct {
+	RuleId  string
+	Branch  int
+	Fact    Fact
+	Support []Fact
+}
+
+//Snapshot writes the state of the engine: its rules, the facts in working memory and the
+//rule firings that made its inferences. Registered actions are not written, and nor is the
+//state of the random source used by the Random strategy. Values must be of types that
+//encoding/gob can write in an interface (the Go basic types, time.Time, time.Duration,
+//Null and Variable).
+func (engine *Engine) Snapshot(w io.Writer) error {
+
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	s := snapshot{Strategy: engine.strategy}
+	for _, p := range engine.productions {
+		if p.branch == 0 { //once for a rule with alternatives
+			s.Rules = append(s.Rules, p.rule)
+		}
+		for _, tok := range p.tokens {
+			if tok.activation == nil || !tok.activation.fired {
+				continue
+			}
+			m := snapshotMatch{RuleId: p.ruleId, Branch: p.branch}
+			for _, f := range tok.incoming {
+				m.Facts = append(m.Facts, *f)
+			}
+			for i, f := range tok.outgoing {
+				if f == nil {
+					m.Inferences = append(m.Inferences, Fact{})
+					m.Unmade = append(m.Unmade, i)
+					continue
+				}
+				m.Inferences = append(m.Inferences, *f)
+			}
+			s.Matches = append(s.Matches, m)
+		}
+		for _, k := range p.kept {
+			s.Kept = append(s.Kept, snapshotKept{RuleId: p.ruleId, Branch: p.branch, Fact: *k.fact, Support: k.support})
+		}
+	}
+	for _, f := range engine.memory() {
+		s.Facts = append(s.Facts, snapshotFact{Fact: *f, Inferred: engine.inferred[factKeyOf(f)] == f})
+	}
+
+	encoder := gob.NewEncoder(w)
+	err := encoder.Encode(snapshotHeader{Version: snapshotVersion})
+	if err != nil {
+		return fmt.Errorf("Snapshot: %s", err)
+	}
+	err = encoder.Encode(s)
+	if err != nil {
+		return fmt.Errorf("Snapshot: %s", err)
+	}
+	return nil
+}
+
+//Restore reads a snapshot into an engine that has no rules or facts. The actions used by
+//the rules must be registered first. The rules are defined and working memory is filled
+//without firing them again, so the inferences are as they were and no action is called;
+//the undo functions of the actions are called as usual if their matches are later broken.
+//If an error occurs, the engine is left as it was.
+func (engine *Engine) Restore(r io.Reader) error {
+
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
+	if len(engine.productions) > 0 || len(engine.timetags) > 0 {
+		return fmt.Errorf("Restore: engine is not empty")
+	}
+
+	decoder := gob.NewDecoder(r)
+	var header snapshotHeader
+	err := decoder.Decode(&header)
+	if err != nil {
+		return fmt.Errorf("Restore: %s", err)
+	}
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("Restore: snapshot version %d is not supported", header.Version)
+	}
+	var s snapshot
+	err = decoder.Decode(&s)
+	if err != nil {
+		return fmt.Errorf("Restore: %s", err)
+	}
+	if s.Strategy.String() == "" {
+		return fmt.Errorf("Restore: unknown strategy %d", int(s.Strategy))
+	}
+
+	//the snapshot is read into a scratch engine, which replaces the state of this one only
+	//when it is complete
+	scratch := &Engine{strategy: s.Strategy, random: engine.random, actions: engine.actions}
+	err = scratch.restore(s)
+	if err != nil {
+		return fmt.Errorf("Restore: %s", err)
+	}
+	engine.replace(scratch)
+	return nil
+}
+
+func (engine *Engine) restore(s snapshot) error {
+
+	for _, rule := range s.Rules {
+		err := engine.define(rule)
+		if err != nil {
+			return err
+		}
+	}
+
+	//fill working memory; the complete matches go on the agenda
+	if engine.inferred == nil {
+		engine.inferred = make(map[factKey]*Fact)
+		engine.support = make(map[*Fact]int)
+	}
+	for _, sf := range s.Facts {
+		f := sf.Fact
+		if sf.Inferred {
+			engine.inferred[factKeyOf(&f)] = &f
+		}
+		err := engine.propagate(&f)
+		if err != nil {
+			return err
+		}
+	}
+
+	//inferences that were not held in working memory (because an equal fact was asserted)
+	//are shared in the same way
+	inference := func(fct Fact) *Fact {
+		k := factKeyOf(&fct)
+		f, ok := engine.inferred[k]
+		if !ok {
+			f = &fct
+			engine.inferred[k] = f
+		}
+		engine.support[f]++
+		return f
+	}
+
+	//then take the matches that had fired off the agenda
+	productions := make(map[string]*pNode)
+	tokens := make(map[string]*token)
+	for _, p := range engine.productions {
+		productions[matchKey(p.ruleId, p.branch, nil)] = p
+		for _, tok := range p.tokens {
+			tokens[matchKey(p.ruleId, p.branch, tok.incoming)] = tok
+		}
+	}
+	for _, m := range s.Matches {
+		incoming := make([]*Fact, len(m.Facts))
+		for i := range m.Facts {
+			incoming[i] = &m.Facts[i]
+		}
+		tok, ok := tokens[matchKey(m.RuleId, m.Branch, incoming)]
+		if !ok || len(m.Inferences) != len(tok.outgoing) {
+			return fmt.Errorf("a match of %s is not in working memory", m.RuleId)
+		}
+		unmade := make(map[int]bool, len(m.Unmade))
+		for _, i := range m.Unmade {
+			unmade[i] = true
+		}
+		for i, fct := range m.Inferences {
+			if !unmade[i] {
+				tok.outgoing[i] = inference(fct)
+			}
+		}
+		engine.markFired(tok)
+		if len(tok.containedBy.actions) > 0 {
+			tok.bindings = tok.containedBy.bindings(tok)
+		}
+	}
+	for _, k := range s.Kept {
+		p, ok := productions[matchKey(k.RuleId, k.Branch, nil)]
+		if !ok {
+			return fmt.Errorf("rule %s is not defined", k.RuleId)
+		}
+		engine.keep(&keptInference{node: p, fact: inference(k.Fact), support: k.Support})
+	}
+
+	//anything left on the agenda was waiting to fire when the snapshot was taken
+	return engine.turn()
+}
+
+//replace gives the engine the state of a scratch engine, which is not used again. Nothing
+//may be waiting to be propagated, as the queue is not moved.
+func (engine *Engine) replace(scratch *Engine) {
+
+	engine.pending.Init()
+	engine.queued = nil
+	engine.agenda = scratch.agenda
+	engine.strategy = scratch.strategy
+	engine.random = scratch.random
+	engine.clock = scratch.clock
+	engine.timetags = scratch.timetags
+	engine.workingMemory = scratch.workingMemory
+	engine.alphaNetwork = scratch.alphaNetwork
+	engine.alphaIndex = scratch.alphaIndex
+	engine.alphaCount = scratch.alphaCount
+	engine.inferred = scratch.inferred
+	engine.support = scratch.support
+	engine.kept = scratch.kept
+	engine.nullFact = scratch.nullFact
+	engine.productions = scratch.productions
+	engine.actions = scratch.actions
+	engine.journal = nil
+
+	//the nodes refer back to their engine
+	for _, p := range engine.productions {
+		p.parentEngine = engine
+	}
+	for _, list := range engine.alphaNetwork {
+		for _, aNode := range list {
+			aNode.parentEngine = engine
+		}
+	}
+}
+
+//matchKey identifies a combination of facts matched by a branch of a rule
+func matchKey(ruleId string, branch int, incoming []*Fact) string {
+
+	key := fmt.Sprintf("%s#%d", ruleId, branch)
+	for _, f := range incoming {
+		key += fmt.Sprintf("|%#v", factKeyOf(f))
+	}
+	return key
+}
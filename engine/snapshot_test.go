@@ -0,0 +1,248 @@
+package engine
+
+import "bytes"
+import "encoding/gob"
+import "fmt"
+import "sort"
+import "testing"
+import "time"
+
+func TestSnapshot(t *testing.T) {
+
+	var o Variable = "o"
+	var v Variable = "v"
+	var f Variable = "f"
+	fired := 0
+	undone := 0
+
+	rules := []Rule{
+		Rule{
+			Id:      "double",
+			LHS:     []Condition{Condition{ObjectId: o, Attribute: "size", Comparator: GT, Value: 1}, Condition{ObjectId: o, Attribute: "weight", Comparator: EQ, Value: v}},
+			RHS:     []Inference{Inference{ObjectId: o, Attribute: "weighed", Value: v}},
+			Actions: []Action{Action{Name: "note"}},
+		},
+		Rule{
+			Id:            "ship",
+			LHS:           []Condition{Condition{Label: f, ObjectId: o, Attribute: "status", Comparator: EQ, Value: "new"}},
+			RHS:           []Inference{Inference{ObjectId: o, Attribute: "handled", Value: Call("mul", 2.5, 1)}},
+			Modifications: []Modification{Modification{Target: f, Value: "shipped"}},
+		},
+		Rule{
+			Id:       "idle",
+			Salience: 5,
+			LHS:      []Condition{Condition{NotExists: true, ObjectId: "", Attribute: "status", Comparator: EQ, Value: "new"}},
+			RHS:      []Inference{Inference{ObjectId: "shop", Attribute: "idle", Value: "yes"}},
+		},
+	}
+	newEngine := func() *Engine {
+		e := &Engine{}
+		err := e.RegisterAction("note", func(ruleId string, bindings Bindings) error {
+			fired++
+			return nil
+		}, func(ruleId string, bindings Bindings) error {
+			if bindings[v] != 40 {
+				return fmt.Errorf("unexpected bindings %s", bindings.String())
+			}
+			undone++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		return e
+	}
+	inferences := func(e *Engine) string {
+		result, err := e.GetInferences("", "")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		list := make([]string, len(result))
+		for i, fct := range result {
+			list[i] = fmt.Sprintf("%s %s %#v", fct.ObjectId, fct.Attribute, fct.Value)
+		}
+		sort.Strings(list)
+		return fmt.Sprint(list)
+	}
+
+	original := newEngine()
+	err := original.SetStrategy(Breadth)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, r := range rules {
+		err = original.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+	for _, fct := range []Fact{
+		Fact{"box", "size", 3},
+		Fact{"box", "weight", 40},
+		Fact{"order1", "status", "new"},
+		Fact{"order1", "paid", true},
+		Fact{"order1", "due", time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)},
+		Fact{"order1", "delay", time.Minute},
+		Fact{"order1", "note", Null},
+	} {
+		err = original.Assert(fct)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	var buf bytes.Buffer
+	err = original.Snapshot(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	data := buf.Bytes()
+
+	restored := newEngine()
+	err = restored.Restore(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if fired != 1 {
+		t.Errorf("Test 1 no firing: expected the action to have fired once, got %d\n", fired)
+	}
+	if inferences(restored) != inferences(original) {
+		t.Errorf("Test 1 inferences: expected\n%s\ngot\n%s\n", inferences(original), inferences(restored))
+	}
+	facts, err := restored.GetFacts("order1", "status")
+	if err != nil || len(facts) != 1 || facts[0].Value != "shipped" {
+		t.Errorf("Test 1 facts: expected the modified status, got %v\n", facts)
+	}
+	for _, fct := range []Fact{
+		Fact{"order1", "paid", true},
+		Fact{"order1", "due", time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)},
+		Fact{"order1", "delay", time.Minute},
+		Fact{"order1", "note", Null},
+	} {
+		facts, err = restored.GetFacts(fct.ObjectId, fct.Attribute)
+		if err != nil || len(facts) != 1 || facts[0].String() != fct.String() {
+			t.Errorf("Test 1 typed values: expected %s, got %v\n", fct, facts)
+		}
+	}
+	if restored.strategy != Breadth || len(restored.productions) != len(rules) {
+		t.Errorf("Test 1 rules: expected the strategy and rules to be restored\n")
+	}
+
+	//the restored engine carries on as the original would
+	err = restored.Retract(Fact{"box", "weight", 40})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if undone != 1 {
+		t.Errorf("Test 2 undo: expected 1, got %d\n", undone)
+	}
+	result, err := restored.GetInferences("box", "")
+	if err != nil || len(result) != 0 {
+		t.Errorf("Test 2 withdrawn: expected no inferences about box, got %v\n", result)
+	}
+	err = restored.Assert(Fact{"order2", "status", "new"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	result, err = restored.GetInferences("", "handled")
+	if err != nil || len(result) != 2 {
+		t.Errorf("Test 2 kept: expected 2 kept inferences, got %v\n", result)
+	}
+
+	err = restored.Restore(bytes.NewReader(data))
+	if err == nil {
+		t.Errorf("Test 3 not empty: expected an error\n")
+	}
+
+	buf.Reset()
+	err = gob.NewEncoder(&buf).Encode(snapshotHeader{Version: snapshotVersion + 1})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = newEngine().Restore(&buf)
+	if err == nil {
+		t.Errorf("Test 4 version: expected an error\n")
+	}
+
+	//a snapshot that fails part way leaves the engine as it was
+	var bad bytes.Buffer
+	encoder := gob.NewEncoder(&bad)
+	err = encoder.Encode(snapshotHeader{Version: snapshotVersion})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = encoder.Encode(snapshot{
+		Strategy: Lex,
+		Rules:    rules,
+		Facts:    []snapshotFact{snapshotFact{Fact: Fact{"box", "size", 3}}},
+		Matches:  []snapshotMatch{snapshotMatch{RuleId: "double", Facts: []Fact{Fact{"box", "size", 3}, Fact{"box", "weight", 40}}}},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	partial := newEngine()
+	err = partial.Restore(&bad)
+	if err == nil {
+		t.Errorf("Test 5 partial: expected an error\n")
+	}
+	if len(partial.Rules()) != 0 || len(partial.timetags) != 0 || partial.strategy != Depth {
+		t.Errorf("Test 5 partial: expected the engine to be untouched, got %d rules\n", len(partial.Rules()))
+	}
+	buf.Reset()
+	err = original.Snapshot(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = partial.Restore(&buf)
+	if err != nil {
+		t.Fatalf("Test 5 partial: %s\n", err)
+	}
+	err = partial.Assert(Fact{"crate", "status", "new"})
+	if err != nil || partial.productions[0].parentEngine != partial {
+		t.Errorf("Test 5 partial: expected the restored engine to work, got %v\n", err)
+	}
+}
+
+func TestSnapshotFailedFiring(t *testing.T) {
+
+	var o Variable = "o"
+	var v Variable = "v"
+
+	//the second inference cannot be made, so the match fires with only the first
+	original := &Engine{}
+	err := original.Define(Rule{
+		Id:  "price",
+		LHS: []Condition{Condition{ObjectId: o, Attribute: "price", Comparator: EQ, Value: v}},
+		RHS: []Inference{Inference{ObjectId: o, Attribute: "priced", Value: true}, Inference{ObjectId: o, Attribute: "gross", Value: Call("mul", v, 2)}},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = original.Assert(Fact{"box", "price", "free"})
+	if err == nil {
+		t.Fatalf("Test 1: expected an expression error\n")
+	}
+
+	var buf bytes.Buffer
+	err = original.Snapshot(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	restored := &Engine{}
+	err = restored.Restore(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	result, _ := restored.GetInferences("", "")
+	if len(result) != 1 || result[0] != (Fact{"box", "priced", true}) {
+		t.Errorf("Test 2: expected the one inference, got %v\n", result)
+	}
+	err = restored.Retract(Fact{"box", "price", "free"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	result, _ = restored.GetInferences("", "")
+	if len(result) != 0 {
+		t.Errorf("Test 3: expected the inference to be withdrawn, got %v\n", result)
+	}
+}
@@ -0,0 +1,204 @@
+package engine
+
+import "fmt"
+
+//A Transaction collects assertions and retractions to be made together. Nothing reaches
+//the engine until Commit, which passes all of them into the network before any rule fires,
+//so no inference is made from part of the batch. If an error occurs, Commit undoes the batch.
+type Transaction struct {
+	engine  *Engine
+	changes []transactionChange
+	done    bool
+}
+
+type transactionChange struct {
+	fact    Fact
+	retract bool
+}
+
+//a journal records the changes made to working memory while a transaction is committed,
+//so that they can be undone
+type journal struct {
+	clock      uint64           //of the engine when the commit began
+	asserted   []*Fact          //facts asserted by the transaction, or by rules modifying facts
+	retracted  []*Fact          //facts held before the commit and retracted since (not inferences)
+	inferences []*Fact          //inferences held before the commit and retracted while their matches stood
+	kept       []*keptInference //inferences kept since the commit began
+	lost       []*keptInference //inferences kept before the commit and retracted since
+}
+
+//Begin starts a transaction on the engine
+func (engine *Engine) Begin() *Transaction {
+
+	return &Transaction{engine: engine}
+}
+
+//Assert adds the assertion of a fact to the transaction
+func (tx *Transaction) Assert(fct Fact) error {
+
+	if tx.done {
+		return fmt.Errorf("Assert: transaction is finished")
+	}
+	tx.changes = append(tx.changes, transactionChange{fact: fct})
+	return nil
+}
+
+//Retract adds the retraction of a fact to the transaction; the fact may be one asserted
+//earlier in the same transaction
+func (tx *Transaction) Retract(fct Fact) error {
+
+	if tx.done {
+		return fmt.Errorf("Retract: transaction is finished")
+	}
+	tx.changes = append(tx.changes, transactionChange{fact: fct, retract: true})
+	return nil
+}
+
+//Rollback discards a transaction that has not been committed
+func (tx *Transaction) Rollback() error {
+
+	if tx.done {
+		return fmt.Errorf("Rollback: transaction is finished")
+	}
+	tx.done = true
+	tx.changes = nil
+	return nil
+}
+
+//Commit makes the assertions and retractions of the transaction, in order, and then lets
+//the rules fire. If an error occurs on the way, working memory is put back as it was: facts
+//asserted by the transaction (or by the rules it fired) are retracted, and facts retracted
+//by it (inferences included) are asserted or inferred again. The inferences follow as usual,
+//so those made during the commit are withdrawn and the undo functions of their actions are
+//called; rules whose matches the transaction broke are matched, and fire, again. The error
+//is then returned.
+func (tx *Transaction) Commit() error {
+
+	if tx.done {
+		return fmt.Errorf("Commit: transaction is finished")
+	}
+	tx.done = true
+
+	engine := tx.engine
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
+	engine.journal = &journal{clock: engine.clock}
+	err := tx.apply()
+	if err == nil {
+		engine.journal = nil
+		return nil
+	}
+	rollbackErr := engine.rollback()
+	if rollbackErr != nil {
+		return fmt.Errorf("%s (and rolling back: %s)", err, rollbackErr)
+	}
+	return err
+}
+
+func (tx *Transaction) apply() error {
+
+	engine := tx.engine
+	for _, c := range tx.changes {
+		fct := c.fact
+		if !c.retract {
+			engine.journal.asserted = append(engine.journal.asserted, &fct)
+			engine.pushFact(&fct)
+			continue
+		}
+		f, err := engine.find(fct)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			f = engine.findPending(fct)
+		}
+		if f == nil {
+			continue
+		}
+		err = engine.retract(f)
+		if err != nil {
+			return err
+		}
+	}
+	return engine.turn()
+}
+
+//findPending returns a fact equal to fct that is waiting to be propagated, or nil
+func (engine *Engine) findPending(fct Fact) *Fact {
+
+	k := factKeyOf(&fct)
+	for e := engine.pending.Back(); e != nil; e = e.Prev() {
+		f := e.Value.(*Fact)
+		if factKeyOf(f) == k {
+			return f
+		}
+	}
+	return nil
+}
+
+//rollback undoes the changes recorded in the journal and lets the engine settle
+func (engine *Engine) rollback() error {
+
+	j := engine.journal
+	engine.journal = nil
+
+	for _, k := range j.kept {
+		if _, ok := k.node.keptPositions[k]; !ok {
+			continue //since retracted
+		}
+		engine.unkeep(k)
+		err := engine.withdraw(k.fact)
+		if err != nil {
+			return err
+		}
+	}
+	for i := len(j.asserted) - 1; i >= 0; i-- {
+		err := engine.retract(j.asserted[i])
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range j.retracted {
+		engine.pushFact(f)
+	}
+	for _, f := range j.inferences {
+		k := factKeyOf(f)
+		if engine.support[f] <= 0 {
+			continue //its matches were broken since, and infer it again if they are restored
+		}
+		if _, ok := engine.inferred[k]; ok {
+			continue
+		}
+		engine.inferred[k] = f
+		engine.pushFact(f)
+	}
+	for _, k := range j.lost {
+		f := engine.infer(k.fact)
+		engine.keep(&keptInference{node: k.node, fact: f, support: k.support})
+	}
+	return engine.turn()
+}
+
+//record notes in the journal (if a transaction is being committed) that a fact is about
+//to be retracted, along with any kept inferences it ends
+func (engine *Engine) record(f *Fact) {
+
+	j := engine.journal
+	if j == nil {
+		return
+	}
+	tag, ok := engine.timetags[f]
+	if !ok || tag > j.clock {
+		return //not held before the commit
+	}
+	if engine.inferred[factKeyOf(f)] == f {
+		j.lost = append(j.lost, engine.kept[f]...)
+		if engine.support[f] > len(engine.kept[f]) {
+			//still supported by matches, so retracted directly rather than withdrawn
+			j.inferences = append(j.inferences, f)
+		}
+		return
+	}
+	j.retracted = append(j.retracted, f)
+}
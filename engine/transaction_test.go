@@ -0,0 +1,175 @@
+package engine
+
+import "fmt"
+import "testing"
+
+func TestTransaction(t *testing.T) {
+
+	var o Variable = "o"
+	lonely := 0
+
+	testEngine := Engine{}
+	err := testEngine.RegisterAction("lonely", func(ruleId string, bindings Bindings) error {
+		lonely++
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = testEngine.RegisterAction("explode", func(ruleId string, bindings Bindings) error {
+		return fmt.Errorf("%v exploded", bindings[o])
+	}, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	rules := []Rule{
+		Rule{
+			Id: "pair",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "a", Comparator: EQ, Value: 1},
+				Condition{ObjectId: o, Attribute: "b", Comparator: EQ, Value: 2},
+			},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "c", Value: 3}},
+		},
+		Rule{
+			Id: "lonely",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "a", Comparator: EQ, Value: 1},
+				Condition{NotExists: true, ObjectId: "", Attribute: "b", Comparator: EQ, Value: 2},
+			},
+			Actions: []Action{Action{Name: "lonely"}},
+		},
+		Rule{
+			Id:      "explode",
+			LHS:     []Condition{Condition{ObjectId: o, Attribute: "explode", Comparator: EQ, Value: "yes"}},
+			Actions: []Action{Action{Name: "explode"}},
+		},
+		Rule{
+			Id:  "p",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "p", Comparator: EQ, Value: 1}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "q", Value: 1}},
+		},
+		Rule{
+			Id:  "q",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "q", Comparator: EQ, Value: 1}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "r", Value: 1}},
+		},
+	}
+	for _, r := range rules {
+		err = testEngine.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+
+	//the facts of a transaction arrive together
+	tx := testEngine.Begin()
+	tx.Assert(Fact{"x", "a", 1})
+	tx.Assert(Fact{"x", "b", 2})
+	tx.Assert(Fact{"y", "z", 0})
+	tx.Retract(Fact{"y", "z", 0})
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if lonely != 0 {
+		t.Errorf("Test 1 together: expected lonely not to fire, fired %d times\n", lonely)
+	}
+	result, err := testEngine.GetInferences("x", "c")
+	if err != nil || len(result) != 1 {
+		t.Errorf("Test 1 together: expected an inference, got %v %v\n", result, err)
+	}
+	facts, _ := testEngine.GetFacts("y", "")
+	if len(facts) != 0 {
+		t.Errorf("Test 1 retraction: expected no facts about y, got %v\n", facts)
+	}
+	err = tx.Commit()
+	if err == nil {
+		t.Errorf("Test 1 finished: expected an error committing twice\n")
+	}
+
+	before, err := testEngine.GetFacts("", "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	//a failing commit is undone
+	tx = testEngine.Begin()
+	tx.Retract(Fact{"x", "b", 2})
+	tx.Assert(Fact{"w", "a", 1})
+	tx.Assert(Fact{"w", "b", 2})
+	tx.Assert(Fact{"w", "explode", "yes"})
+	err = tx.Commit()
+	if err == nil {
+		t.Fatalf("Test 2 rollback: expected an error\n")
+	}
+	after, err := testEngine.GetFacts("", "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if fmt.Sprint(keysOf(before)) != fmt.Sprint(keysOf(after)) {
+		t.Errorf("Test 2 rollback: expected\n%v\ngot\n%v\n", before, after)
+	}
+	if lonely != 0 {
+		t.Errorf("Test 2 rollback: expected lonely not to fire, fired %d times\n", lonely)
+	}
+
+	//a transaction that is rolled back never reaches the engine
+	tx = testEngine.Begin()
+	tx.Retract(Fact{"x", "b", 2})
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = tx.Commit()
+	if err == nil {
+		t.Errorf("Test 3 rolled back: expected an error committing\n")
+	}
+	result, err = testEngine.GetInferences("x", "c")
+	if err != nil || len(result) != 1 {
+		t.Errorf("Test 3 rolled back: expected the inference to remain, got %v %v\n", result, err)
+	}
+
+	//an inference retracted by a failing commit is inferred again, with what follows from it
+	err = testEngine.Assert(Fact{"v", "p", 1})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tx = testEngine.Begin()
+	tx.Retract(Fact{"v", "q", 1})
+	tx.Assert(Fact{"v", "explode", "yes"})
+	err = tx.Commit()
+	if err == nil {
+		t.Fatalf("Test 4 inference: expected an error\n")
+	}
+	found, err := testEngine.find(Fact{"v", "q", 1})
+	if err != nil || found == nil {
+		t.Errorf("Test 4 inference: expected v q 1 in working memory, got %v %v\n", found, err)
+	}
+	result, err = testEngine.GetInferences("v", "r")
+	if err != nil || len(result) != 1 {
+		t.Errorf("Test 4 inference: expected v r 1, got %v %v\n", result, err)
+	}
+
+	//and stays retracted by a commit that succeeds
+	tx = testEngine.Begin()
+	tx.Retract(Fact{"v", "q", 1})
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	result, err = testEngine.GetInferences("v", "r")
+	if err != nil || len(result) != 0 {
+		t.Errorf("Test 5 inference: expected no v r, got %v %v\n", result, err)
+	}
+}
+
+func keysOf(facts []Fact) map[factKey]bool {
+
+	keys := make(map[factKey]bool)
+	for i := range facts {
+		keys[factKeyOf(&facts[i])] = true
+	}
+	return keys
+}
@@ -0,0 +1,128 @@
+package engine
+
+import "testing"
+
+func TestUndefine(t *testing.T) {
+
+	var o Variable = "o"
+	undone := 0
+
+	testEngine := Engine{}
+	err := testEngine.RegisterAction("note", func(ruleId string, bindings Bindings) error {
+		return nil
+	}, func(ruleId string, bindings Bindings) error {
+		undone++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	rules := []Rule{
+		Rule{
+			Id:  "first",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "a", Comparator: EQ, Value: "x"}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "b", Value: "y"}},
+		},
+		Rule{
+			Id:  "twin",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "a", Comparator: EQ, Value: "x"}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "b", Value: "y"}},
+		},
+		Rule{
+			Id:      "second",
+			LHS:     []Condition{Condition{ObjectId: o, Attribute: "b", Comparator: EQ, Value: "y"}},
+			RHS:     []Inference{Inference{ObjectId: o, Attribute: "c", Value: "z"}},
+			Actions: []Action{Action{Name: "note"}},
+		},
+		Rule{
+			Id: "quiet",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "a", Comparator: EQ, Value: "x"},
+				Condition{NotExists: true, ObjectId: "", Attribute: "c", Comparator: EQ, Value: "z"},
+			},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "quiet", Value: "yes"}},
+		},
+	}
+	for _, r := range rules {
+		err = testEngine.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+	err = testEngine.Assert(Fact{"o1", "a", "x"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	count := func(test string, attribute string, expected int) {
+		result, err := testEngine.GetInferences("o1", attribute)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		if len(result) != expected {
+			t.Errorf("Test %s: expected %d, got %d %v\n", test, expected, len(result), result)
+		}
+	}
+	count("1 c", "c", 1)
+	count("1 quiet", "quiet", 0)
+
+	err = testEngine.Undefine("nosuchrule")
+	if err == nil {
+		t.Errorf("Test 2 unknown rule: expected an error")
+	}
+
+	//twin still infers the same fact, so nothing downstream changes
+	err = testEngine.Undefine("first")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	count("3 b", "b", 1)
+	count("3 c", "c", 1)
+	if undone != 0 {
+		t.Errorf("Test 3 undone: expected 0, got %d\n", undone)
+	}
+
+	err = testEngine.Undefine("twin")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	count("4 b", "b", 0)
+	count("4 c", "c", 0)
+	count("4 quiet", "quiet", 1)
+	if undone != 1 {
+		t.Errorf("Test 4 undone: expected 1, got %d\n", undone)
+	}
+
+	err = testEngine.Undefine("second")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, ok := testEngine.alphaNetwork["b"]; ok {
+		t.Errorf("Test 5 alpha nodes: expected b to be removed\n")
+	}
+	if len(testEngine.alphaNetwork["a"]) != 1 || len(testEngine.alphaNetwork["c"]) != 1 {
+		t.Errorf("Test 5 alpha nodes: shared nodes were removed\n")
+	}
+	if len(testEngine.productions) != 1 {
+		t.Errorf("Test 5 productions: expected 1, got %d\n", len(testEngine.productions))
+	}
+
+	//the remaining rule carries on as before
+	err = testEngine.Assert(Fact{"o1", "c", "z"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	count("6 quiet", "quiet", 0)
+
+	//an id names one rule only, so that undefining it leaves the others alone
+	duplicate := rules[0]
+	duplicate.Id = "quiet"
+	err = testEngine.Define(duplicate)
+	if err == nil || err.Error() != "Rule quiet is already defined" {
+		t.Errorf("Test 7 duplicate: expected an error, got %v\n", err)
+	}
+	if len(testEngine.productions) != 1 || len(testEngine.Rules()) != 1 {
+		t.Errorf("Test 7 duplicate: expected 1 rule, got %v\n", testEngine.Rules())
+	}
+}
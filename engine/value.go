@@ -0,0 +1,286 @@
+package engine
+
+import "fmt"
+import "math"
+import "reflect"
+import "time"
+
+//NullValue is the type of Null
+type NullValue struct{}
+
+//Null is an explicit null value, for an attribute that is known to be absent. It equals only
+//itself and cannot be ordered. It is not the same as a nil Condition.Value, which places no
+//constraint on the value at all.
+var Null = NullValue{}
+
+func (NullValue) String() string {
+
+	return "null"
+}
+
+//GobEncode lets Null be written in a snapshot, which gob does not allow for an empty struct
+func (NullValue) GobEncode() ([]byte, error) {
+
+	return []byte{}, nil
+}
+
+func (*NullValue) GobDecode([]byte) error {
+
+	return nil
+}
+
+//typed reports whether a value is compared by its type rather than by its kind:
+//Null, bool, time.Time and time.Duration (whose kind is int64, but which is not an integer)
+func typed(v interface{}) bool {
+
+	switch v.(type) {
+	case NullValue, bool, time.Time, time.Duration:
+		return true
+	}
+	return false
+}
+
+//matchTyped compares values when either of them is typed. Values of different types are
+//never equal. Times and durations can be ordered; Null and booleans only compared for equality.
+func matchTyped(left interface{}, op Operator, right interface{}) (bool, error) {
+
+	var order int //-1, 0 or 1 as left is less than, equal to or greater than right
+	ordered := true
+	same := false
+
+	switch l := left.(type) {
+	case NullValue:
+		_, same = right.(NullValue)
+		ordered = false
+	case bool:
+		var r bool
+		r, same = right.(bool)
+		if l != r {
+			order = 1
+		}
+		ordered = false
+	case time.Time:
+		var r time.Time
+		r, same = right.(time.Time)
+		if l.Before(r) {
+			order = -1
+		} else if l.After(r) {
+			order = 1
+		}
+	case time.Duration:
+		var r time.Duration
+		r, same = right.(time.Duration)
+		if l < r {
+			order = -1
+		} else if l > r {
+			order = 1
+		}
+	}
+
+	if !same {
+		switch op {
+		case EQ:
+			return false, nil
+		case NE:
+			return true, nil
+		default:
+			return false, fmt.Errorf("match: cannot compare %s to %s using %s", typeName(left), typeName(right), op.String())
+		}
+	}
+	switch op {
+	case EQ:
+		return order == 0, nil
+	case NE:
+		return order != 0, nil
+	}
+	if !ordered {
+		return false, fmt.Errorf("match: cannot compare %s using %s", typeName(left), op.String())
+	}
+	switch op {
+	case GE:
+		return order >= 0, nil
+	case GT:
+		return order > 0, nil
+	case LE:
+		return order <= 0, nil
+	case LT:
+		return order < 0, nil
+	}
+	return false, fmt.Errorf("match: unknown operator %d", int(op))
+}
+
+//unordered reports whether an ordered comparison involves a typed value that cannot be
+//ordered against the other: Null, a boolean, or a time or duration against another type.
+//An alpha test treats this as a non-match, since Null stands for an absent value.
+func unordered(left interface{}, op Operator, right interface{}) bool {
+
+	if op == EQ || op == NE || !typed(left) && !typed(right) {
+		return false
+	}
+	switch left.(type) {
+	case time.Time:
+		_, ok := right.(time.Time)
+		return !ok
+	case time.Duration:
+		_, ok := right.(time.Duration)
+		return !ok
+	}
+	return true
+}
+
+func typeName(v interface{}) string {
+
+	if v == nil {
+		return "nil"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+//formatTyped writes a typed value for Fact.String and alphaNode.String
+func formatTyped(v interface{}) string {
+
+	switch t := v.(type) {
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprintf("%v", t)
+	}
+}
+
+//a number is an integer, unsigned integer or float value of any size, so that numbers
+//of different kinds can be compared by their numeric value
+type number struct {
+	kind reflect.Kind //Int64, Uint64 or Float64
+	i int64
+	u uint64
+	f float64
+}
+
+//numberOf returns the number held by a value of any integer, unsigned integer or float kind
+//(time.Duration aside)
+func numberOf(v interface{}) (number, bool) {
+
+	if typed(v) {
+		return number{}, false
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return number{kind: reflect.Int64, i: rv.Int()}, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return number{kind: reflect.Uint64, u: rv.Uint()}, true
+	case reflect.Float32, reflect.Float64:
+		return number{kind: reflect.Float64, f: rv.Float()}, true
+	}
+	return number{}, false
+}
+
+//normalize returns the number as an int64 if it is an integer in range, then as a uint64,
+//and only otherwise as a float64, so that equal numbers are normalized alike
+func (n number) normalize() number {
+
+	switch n.kind {
+	case reflect.Uint64:
+		if n.u <= math.MaxInt64 {
+			return number{kind: reflect.Int64, i: int64(n.u)}
+		}
+	case reflect.Float64:
+		if n.f != math.Trunc(n.f) { //fractions, infinities and NaN
+			break
+		}
+		if n.f >= -(1<<63) && n.f < 1<<63 {
+			return number{kind: reflect.Int64, i: int64(n.f)}
+		}
+		if n.f >= 0 && n.f < 1<<64 {
+			return number{kind: reflect.Uint64, u: uint64(n.f)}
+		}
+	}
+	return n
+}
+
+//compareNumbers returns -1, 0 or 1 as a is less than, equal to or greater than b, exactly
+//(without rounding large integers to floats); ok is false if either is NaN
+func compareNumbers(a number, b number) (order int, ok bool) {
+
+	a, b = a.normalize(), b.normalize()
+	if a.kind != reflect.Float64 && b.kind == reflect.Float64 {
+		order, ok = compareNumbers(b, a)
+		return -order, ok
+	}
+	if a.kind == reflect.Float64 && b.kind != reflect.Float64 && a.f == math.Trunc(a.f) {
+		//a whole float that did not normalize is beyond the range of every integer
+		if a.f > 0 {
+			return 1, true
+		}
+		return -1, true
+	}
+	if a.kind == reflect.Float64 {
+		//a fraction lies strictly between two integers, which rounding the other to
+		//float cannot cross, so the float comparison is exact
+		x, y := a.float(), b.float()
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		case x == y:
+			return 0, true
+		}
+		return 0, false
+	}
+	switch {
+	case a.kind == reflect.Uint64 && b.kind == reflect.Uint64:
+		return compareOrdered(a.u < b.u, a.u > b.u), true
+	case a.kind == reflect.Uint64: //greater than any int64
+		return 1, true
+	case b.kind == reflect.Uint64:
+		return -1, true
+	}
+	return compareOrdered(a.i < b.i, a.i > b.i), true
+}
+
+func (n number) float() float64 {
+
+	switch n.kind {
+	case reflect.Int64:
+		return float64(n.i)
+	case reflect.Uint64:
+		return float64(n.u)
+	}
+	return n.f
+}
+
+func compareOrdered(less bool, greater bool) int {
+
+	if less {
+		return -1
+	}
+	if greater {
+		return 1
+	}
+	return 0
+}
+
+//matchNumbers compares two numbers by value. As with floats, NaN is equal to nothing.
+func matchNumbers(left number, op Operator, right number) (bool, error) {
+
+	order, ok := compareNumbers(left, right)
+	if !ok {
+		return op == NE, nil
+	}
+	switch op {
+	case EQ:
+		return order == 0, nil
+	case GE:
+		return order >= 0, nil
+	case GT:
+		return order > 0, nil
+	case LE:
+		return order <= 0, nil
+	case LT:
+		return order < 0, nil
+	case NE:
+		return order != 0, nil
+	}
+	return false, fmt.Errorf("match: unknown operator %d", int(op))
+}
@@ -0,0 +1,242 @@
+package engine
+
+import "math"
+import "testing"
+import "time"
+
+func TestTypedValues(t *testing.T) {
+
+	noon := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	later := noon.Add(time.Hour)
+
+	tests := []struct {
+		left     interface{}
+		op       Operator
+		right    interface{}
+		expected bool
+		err      bool
+	}{
+		{true, EQ, true, true, false},
+		{true, NE, false, true, false},
+		{true, GT, false, false, true},
+		{true, EQ, 1, false, false},
+		{"true", NE, true, true, false},
+		{noon, LT, later, true, false},
+		{later, GE, noon, true, false},
+		{noon, EQ, noon.In(time.FixedZone("EST", -5*3600)), true, false},
+		{noon, GT, "2024-01-01", false, true},
+		{time.Minute, GT, time.Second, true, false},
+		{time.Minute, LE, time.Minute, true, false},
+		{time.Duration(60), EQ, 60, false, false},
+		{time.Duration(60), LT, 61, false, true},
+		{Null, EQ, Null, true, false},
+		{Null, NE, "", true, false},
+		{Null, EQ, nil, false, false},
+		{Null, LT, Null, false, true},
+	}
+	for i, tst := range tests {
+		result, err := match(tst.left, tst.op, tst.right)
+		if (err != nil) != tst.err {
+			t.Errorf("Test %d: expected error %t, got %v\n", i, tst.err, err)
+			continue
+		}
+		if result != tst.expected {
+			t.Errorf("Test %d: %v %s %v expected %t, got %t\n", i, tst.left, tst.op.String(), tst.right, tst.expected, result)
+		}
+	}
+
+	var o Variable = "o"
+
+	testEngine := Engine{}
+	rules := []Rule{
+		Rule{
+			Id: "overdue",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "paid", Comparator: EQ, Value: false},
+				Condition{ObjectId: o, Attribute: "due", Comparator: LT, Value: noon},
+			},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "overdue", Value: true}},
+		},
+		Rule{
+			Id:  "slow",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "delay", Comparator: GT, Value: time.Hour}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "slow", Value: true}},
+		},
+		Rule{
+			Id:  "unnoted",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "note", Comparator: EQ, Value: Null}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "unnoted", Value: true}},
+		},
+		Rule{
+			Id:  "fever",
+			LHS: []Condition{Condition{ObjectId: o, Attribute: "temp", Comparator: GT, Value: 38}},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "fever", Value: true}},
+		},
+	}
+	for _, r := range rules {
+		err := testEngine.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+	for _, f := range []Fact{
+		Fact{"o1", "paid", false},
+		Fact{"o1", "due", noon.Add(-time.Minute)},
+		Fact{"o2", "paid", true},
+		Fact{"o2", "due", noon.Add(-time.Minute)},
+		Fact{"o1", "delay", 2 * time.Hour},
+		Fact{"o1", "note", Null},
+		Fact{"o2", "note", ""},
+		Fact{"o1", "temp", 39},
+		Fact{"o2", "temp", Null}, //absent, and so not above 38
+		Fact{"o3", "temp", true},
+	} {
+		err := testEngine.Assert(f)
+		if err != nil {
+			t.Fatalf("Error asserting %s: %s\n", f, err)
+		}
+	}
+
+	for _, tst := range []struct {
+		attribute string
+		expected  int
+	}{
+		{"overdue", 1},
+		{"slow", 1},
+		{"unnoted", 1},
+		{"fever", 1},
+	} {
+		result, err := testEngine.GetInferences("", tst.attribute)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		if len(result) != tst.expected || result[0].ObjectId != "o1" || result[0].Value != true {
+			t.Errorf("Test %s: expected o1 only, got %v\n", tst.attribute, result)
+		}
+	}
+
+	//the same instant in another location is a duplicate, and retracts the original
+	err := testEngine.Assert(Fact{"o1", "due", noon.Add(-time.Minute).In(time.FixedZone("EST", -5*3600))})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	facts, err := testEngine.GetFacts("o1", "due")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(facts) != 1 {
+		t.Errorf("Test duplicate: expected 1 fact, got %v\n", facts)
+	}
+	err = testEngine.Retract(Fact{"o1", "due", noon.Add(-time.Minute).In(time.FixedZone("CET", 3600))})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	result, err := testEngine.GetInferences("", "overdue")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(result) != 0 {
+		t.Errorf("Test retract: expected no overdue orders, got %v\n", result)
+	}
+
+	if s := (Fact{"o1", "delay", 90 * time.Second}).String(); s != "O o1 A delay V 1m30s" {
+		t.Errorf("Test String: got %q\n", s)
+	}
+	if s := (Fact{"o1", "due", noon}).String(); s != "O o1 A due V 2024-01-01T12:00:00Z" {
+		t.Errorf("Test String: got %q\n", s)
+	}
+	if s := (Fact{"o1", "note", Null}).String(); s != "O o1 A note V null" {
+		t.Errorf("Test String: got %q\n", s)
+	}
+}
+
+func TestNumericValues(t *testing.T) {
+
+	tests := []struct {
+		left     interface{}
+		op       Operator
+		right    interface{}
+		expected bool
+	}{
+		{5, GT, 0.0, true},
+		{5, EQ, 5.0, true},
+		{5, LT, 5.5, true},
+		{int8(-1), LT, uint(0), true},
+		{uint64(math.MaxUint64), GT, int64(math.MaxInt64), true},
+		{uint64(math.MaxUint64), LT, math.Pow(2, 64), true},
+		{int64(math.MaxInt64), LT, math.Pow(2, 63), true},
+		{int64(math.MinInt64), EQ, -math.Pow(2, 63), true},
+		{1<<53 + 1, GT, float64(1 << 53), true},
+		{1<<53 + 1, NE, float64(1 << 53), true},
+		{-3, GT, math.Inf(-1), true},
+		{float32(0.5), EQ, 0.5, true},
+		{math.NaN(), EQ, math.NaN(), false},
+		{math.NaN(), NE, 1, true},
+		{math.NaN(), GE, 1, false},
+		{"5", EQ, 5, false},
+	}
+	for i, tst := range tests {
+		result, err := match(tst.left, tst.op, tst.right)
+		if err != nil {
+			t.Errorf("Test %d: %s\n", i, err)
+			continue
+		}
+		if result != tst.expected {
+			t.Errorf("Test %d: %v %s %v expected %t, got %t\n", i, tst.left, tst.op.String(), tst.right, tst.expected, result)
+		}
+		//the operands the other way round
+		reversed := map[Operator]Operator{EQ: EQ, NE: NE, GT: LT, GE: LE, LT: GT, LE: GE}[tst.op]
+		result, err = match(tst.right, reversed, tst.left)
+		if err != nil || result != tst.expected {
+			t.Errorf("Test %d reversed: expected %t, got %t %v\n", i, tst.expected, result, err)
+		}
+	}
+
+	var o Variable = "o"
+
+	testEngine := Engine{}
+	err := testEngine.Define(Rule{
+		Id:  "positive",
+		LHS: []Condition{Condition{ObjectId: o, Attribute: "balance", Comparator: GT, Value: 0.0}},
+		RHS: []Inference{Inference{ObjectId: o, Attribute: "positive", Value: "yes"}},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = testEngine.Define(Rule{
+		Id:  "even",
+		LHS: []Condition{Condition{ObjectId: o, Attribute: "balance", Comparator: EQ, Value: uint(10)}},
+		RHS: []Inference{Inference{ObjectId: o, Attribute: "even", Value: "yes"}},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, f := range []Fact{
+		Fact{"a1", "balance", 10},
+		Fact{"a1", "balance", 10.0}, //a duplicate
+		Fact{"a2", "balance", -2.5},
+	} {
+		err = testEngine.Assert(f)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	facts, err := testEngine.GetFacts("a1", "balance")
+	if err != nil || len(facts) != 1 {
+		t.Errorf("Test duplicate: expected 1 fact, got %v %v\n", facts, err)
+	}
+	for _, attribute := range []string{"positive", "even"} {
+		result, err := testEngine.GetInferences("", attribute)
+		if err != nil || len(result) != 1 || result[0].ObjectId != "a1" {
+			t.Errorf("Test %s: expected a1 only, got %v %v\n", attribute, result, err)
+		}
+	}
+	err = testEngine.Retract(Fact{"a1", "balance", int64(10)})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	result, err := testEngine.GetInferences("", "")
+	if err != nil || len(result) != 0 {
+		t.Errorf("Test retract: expected no inferences, got %v %v\n", result, err)
+	}
+}
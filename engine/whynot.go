@@ -0,0 +1,277 @@
+package engine
+
+import "fmt"
+import "strings"
+
+//Diagnosis describes how far a rule has got in matching the facts in memory
+type Diagnosis struct {
+	RuleId     string
+	Conditions []ConditionState
+	Matches    []PartialMatch //one per token of the rule
+	Branch     int            //of a rule with alternatives
+	Branches   []*Diagnosis   //for a rule with alternatives, one per branch (and no Conditions or Matches)
+}
+
+//ConditionState describes one condition of a rule on its own, before any variables are joined
+type ConditionState struct {
+	Condition Condition
+	Facts     []Fact //facts passing the constant tests of the condition (the first condition, for forall, an aggregate or a negated group)
+	Blocking  bool   //a negated condition with facts passing its constant tests, which block the partial matches they agree with
+}
+
+//PartialMatch describes a set of facts that agree on the rule's variables
+type PartialMatch struct {
+	Facts    []*Fact       //per condition; nil if no fact has joined (and for negated conditions), the function and its result for an aggregate
+	Missing  []int         //conditions still unsatisfied
+	Failures []JoinFailure //why the facts of missing conditions could not join
+	Blockers []Fact        //for a partial match that a negated condition stops, the facts that agree with it
+	Complete bool
+	Fired    bool
+}
+
+//JoinFailure records the variable test that kept a fact out of a partial match
+type JoinFailure struct {
+	Condition      int  //the missing condition
+	Fact           Fact //a fact passing its constant tests
+	Variable       Variable
+	Other          Variable //the same as Variable if the values differ, else a distinct variable that the value would duplicate
+	OtherCondition int      //where Other is bound in the partial match
+	Relational     bool     //the fact's value failed Comparator against the value bound to Variable
+	Comparator     Operator
+}
+
+//WhyNot diagnoses a rule that has not fired (or not as often as expected): for each
+//condition, the facts that pass its constant tests and whether it is a negated condition
+//blocked by facts. If the rule has complete matches, they are listed; otherwise the
+//partial matches that get furthest through the rule's join nodes are listed with the
+//conditions that are missing and the variable tests that kept the facts out, or the facts
+//that block them at a negated condition. A rule with
+//alternatives is diagnosed branch by branch, each branch being the conditions that remain
+//when one group is chosen from every set of alternatives.
+func (engine *Engine) WhyNot(ruleId string) (*Diagnosis, error) {
+
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	var nodes []*pNode
+	for _, p := range engine.productions {
+		if p.ruleId == ruleId {
+			nodes = append(nodes, p)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("WhyNot: rule %s is not defined", ruleId)
+	}
+	if len(nodes) == 1 {
+		return engine.diagnose(nodes[0])
+	}
+	d := &Diagnosis{RuleId: ruleId}
+	for _, node := range nodes {
+		branch, err := engine.diagnose(node)
+		if err != nil {
+			return nil, err
+		}
+		d.Branches = append(d.Branches, branch)
+	}
+	return d, nil
+}
+
+//diagnose diagnoses the p-node of one branch of a rule
+func (engine *Engine) diagnose(node *pNode) (*Diagnosis, error) {
+
+	d := &Diagnosis{RuleId: node.ruleId, Branch: node.branch}
+	for i, jNode := range node.joins {
+		state := ConditionState{Condition: node.lhs[i]}
+		for _, f := range jNode.alpha.facts {
+			state.Facts = append(state.Facts, *f)
+		}
+		state.Blocking = jNode.negated && len(state.Facts) > 0
+		d.Conditions = append(d.Conditions, state)
+	}
+
+	//complete matches are the rule's tokens
+	for _, tok := range node.tokens {
+		m := PartialMatch{Facts: make([]*Fact, len(tok.incoming)), Complete: true}
+		m.Fired = tok.activation != nil && tok.activation.fired
+		for i, f := range tok.incoming {
+			if f != node.parentEngine.nullFact {
+				fct := *f
+				m.Facts[i] = &fct
+			}
+		}
+		d.Matches = append(d.Matches, m)
+	}
+	if len(node.tokens) > 0 {
+		return d, nil
+	}
+
+	//otherwise the partial matches that get furthest are in the memory
+	//of the join node before the first one with an empty memory
+	for i, jNode := range node.joins {
+		if len(jNode.memory) > 0 {
+			continue
+		}
+		level := jNode.leftInputs()
+		if jNode.quantifier != nil {
+			return d.partial(node, level, i, nil), nil
+		}
+		if jNode.negated {
+			var blockers [][]Fact
+			for _, left := range level {
+				var blocking []Fact
+				for _, f := range jNode.alpha.facts {
+					failure, err := jNode.joinTest(left, f)
+					if err != nil {
+						return nil, err
+					}
+					if failure == nil {
+						blocking = append(blocking, *f)
+					}
+				}
+				blockers = append(blockers, blocking)
+			}
+			d.partial(node, level, i, nil)
+			for n := range d.Matches {
+				d.Matches[n].Blockers = blockers[n]
+			}
+			return d, nil
+		}
+		var failures [][]JoinFailure
+		for _, left := range level {
+			var failed []JoinFailure
+			for _, f := range jNode.alpha.facts {
+				failure, err := jNode.joinTest(left, f)
+				if err != nil {
+					return nil, err
+				}
+				if failure != nil {
+					failed = append(failed, *failure)
+				}
+			}
+			failures = append(failures, failed)
+		}
+		return d.partial(node, level, i, failures), nil
+	}
+	return d, nil
+}
+
+//partial records the partial matches that could not be extended to condition i
+func (d *Diagnosis) partial(node *pNode, level []*betaToken, i int, failures [][]JoinFailure) *Diagnosis {
+
+	if i == 0 {
+		return d //nothing matched at all
+	}
+	for n, t := range level {
+		facts := t.facts(len(node.joins))
+		m := PartialMatch{Facts: make([]*Fact, len(facts))}
+		for j, f := range facts {
+			if f != nil && f != node.parentEngine.nullFact {
+				fct := *f
+				m.Facts[j] = &fct
+			}
+			if j >= i && !node.joins[j].negated {
+				m.Missing = append(m.Missing, j)
+			}
+		}
+		if failures != nil {
+			m.Failures = failures[n]
+		}
+		d.Matches = append(d.Matches, m)
+	}
+	return d
+}
+
+func (d *Diagnosis) String() string {
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "rule %s\n", d.RuleId)
+	for _, branch := range d.Branches {
+		fmt.Fprintf(&b, "  branch %d\n", branch.Branch)
+		body := strings.SplitN(branch.String(), "\n", 2)[1] //without its own heading
+		for _, line := range strings.SplitAfter(body, "\n") {
+			if line != "" {
+				b.WriteString("  " + line)
+			}
+		}
+	}
+	if d.Branches != nil {
+		return b.String()
+	}
+	for i, c := range d.Conditions {
+		fmt.Fprintf(&b, "  [%d] %s: ", i, c.Condition.String())
+		switch {
+		case c.Blocking:
+			b.WriteString("blocked by")
+			for _, f := range c.Facts {
+				fmt.Fprintf(&b, " (%s)", f.String())
+			}
+			b.WriteString("\n")
+		case c.Condition.NotExists:
+			b.WriteString("satisfied (no facts)\n")
+		case len(c.Facts) == 1:
+			b.WriteString("1 fact\n")
+		default:
+			fmt.Fprintf(&b, "%d facts\n", len(c.Facts))
+		}
+	}
+	if len(d.Matches) == 0 {
+		b.WriteString("  no partial matches\n")
+	}
+	for n, m := range d.Matches {
+		switch {
+		case m.Fired:
+			fmt.Fprintf(&b, "  match %d: fired\n", n+1)
+		case m.Complete:
+			fmt.Fprintf(&b, "  match %d: complete, waiting on the agenda\n", n+1)
+		default:
+			fmt.Fprintf(&b, "  match %d: partial\n", n+1)
+		}
+		for i, f := range m.Facts {
+			switch {
+			case f != nil && d.Conditions[i].Condition.Aggregate != nil:
+				fmt.Fprintf(&b, "    [%d] %s is %v\n", i, f.Attribute, f.Value)
+			case f != nil:
+				fmt.Fprintf(&b, "    [%d] %s\n", i, f.String())
+			case d.Conditions[i].Blocking:
+				fmt.Fprintf(&b, "    [%d] blocked\n", i)
+			case d.Conditions[i].Condition.NotExists:
+				fmt.Fprintf(&b, "    [%d] satisfied\n", i)
+			case d.Conditions[i].Condition.ForAll != nil && !m.missing(i):
+				fmt.Fprintf(&b, "    [%d] holds for every fact\n", i)
+			case d.Conditions[i].Condition.None != nil && !m.missing(i):
+				fmt.Fprintf(&b, "    [%d] satisfied\n", i)
+			default:
+				fmt.Fprintf(&b, "    [%d] missing\n", i)
+			}
+		}
+		for _, j := range m.Failures {
+			fmt.Fprintf(&b, "    (%s) cannot join [%d]: %s\n", j.Fact.String(), j.Condition, j.reason(m))
+		}
+		for _, f := range m.Blockers {
+			fmt.Fprintf(&b, "    blocked by (%s)\n", f.String())
+		}
+	}
+	return b.String()
+}
+
+func (m PartialMatch) missing(i int) bool {
+
+	for _, j := range m.Missing {
+		if j == i {
+			return true
+		}
+	}
+	return false
+}
+
+func (j JoinFailure) reason(m PartialMatch) string {
+
+	bound := m.Facts[j.OtherCondition]
+	if j.Relational {
+		return fmt.Sprintf("the value is not %s ?%s, bound by [%d] (%s)", j.Comparator.String(), j.Variable, j.OtherCondition, bound.String())
+	}
+	if j.Variable == j.Other {
+		return fmt.Sprintf("?%s is bound differently by [%d] (%s)", j.Variable, j.OtherCondition, bound.String())
+	}
+	return fmt.Sprintf("?%s would have the same value as ?%s, bound by [%d] (%s)", j.Variable, j.Other, j.OtherCondition, bound.String())
+}
@@ -0,0 +1,115 @@
+package engine
+
+import "testing"
+
+func TestWhyNot(t *testing.T) {
+
+	var o Variable = "o"
+	var p Variable = "p"
+
+	testEngine := Engine{}
+	rules := []Rule{
+		Rule{
+			Id: "approve",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "score", Comparator: GE, Value: 700},
+				Condition{ObjectId: o, Attribute: "verified", Comparator: EQ, Value: "yes"},
+				Condition{NotExists: true, ObjectId: "", Attribute: "freeze", Comparator: EQ, Value: "on"},
+			},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "approved", Value: "yes"}},
+		},
+		Rule{
+			Id: "pair",
+			LHS: []Condition{
+				Condition{ObjectId: o, Attribute: "partner", Comparator: EQ, Value: p},
+				Condition{ObjectId: p, Attribute: "status", Comparator: EQ, Value: "single"},
+			},
+			RHS: []Inference{Inference{ObjectId: o, Attribute: "paired", Value: "yes"}},
+		},
+	}
+	for _, r := range rules {
+		err := testEngine.Define(r)
+		if err != nil {
+			t.Fatalf("Error defining rule %s: %s\n", r.Id, err)
+		}
+	}
+
+	_, err := testEngine.WhyNot("nosuchrule")
+	if err == nil {
+		t.Errorf("Test 1 unknown rule: expected an error")
+	}
+
+	for _, fct := range []Fact{
+		Fact{"c1", "score", 720},
+		Fact{"c2", "verified", "yes"},
+		Fact{"ann", "partner", "ann"},
+	} {
+		err = testEngine.Assert(fct)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	d, err := testEngine.WhyNot("approve")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(d.Conditions) != 3 || len(d.Conditions[0].Facts) != 1 || len(d.Conditions[1].Facts) != 1 || d.Conditions[2].Blocking {
+		t.Errorf("Test 2 conditions: unexpected %v\n", d.Conditions)
+	}
+	expected := `rule approve
+  [0] ?o score GE 700: 1 fact
+  [1] ?o verified EQ "yes": 1 fact
+  [2] not * freeze EQ "on": satisfied (no facts)
+  match 1: partial
+    [0] O c1 A score V 720
+    [1] missing
+    [2] satisfied
+    (O c2 A verified V yes) cannot join [1]: ?o is bound differently by [0] (O c1 A score V 720)
+`
+	if d.String() != expected {
+		t.Errorf("Test 3 join failures: expected\n%s\ngot\n%s", expected, d.String())
+	}
+
+	err = testEngine.Assert(Fact{"c1", "verified", "yes"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = testEngine.Assert(Fact{"bank", "freeze", "on"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d, err = testEngine.WhyNot("approve")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !d.Conditions[2].Blocking {
+		t.Errorf("Test 4 blocking: expected condition 2 to block\n")
+	}
+	for i, m := range d.Matches {
+		if m.Complete || m.Fired {
+			t.Errorf("Test 4 blocking: match %d should be incomplete\n", i+1)
+		}
+	}
+
+	//distinct variables may not bind the same value
+	err = testEngine.Assert(Fact{"ann", "status", "single"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d, err = testEngine.WhyNot("pair")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	found := false
+	for _, m := range d.Matches {
+		for _, j := range m.Failures {
+			if j.Condition == 1 && j.Variable == p && j.Other == o {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Test 5 distinct variables: expected a failure on ?p\n%s", d.String())
+	}
+}
@@ -2,4 +2,4 @@ module github.com/Alan-Shaw/goference
 
 go 1.16
 
-
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,240 @@
+package parser
+
+import "fmt"
+import "strconv"
+import "strings"
+import "time"
+
+import "github.com/Alan-Shaw/goference/engine"
+
+//Format renders a rule in the rule language, such that Parse(Format(r)) yields r
+func Format(r engine.Rule) string {
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "rule %s", formatName(r.Id))
+	if r.Salience != 0 {
+		fmt.Fprintf(&b, " salience %d", r.Salience)
+	}
+	b.WriteString(":\n")
+	for i, condition := range r.LHS {
+		b.WriteString("\t" + formatCondition(condition))
+		if i < len(r.LHS)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("=>\n")
+	var consequents []string
+	for _, inference := range r.RHS {
+		consequents = append(consequents, fmt.Sprintf("%s %s %s", formatTerm(inference.ObjectId, true), formatName(inference.Attribute), formatTerm(inference.Value, false)))
+	}
+	for _, a := range r.Actions {
+		consequents = append(consequents, "call "+formatName(a.Name))
+	}
+	for _, retraction := range r.Retractions {
+		consequents = append(consequents, "retract "+formatTerm(retraction.Target, false))
+	}
+	for _, modification := range r.Modifications {
+		consequents = append(consequents, fmt.Sprintf("modify %s %s", formatTerm(modification.Target, false), formatTerm(modification.Value, false)))
+	}
+	for i, consequent := range consequents {
+		fmt.Fprintf(&b, "\t%s", consequent)
+		if i < len(consequents)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func formatCondition(condition engine.Condition) string {
+
+	var b strings.Builder
+	if condition.Any != nil {
+		b.WriteString("(")
+		for i, group := range condition.Any {
+			if i > 0 {
+				b.WriteString(" or ")
+			}
+			for j, c := range group {
+				if j > 0 {
+					b.WriteString(", ")
+				}
+				b.WriteString(formatCondition(c))
+			}
+		}
+		b.WriteString(")")
+		return b.String()
+	}
+	if condition.ForAll != nil {
+		b.WriteString("forall (")
+		for i, c := range condition.ForAll {
+			switch i {
+			case 0:
+			case 1:
+				b.WriteString(": ")
+			default:
+				b.WriteString(", ")
+			}
+			b.WriteString(formatCondition(c))
+		}
+		b.WriteString(")")
+		return b.String()
+	}
+	if condition.None != nil {
+		b.WriteString("not (")
+		for i, c := range condition.None {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(formatCondition(c))
+		}
+		b.WriteString(")")
+		return b.String()
+	}
+	if a := condition.Aggregate; a != nil {
+		b.WriteString(a.Function)
+		if a.Of != "" {
+			fmt.Fprintf(&b, " ?%s", a.Of)
+		}
+		b.WriteString(" (")
+		for i, c := range a.Conditions {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(formatCondition(c))
+		}
+		b.WriteString(")")
+		if condition.Value != nil {
+			fmt.Fprintf(&b, " %s %s", formatOperator(condition.Comparator), formatTerm(condition.Value, false))
+		}
+		if a.Into != "" {
+			fmt.Fprintf(&b, " as ?%s", a.Into)
+		}
+		return b.String()
+	}
+	if condition.Label != "" {
+		fmt.Fprintf(&b, "?%s <- ", condition.Label)
+	}
+	if condition.NotExists {
+		b.WriteString("not ")
+	}
+	if s, ok := condition.ObjectId.(string); ok && s == "" {
+		b.WriteString("*")
+	} else {
+		b.WriteString(formatTerm(condition.ObjectId, true))
+	}
+	fmt.Fprintf(&b, " %s %s %s", formatName(condition.Attribute), formatOperator(condition.Comparator), formatTerm(condition.Value, false))
+	return b.String()
+}
+
+//FormatFact renders a fact in the form accepted by ParseFact
+func FormatFact(fct engine.Fact) string {
+	return fmt.Sprintf("%s %s %s", formatName(fct.ObjectId), formatName(fct.Attribute), formatTerm(fct.Value, false))
+}
+
+func formatOperator(op engine.Operator) string {
+
+	switch op {
+	case engine.EQ:
+		return "="
+	case engine.GE:
+		return ">="
+	case engine.GT:
+		return ">"
+	case engine.LE:
+		return "<="
+	case engine.LT:
+		return "<"
+	case engine.NE:
+		return "!="
+	default:
+		return "?"
+	}
+}
+
+//formatTerm renders a variable, a name (if name is true) or a value
+func formatTerm(term interface{}, name bool) string {
+
+	switch v := term.(type) {
+	case engine.Variable:
+		return "?" + string(v)
+	case engine.Expression:
+		return formatExpression(v)
+	case string:
+		if name {
+			return formatName(v)
+		}
+		return strconv.Quote(v)
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		s := strconv.FormatFloat(v, 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0" //keep floats distinct from integers
+		}
+		return s
+	case float32:
+		s := strconv.FormatFloat(float64(v), 'f', -1, 32)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		return s
+	case bool:
+		return strconv.FormatBool(v)
+	case engine.NullValue:
+		return "null"
+	case time.Time:
+		return "time " + strconv.Quote(v.Format(time.RFC3339Nano))
+	case time.Duration:
+		return "duration " + strconv.Quote(v.String())
+	default:
+		return fmt.Sprintf("%v", v) //the other integer types
+	}
+}
+
+//formatExpression writes the arithmetic functions as operators, fully parenthesized
+func formatExpression(e engine.Expression) string {
+
+	args := make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = formatTerm(arg, false)
+		if nested, ok := arg.(engine.Expression); ok && infix(nested) != "" {
+			args[i] = "(" + args[i] + ")"
+		}
+	}
+	if op := infix(e); op != "" {
+		return args[0] + " " + op + " " + args[1]
+	}
+	return e.Function + "(" + strings.Join(args, ", ") + ")"
+}
+
+//infix returns the operator that an expression is written with, if any
+func infix(e engine.Expression) string {
+
+	if len(e.Args) != 2 {
+		return ""
+	}
+	for op, function := range arithmetic {
+		if function == e.Function {
+			return op
+		}
+	}
+	return ""
+}
+
+//formatName leaves a name bare if the lexer would read it back as an identifier
+func formatName(name string) string {
+
+	switch name {
+	case "", "rule", "not", "or", "call", "retract", "modify":
+		return strconv.Quote(name)
+	}
+	lex := newLexer("", name)
+	tok, err := lex.next()
+	if err != nil || tok.kind != tokIdent || tok.text != name || lex.offset != len(name) {
+		return strconv.Quote(name)
+	}
+	return name
+}
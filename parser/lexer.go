@@ -0,0 +1,305 @@
+package parser
+
+import "fmt"
+import "strconv"
+import "strings"
+import "unicode"
+import "unicode/utf8"
+
+type tokenKind int
+
+const ( //enumeration
+	tokEOF tokenKind = iota
+	tokIdent
+	tokVariable
+	tokString
+	tokInt
+	tokFloat
+	tokOperator
+	tokComma
+	tokColon
+	tokArrow
+	tokWildcard
+	tokLabel
+	tokArith
+	tokLParen
+	tokRParen
+)
+
+func (kind tokenKind) String() string {
+
+	switch kind {
+	case tokEOF:
+		return "end of input"
+	case tokIdent:
+		return "identifier"
+	case tokVariable:
+		return "variable"
+	case tokString:
+		return "string"
+	case tokInt:
+		return "integer"
+	case tokFloat:
+		return "float"
+	case tokOperator:
+		return "operator"
+	case tokComma:
+		return "','"
+	case tokColon:
+		return "':'"
+	case tokArrow:
+		return "'=>'"
+	case tokWildcard:
+		return "'*'"
+	case tokLabel:
+		return "'<-'"
+	case tokArith:
+		return "arithmetic operator"
+	case tokLParen:
+		return "'('"
+	case tokRParen:
+		return "')'"
+	default:
+		return ""
+	}
+}
+
+//Position identifies a location in the rule source (lines and columns start at 1)
+type Position struct {
+	Filename string
+	Line     int
+	Column   int
+}
+
+func (pos Position) String() string {
+
+	if pos.Filename != "" {
+		return fmt.Sprintf("%s:%d:%d", pos.Filename, pos.Line, pos.Column)
+	}
+	return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+}
+
+//Error is returned for any problem found in the rule source
+type Error struct {
+	Pos Position
+	Msg string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%s: %s", err.Pos.String(), err.Msg)
+}
+
+type token struct {
+	kind  tokenKind
+	text  string      //the source text, or the unquoted contents of a string
+	value interface{} //int or float64 for numeric literals
+	pos   Position
+}
+
+func (tok token) String() string {
+
+	switch tok.kind {
+	case tokEOF:
+		return tok.kind.String()
+	case tokString:
+		return strconv.Quote(tok.text)
+	default:
+		return fmt.Sprintf("%q", tok.text)
+	}
+}
+
+type lexer struct {
+	src    string
+	offset int
+	pos    Position
+}
+
+func newLexer(filename string, src string) *lexer {
+	return &lexer{src: src, pos: Position{Filename: filename, Line: 1, Column: 1}}
+}
+
+func (lex *lexer) peekRune() rune {
+
+	if lex.offset >= len(lex.src) {
+		return utf8.RuneError
+	}
+	r, _ := utf8.DecodeRuneInString(lex.src[lex.offset:])
+	return r
+}
+
+func (lex *lexer) nextRune() rune {
+
+	if lex.offset >= len(lex.src) {
+		return utf8.RuneError
+	}
+	r, size := utf8.DecodeRuneInString(lex.src[lex.offset:])
+	lex.offset += size
+	if r == '\n' {
+		lex.pos.Line++
+		lex.pos.Column = 1
+	} else {
+		lex.pos.Column++
+	}
+	return r
+}
+
+func (lex *lexer) errorf(pos Position, format string, args ...interface{}) error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
+
+//skip passes over white space and comments (which run from '#' to the end of the line)
+func (lex *lexer) skip() {
+
+	for lex.offset < len(lex.src) {
+		r := lex.peekRune()
+		if r == '#' {
+			for lex.offset < len(lex.src) && lex.peekRune() != '\n' {
+				lex.nextRune()
+			}
+		} else if unicode.IsSpace(r) {
+			lex.nextRune()
+		} else {
+			return
+		}
+	}
+}
+
+//next returns the next token in the source
+func (lex *lexer) next() (token, error) {
+
+	lex.skip()
+
+	start := lex.pos
+	if lex.offset >= len(lex.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+
+	r := lex.nextRune()
+	switch {
+	case r == ',':
+		return token{kind: tokComma, text: ",", pos: start}, nil
+	case r == ':':
+		return token{kind: tokColon, text: ":", pos: start}, nil
+	case r == '*':
+		return token{kind: tokWildcard, text: "*", pos: start}, nil //or multiplication
+	case r == '/' || r == '%':
+		return token{kind: tokArith, text: string(r), pos: start}, nil
+	case r == '(':
+		return token{kind: tokLParen, text: "(", pos: start}, nil
+	case r == ')':
+		return token{kind: tokRParen, text: ")", pos: start}, nil
+	case r == '=':
+		switch lex.peekRune() {
+		case '>':
+			lex.nextRune()
+			return token{kind: tokArrow, text: "=>", pos: start}, nil
+		case '=':
+			lex.nextRune()
+			return token{kind: tokOperator, text: "==", pos: start}, nil
+		}
+		return token{kind: tokOperator, text: "=", pos: start}, nil
+	case r == '!':
+		if lex.peekRune() != '=' {
+			return token{}, lex.errorf(start, "unexpected character '!'")
+		}
+		lex.nextRune()
+		return token{kind: tokOperator, text: "!=", pos: start}, nil
+	case r == '<' && lex.peekRune() == '-' && !lex.numberFollows(1):
+		lex.nextRune()
+		return token{kind: tokLabel, text: "<-", pos: start}, nil
+	case r == '<' || r == '>':
+		text := string(r)
+		if next := lex.peekRune(); next == '=' || (r == '<' && next == '>') {
+			lex.nextRune()
+			text += string(next)
+		}
+		return token{kind: tokOperator, text: text, pos: start}, nil
+	case r == '"':
+		return lex.lexString(start)
+	case r == '?':
+		begin := lex.offset
+		for lex.offset < len(lex.src) && isWordRune(lex.peekRune()) {
+			lex.nextRune()
+		}
+		if lex.offset == begin {
+			return token{}, lex.errorf(start, "variable name expected after '?'")
+		}
+		return token{kind: tokVariable, text: lex.src[begin:lex.offset], pos: start}, nil
+	case isWordRune(r) || r == '+':
+		begin := lex.offset - utf8.RuneLen(r)
+		for lex.offset < len(lex.src) && isWordRune(lex.peekRune()) {
+			lex.nextRune()
+		}
+		word := lex.src[begin:lex.offset]
+		if word == "+" || word == "-" {
+			return token{kind: tokArith, text: word, pos: start}, nil
+		}
+		return lex.classifyWord(word, start)
+	}
+	return token{}, lex.errorf(start, "unexpected character %q", r)
+}
+
+//numberFollows reports whether a digit (or a point and a digit) appears skip bytes ahead,
+//so that x <-1 still compares x with -1
+func (lex *lexer) numberFollows(skip int) bool {
+
+	rest := lex.src[lex.offset+skip:]
+	if strings.HasPrefix(rest, ".") {
+		rest = rest[1:]
+	}
+	return len(rest) > 0 && unicode.IsDigit(rune(rest[0]))
+}
+
+func (lex *lexer) lexString(start Position) (token, error) {
+
+	begin := lex.offset - 1
+	for {
+		if lex.offset >= len(lex.src) {
+			return token{}, lex.errorf(start, "unterminated string")
+		}
+		r := lex.nextRune()
+		if r == '\n' {
+			return token{}, lex.errorf(start, "unterminated string")
+		}
+		if r == '\\' {
+			lex.nextRune()
+			continue
+		}
+		if r == '"' {
+			break
+		}
+	}
+	text, err := strconv.Unquote(lex.src[begin:lex.offset])
+	if err != nil {
+		return token{}, lex.errorf(start, "invalid string %s", lex.src[begin:lex.offset])
+	}
+	return token{kind: tokString, text: text, pos: start}, nil
+}
+
+//classifyWord decides whether a bare word is a number or an identifier
+func (lex *lexer) classifyWord(word string, start Position) (token, error) {
+
+	first := strings.TrimLeft(word, "+-")
+	if len(first) == 0 || !(unicode.IsDigit(rune(first[0])) || (first[0] == '.' && len(first) > 1 && unicode.IsDigit(rune(first[1])))) {
+		if word[0] == '+' {
+			return token{}, lex.errorf(start, "unexpected character '+'")
+		}
+		return token{kind: tokIdent, text: word, pos: start}, nil
+	}
+
+	if i, err := strconv.Atoi(word); err == nil {
+		return token{kind: tokInt, text: word, value: i, pos: start}, nil
+	}
+	if f, err := strconv.ParseFloat(word, 64); err == nil {
+		return token{kind: tokFloat, text: word, value: f, pos: start}, nil
+	}
+	if word[0] == '+' || word[0] == '-' || word[0] == '.' {
+		return token{}, lex.errorf(start, "invalid number %q", word)
+	}
+	//object ids such as 123A begin with a digit but are not numbers
+	return token{kind: tokIdent, text: word, pos: start}, nil
+}
@@ -0,0 +1,928 @@
+//Package parser implements a small declarative language for goference rules.
+//
+//A rule has an id, a comma separated list of conditions and, after the
+//arrow, a comma separated list of inferences:
+//
+//	rule simple-rule:
+//		?o attribute1 = "value1",
+//		not object2 attribute2 > 0.0,
+//		?o attribute3 < 10
+//	=>
+//		?o attribute4 3.14
+//
+//A condition is an optional "not", an object, an attribute, an operator and
+//a value. The object is a variable (?name), an object id (a bare word, a
+//quoted string or a number, read as it is written) or * to accept any object id. The operators are = (or ==),
+//!= (or <>), >, >=, < and <=. Values are quoted strings, integers, floats,
+//true, false, null (engine.Null), times and durations written as quoted strings after
+//"time" or "duration" (as in time "2024-01-01T12:00:00Z" or duration "1h30m"), or variables. A variable compared with any
+//operator but = must be bound by an earlier condition, as in "?p temperature >
+//?limit". A negated condition may use variables too: it then forbids only the facts that
+//agree with the variables bound before it, as in "?o kind = "order", not ?o approved-by = ?a",
+//and binds nothing itself. An inference is an object, an attribute and a value.
+//
+//Conditions may be grouped as alternatives in parentheses, separated by "or",
+//as in "?p fever = true, (?p cough = true or ?p sneeze = true, ?p tired = true)";
+//the commas bind more tightly than "or", and groups may be nested. A variable or
+//label is bound after the parentheses only if every group binds it.
+//
+//A forall condition holds when every fact matching its first condition matches the
+//rest, as in "?p kind = "patient", forall (?r patient = ?p: ?r status = "normal")".
+//The variables bound within it are not bound after it.
+//
+//An aggregate computes count, sum, min, max or average over the matches of its conditions,
+//which are joined with the variables bound before it, as in
+//"?p kind = "patient", count (?s symptom-of = ?p) >= 3 as ?n" or
+//"sum ?v (?i order = ?o, ?i price = ?v) > 1000". The result may be tested with an operator
+//and a value or bound variable, and bound to a new variable with "as". As with forall, the
+//variables bound within the parentheses are not bound after it.
+//
+//A negated group holds when no facts match all of its conditions together, as in
+//"?o kind = "order", not (?s shipment-of = ?o, ?r receipt-for = ?s, ?r signed = true)".
+//Its conditions are joined with each other and with the variables bound before it, and the
+//variables bound within it are not bound after it.
+//
+//The object and value of an inference (and the value of a modification) may be
+//expressions, as in "?o gross ?price * 1.2" or "?p name concat(?first, " ", ?last)".
+//The operators are + - * / and %, which need white space after them where a number
+//follows; the functions are those of engine.Expression.
+//
+//The RHS may also call Go functions registered with Engine.RegisterAction,
+//as in "=> ?o attribute4 3.14, call notify". Actions run after the inferences.
+//
+//A condition may be labelled with a variable that names the matched fact, as in
+//"?f <- ?o status = "new"". The RHS can then remove the fact with "retract ?f"
+//or change its value with "modify ?f "shipped"". A condition can also be given
+//by its index in the LHS (starting at 0), as in "retract 0".
+//
+//A rule id may be followed by a salience, as in "rule urgent salience 10:";
+//rules with higher salience fire first.
+//
+//Comments run from # to the end of the line.
+package parser
+
+import "fmt"
+import "os"
+import "time"
+
+import "github.com/Alan-Shaw/goference/engine"
+
+//Parse compiles rule source into rules ready for Engine.Define
+func Parse(src string) ([]engine.Rule, error) {
+
+	rules, _, err := parse("", src)
+	return rules, err
+}
+
+//ParseFile reads and compiles a rule file
+func ParseFile(filename string) ([]engine.Rule, error) {
+
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	rules, _, err := parse(filename, string(src))
+	return rules, err
+}
+
+//Load compiles rule source and defines every rule in the engine. If a rule cannot be
+//defined, the rules defined before it are undefined again, so the source is loaded whole
+//or not at all.
+func Load(e *engine.Engine, src string) ([]engine.Rule, error) {
+	return load(e, "", src)
+}
+
+//LoadFile reads a rule file and defines every rule in the engine, as Load does
+func LoadFile(e *engine.Engine, filename string) ([]engine.Rule, error) {
+
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return load(e, filename, string(src))
+}
+
+//ParseFact compiles a single fact written as: object attribute value
+func ParseFact(src string) (engine.Fact, error) {
+
+	p, err := newParser("", src)
+	if err != nil {
+		return engine.Fact{}, err
+	}
+
+	fct := engine.Fact{}
+	fct.ObjectId, err = p.parseName("object id")
+	if err != nil {
+		return engine.Fact{}, err
+	}
+	fct.Attribute, err = p.parseName("attribute")
+	if err != nil {
+		return engine.Fact{}, err
+	}
+	if p.tok.kind == tokVariable {
+		return engine.Fact{}, p.errorf("a fact cannot contain a variable")
+	}
+	fct.Value, err = p.parseValue()
+	if err != nil {
+		return engine.Fact{}, err
+	}
+	if p.tok.kind != tokEOF {
+		return engine.Fact{}, p.errorf("unexpected %s after fact", p.tok.String())
+	}
+	return fct, nil
+}
+
+func load(e *engine.Engine, filename string, src string) ([]engine.Rule, error) {
+
+	rules, positions, err := parse(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range rules {
+		err = e.Define(r)
+		if err == nil {
+			continue
+		}
+		msg := err.Error()
+		for j := i - 1; j >= 0; j-- {
+			err = e.Undefine(rules[j].Id)
+			if err != nil {
+				msg = fmt.Sprintf("%s (and undefining %s: %s)", msg, rules[j].Id, err)
+				break
+			}
+		}
+		return nil, &Error{Pos: positions[i], Msg: msg}
+	}
+	return rules, nil
+}
+
+func parse(filename string, src string) ([]engine.Rule, []Position, error) {
+
+	p, err := newParser(filename, src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rules []engine.Rule
+	var positions []Position
+	seen := make(map[string]Position)
+
+	for p.tok.kind != tokEOF {
+		pos := p.tok.pos
+		r, err := p.parseRule()
+		if err != nil {
+			return nil, nil, err
+		}
+		if first, ok := seen[r.Id]; ok {
+			return nil, nil, &Error{Pos: pos, Msg: fmt.Sprintf("rule %s is already defined at %s", r.Id, first.String())}
+		}
+		seen[r.Id] = pos
+		rules = append(rules, r)
+		positions = append(positions, pos)
+	}
+	return rules, positions, nil
+}
+
+type parser struct {
+	lex *lexer
+	tok token //the current (lookahead) token
+
+	bound map[engine.Variable]bool //variables bound by the rule being parsed
+	labels map[engine.Variable]bool //labels of the conditions of the rule being parsed
+}
+
+func newParser(filename string, src string) (*parser, error) {
+
+	p := &parser{lex: newLexer(filename, src)}
+	err := p.advance()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *parser) advance() (err error) {
+
+	p.tok, err = p.lex.next()
+	return err
+}
+
+//peek returns the token after the current one, leaving the parser where it is
+func (p *parser) peek() (token, error) {
+
+	saved := *p.lex
+	tok, err := p.lex.next()
+	*p.lex = saved
+	return tok, err
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &Error{Pos: p.tok.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) isKeyword(word string) bool {
+	return p.tok.kind == tokIdent && p.tok.text == word
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+
+	tok := p.tok
+	if tok.kind != kind {
+		return tok, p.errorf("expected %s, found %s", kind.String(), tok.String())
+	}
+	return tok, p.advance()
+}
+
+func (p *parser) parseRule() (r engine.Rule, err error) {
+
+	if !p.isKeyword("rule") {
+		return r, p.errorf("expected rule, found %s", p.tok.String())
+	}
+	err = p.advance()
+	if err != nil {
+		return r, err
+	}
+
+	r.Id, err = p.parseName("rule id")
+	if err != nil {
+		return r, err
+	}
+	if p.isKeyword("salience") {
+		err = p.advance()
+		if err != nil {
+			return r, err
+		}
+		salience, err := p.expect(tokInt)
+		if err != nil {
+			return r, err
+		}
+		r.Salience = salience.value.(int)
+	}
+	_, err = p.expect(tokColon)
+	if err != nil {
+		return r, err
+	}
+
+	p.bound = make(map[engine.Variable]bool)
+	p.labels = make(map[engine.Variable]bool)
+
+	r.LHS, err = p.parseConditions()
+	if err != nil {
+		return r, err
+	}
+
+	_, err = p.expect(tokArrow)
+	if err != nil {
+		return r, err
+	}
+
+	for {
+		if p.isKeyword("call") {
+			err = p.advance()
+			if err != nil {
+				return r, err
+			}
+			name, err := p.parseName("action name")
+			if err != nil {
+				return r, err
+			}
+			r.Actions = append(r.Actions, engine.Action{Name: name})
+		} else if p.isKeyword("retract") {
+			err = p.advance()
+			if err != nil {
+				return r, err
+			}
+			target, err := p.parseTarget(len(r.LHS))
+			if err != nil {
+				return r, err
+			}
+			r.Retractions = append(r.Retractions, engine.Retraction{Target: target})
+		} else if p.isKeyword("modify") {
+			err = p.advance()
+			if err != nil {
+				return r, err
+			}
+			modification := engine.Modification{}
+			modification.Target, err = p.parseTarget(len(r.LHS))
+			if err != nil {
+				return r, err
+			}
+			modification.Value, err = p.parseExpression()
+			if err != nil {
+				return r, err
+			}
+			r.Modifications = append(r.Modifications, modification)
+		} else {
+			inference, err := p.parseInference()
+			if err != nil {
+				return r, err
+			}
+			r.RHS = append(r.RHS, inference)
+		}
+		if p.tok.kind != tokComma {
+			break
+		}
+		err = p.advance()
+		if err != nil {
+			return r, err
+		}
+	}
+
+	if p.tok.kind != tokEOF && !p.isKeyword("rule") {
+		return r, p.errorf("expected ',' or rule, found %s", p.tok.String())
+	}
+	return r, nil
+}
+
+//parseConditions parses a comma separated list of conditions
+func (p *parser) parseConditions() ([]engine.Condition, error) {
+
+	var list []engine.Condition
+	for {
+		condition, err := p.parseCondition()
+		if err != nil {
+			return list, err
+		}
+		list = append(list, condition)
+		if p.tok.kind != tokComma {
+			return list, nil
+		}
+		err = p.advance()
+		if err != nil {
+			return list, err
+		}
+	}
+}
+
+//parseAlternatives parses groups of conditions separated by "or", in parentheses. Only
+//the variables and labels bound by every group are bound after it.
+func (p *parser) parseAlternatives() (condition engine.Condition, err error) {
+
+	_, err = p.expect(tokLParen)
+	if err != nil {
+		return condition, err
+	}
+	bound, labels := p.bound, p.labels
+	var groupBound, groupLabels []map[engine.Variable]bool
+	for {
+		p.bound, p.labels = copySet(bound), copySet(labels)
+		group, err := p.parseConditions()
+		if err != nil {
+			return condition, err
+		}
+		condition.Any = append(condition.Any, group)
+		groupBound = append(groupBound, p.bound)
+		groupLabels = append(groupLabels, p.labels)
+		if !p.isKeyword("or") {
+			break
+		}
+		err = p.advance()
+		if err != nil {
+			return condition, err
+		}
+	}
+	p.bound, p.labels = intersection(groupBound), intersection(groupLabels)
+	_, err = p.expect(tokRParen)
+	return condition, err
+}
+
+func copySet(set map[engine.Variable]bool) map[engine.Variable]bool {
+
+	c := make(map[engine.Variable]bool, len(set))
+	for v := range set {
+		c[v] = true
+	}
+	return c
+}
+
+func intersection(sets []map[engine.Variable]bool) map[engine.Variable]bool {
+
+	result := copySet(sets[0])
+	for _, set := range sets[1:] {
+		for v := range result {
+			if !set[v] {
+				delete(result, v)
+			}
+		}
+	}
+	return result
+}
+
+//parseForAll parses "forall (" followed by a condition, a colon, the conditions that each of
+//its facts must match and ")". The variables bound within are not bound after it.
+func (p *parser) parseForAll() (condition engine.Condition, err error) {
+
+	err = p.advance() //forall
+	if err != nil {
+		return condition, err
+	}
+	condition.ForAll, _, err = p.parseInnerConditions("forall")
+	return condition, err
+}
+
+//parseNone parses a negated group, after its "not": a comma separated list of conditions in
+//parentheses. The variables bound within are not bound after it.
+func (p *parser) parseNone() (condition engine.Condition, err error) {
+
+	condition.None, _, err = p.parseInnerConditions("a negated group")
+	return condition, err
+}
+
+//parseInnerConditions parses the parenthesized conditions of a forall (whose first condition
+//is followed by a colon), an aggregate or a negated group, named by kind in errors. It returns
+//the variables bound by them, which are not bound after the parentheses.
+func (p *parser) parseInnerConditions(kind string) (conditions []engine.Condition, inner map[engine.Variable]bool, err error) {
+
+	_, err = p.expect(tokLParen)
+	if err != nil {
+		return nil, nil, err
+	}
+	bound, labels := p.bound, p.labels
+	p.bound, p.labels = copySet(bound), copySet(labels)
+	for {
+		pos := p.tok.pos
+		c, err := p.parseCondition()
+		if err != nil {
+			return nil, nil, err
+		}
+		if c.Label != "" || c.Any != nil || c.ForAll != nil || c.Aggregate != nil || c.None != nil {
+			return nil, nil, &Error{Pos: pos, Msg: fmt.Sprintf("a condition within %s cannot have a label, alternatives, a forall, an aggregate or a negated group of its own", kind)}
+		}
+		if len(conditions) == 0 && c.NotExists {
+			return nil, nil, &Error{Pos: pos, Msg: fmt.Sprintf("the first condition of %s cannot be negated", kind)}
+		}
+		conditions = append(conditions, c)
+		if len(conditions) == 1 && kind == "forall" {
+			_, err = p.expect(tokColon)
+		} else if p.tok.kind == tokComma {
+			err = p.advance()
+		} else {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if p.isKeyword("or") {
+		return nil, nil, p.errorf("alternatives cannot be written within %s", kind)
+	}
+	inner = p.bound
+	p.bound, p.labels = bound, labels
+	_, err = p.expect(tokRParen)
+	return conditions, inner, err
+}
+
+//the functions of aggregates
+var aggregates = map[string]bool{"count": true, "sum": true, "min": true, "max": true, "average": true}
+
+//aggregateAhead reports whether an aggregate starts at the current token: the name of a
+//function followed by a variable or a parenthesis (or the name is an object id)
+func (p *parser) aggregateAhead() (bool, error) {
+
+	if p.tok.kind != tokIdent || !aggregates[p.tok.text] {
+		return false, nil
+	}
+	next, err := p.peek()
+	if err != nil {
+		return false, err
+	}
+	return next.kind == tokLParen || next.kind == tokVariable, nil
+}
+
+//parseAggregate parses a function, the variable whose values it takes (but for count), its
+//conditions in parentheses, an optional test of the result and an optional "as" with the
+//variable bound to the result. The variables bound within the parentheses are not bound after it.
+func (p *parser) parseAggregate() (condition engine.Condition, err error) {
+
+	a := &engine.Aggregate{Function: p.tok.text}
+	condition.Aggregate = a
+	err = p.advance()
+	if err != nil {
+		return condition, err
+	}
+	of := p.tok
+	if of.kind == tokVariable {
+		a.Of = engine.Variable(of.text)
+		err = p.advance()
+		if err != nil {
+			return condition, err
+		}
+	}
+	var inner map[engine.Variable]bool
+	a.Conditions, inner, err = p.parseInnerConditions("an aggregate")
+	if err != nil {
+		return condition, err
+	}
+	if a.Of != "" && !inner[a.Of] {
+		return condition, &Error{Pos: of.pos, Msg: fmt.Sprintf("?%s is not bound by the conditions of the aggregate", of.text)}
+	}
+
+	if p.tok.kind == tokOperator {
+		condition.Comparator, err = p.parseOperator()
+		if err != nil {
+			return condition, err
+		}
+		if p.tok.kind == tokVariable {
+			if p.labels[engine.Variable(p.tok.text)] {
+				return condition, p.errorf("?%s is the label of a condition", p.tok.text)
+			}
+			condition.Value, err = p.parseVariable()
+		} else {
+			condition.Value, err = p.parseValue()
+		}
+		if err != nil {
+			return condition, err
+		}
+	}
+	if p.isKeyword("as") {
+		err = p.advance()
+		if err != nil {
+			return condition, err
+		}
+		if p.tok.kind != tokVariable {
+			return condition, p.errorf("expected variable, found %s", p.tok.String())
+		}
+		v := engine.Variable(p.tok.text)
+		if inner[v] || p.labels[v] {
+			return condition, p.errorf("?%s is already used in this rule", p.tok.text)
+		}
+		a.Into = v
+		p.bound[v] = true
+		err = p.advance()
+	}
+	return condition, err
+}
+
+func (p *parser) parseCondition() (condition engine.Condition, err error) {
+
+	if p.tok.kind == tokLParen {
+		return p.parseAlternatives()
+	}
+	if p.isKeyword("forall") {
+		//look ahead for the parenthesis, or forall is an object id
+		next, err := p.peek()
+		if err != nil {
+			return condition, err
+		}
+		if next.kind == tokLParen {
+			return p.parseForAll()
+		}
+	}
+	aggregate, err := p.aggregateAhead()
+	if err != nil {
+		return condition, err
+	}
+	if aggregate {
+		return p.parseAggregate()
+	}
+
+	if p.tok.kind == tokVariable {
+		//look ahead for a label
+		next, err := p.peek()
+		if err != nil {
+			return condition, err
+		}
+		if next.kind == tokLabel {
+			label := engine.Variable(p.tok.text)
+			if p.labels[label] || p.bound[label] {
+				return condition, p.errorf("?%s is already used in this rule", p.tok.text)
+			}
+			condition.Label = label
+			p.labels[label] = true
+			err = p.advance()
+			if err == nil {
+				err = p.advance()
+			}
+			if err != nil {
+				return condition, err
+			}
+		}
+	}
+
+	if p.isKeyword("not") {
+		if condition.Label != "" {
+			return condition, p.errorf("a negated condition cannot be labelled")
+		}
+		condition.NotExists = true
+		err = p.advance()
+		if err != nil {
+			return condition, err
+		}
+	}
+	if p.tok.kind == tokLParen {
+		if condition.NotExists {
+			return p.parseNone()
+		}
+		return condition, p.errorf("alternatives cannot be labelled")
+	}
+	aggregate, err = p.aggregateAhead()
+	if err != nil {
+		return condition, err
+	}
+	if aggregate {
+		return condition, p.errorf("an aggregate cannot be labelled or negated")
+	}
+
+	switch p.tok.kind {
+	case tokVariable:
+		if p.labels[engine.Variable(p.tok.text)] {
+			return condition, p.errorf("?%s is the label of a condition", p.tok.text)
+		}
+		condition.ObjectId = engine.Variable(p.tok.text)
+		if !condition.NotExists {
+			p.bound[engine.Variable(p.tok.text)] = true
+		}
+		err = p.advance()
+	case tokWildcard:
+		condition.ObjectId = ""
+		err = p.advance()
+	default:
+		condition.ObjectId, err = p.parseName("object id")
+	}
+	if err != nil {
+		return condition, err
+	}
+
+	condition.Attribute, err = p.parseName("attribute")
+	if err != nil {
+		return condition, err
+	}
+
+	condition.Comparator, err = p.parseOperator()
+	if err != nil {
+		return condition, err
+	}
+
+	if p.tok.kind == tokVariable {
+		if p.labels[engine.Variable(p.tok.text)] {
+			return condition, p.errorf("?%s is the label of a condition", p.tok.text)
+		}
+		if condition.Comparator != engine.EQ {
+			//a relational test, against the value bound by an earlier condition
+			condition.Value, err = p.parseVariable()
+			return condition, err
+		}
+		condition.Value = engine.Variable(p.tok.text)
+		if !condition.NotExists {
+			p.bound[engine.Variable(p.tok.text)] = true
+		}
+		return condition, p.advance()
+	}
+
+	condition.Value, err = p.parseValue()
+	return condition, err
+}
+
+func (p *parser) parseInference() (inference engine.Inference, err error) {
+
+	switch p.tok.kind {
+	case tokVariable, tokLParen:
+		inference.ObjectId, err = p.parseExpression()
+	default:
+		var name string
+		name, err = p.parseName("object id")
+		if err == nil && p.tok.kind == tokLParen {
+			inference.ObjectId, err = p.parseCall(name)
+		} else {
+			inference.ObjectId = name
+		}
+	}
+	if err != nil {
+		return inference, err
+	}
+
+	inference.Attribute, err = p.parseName("attribute")
+	if err != nil {
+		return inference, err
+	}
+
+	inference.Value, err = p.parseExpression()
+	return inference, err
+}
+
+//the functions of the arithmetic operators, which take two arguments
+var arithmetic = map[string]string{"+": "add", "-": "sub", "*": "mul", "/": "div", "%": "mod"}
+
+//parseExpression accepts a value, a bound variable or an expression built from them with
+//arithmetic operators (* / and % before + and -), unary minus, parentheses and function calls
+func (p *parser) parseExpression() (interface{}, error) {
+
+	left, err := p.parseProduct()
+	for err == nil && p.tok.kind == tokArith && (p.tok.text == "+" || p.tok.text == "-") {
+		function := arithmetic[p.tok.text]
+		err = p.advance()
+		if err != nil {
+			return nil, err
+		}
+		var right interface{}
+		right, err = p.parseProduct()
+		left = engine.Call(function, left, right)
+	}
+	return left, err
+}
+
+func (p *parser) parseProduct() (interface{}, error) {
+
+	left, err := p.parseUnary()
+	for err == nil && (p.tok.kind == tokWildcard || (p.tok.kind == tokArith && (p.tok.text == "/" || p.tok.text == "%"))) {
+		function := arithmetic[p.tok.text]
+		err = p.advance()
+		if err != nil {
+			return nil, err
+		}
+		var right interface{}
+		right, err = p.parseUnary()
+		left = engine.Call(function, left, right)
+	}
+	return left, err
+}
+
+func (p *parser) parseUnary() (interface{}, error) {
+
+	if p.tok.kind == tokArith && p.tok.text == "-" {
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return engine.Call("neg", operand), nil
+	}
+
+	switch p.tok.kind {
+	case tokVariable:
+		return p.parseVariable()
+	case tokLParen:
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(tokRParen)
+		return value, err
+	case tokIdent:
+		switch p.tok.text {
+		case "true", "false", "null", "time", "duration":
+			return p.parseValue()
+		}
+		name := p.tok.text
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokLParen {
+			return nil, p.errorf("expected '(' after function name %s", name)
+		}
+		return p.parseCall(name)
+	}
+	return p.parseValue()
+}
+
+//parseCall accepts the parenthesized arguments of a function
+func (p *parser) parseCall(name string) (interface{}, error) {
+
+	_, err := p.expect(tokLParen)
+	if err != nil {
+		return nil, err
+	}
+	call := engine.Expression{Function: name}
+	for p.tok.kind != tokRParen {
+		arg, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+		if p.tok.kind != tokComma {
+			break
+		}
+		err = p.advance()
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = p.expect(tokRParen)
+	return call, err
+}
+
+//parseTarget accepts the label or the index of one of the n conditions
+func (p *parser) parseTarget(n int) (interface{}, error) {
+
+	switch p.tok.kind {
+	case tokVariable:
+		label := engine.Variable(p.tok.text)
+		if !p.labels[label] {
+			return nil, p.errorf("?%s is not the label of a condition", p.tok.text)
+		}
+		return label, p.advance()
+	case tokInt:
+		i := p.tok.value.(int)
+		if i < 0 || i >= n {
+			return nil, p.errorf("there is no condition %d", i)
+		}
+		return i, p.advance()
+	}
+	return nil, p.errorf("expected label or condition index, found %s", p.tok.String())
+}
+
+//parseVariable accepts a variable that has already been bound by a condition
+func (p *parser) parseVariable() (engine.Variable, error) {
+
+	v := engine.Variable(p.tok.text)
+	if !p.bound[v] {
+		return v, p.errorf("variable ?%s is not bound by any condition", p.tok.text)
+	}
+	return v, p.advance()
+}
+
+//parseName accepts a bare word, a quoted string or a number (as written, so 42 is "42")
+func (p *parser) parseName(what string) (string, error) {
+
+	switch p.tok.kind {
+	case tokIdent, tokString, tokInt, tokFloat:
+	default:
+		return "", p.errorf("expected %s, found %s", what, p.tok.String())
+	}
+	name := p.tok.text
+	return name, p.advance()
+}
+
+func (p *parser) parseOperator() (engine.Operator, error) {
+
+	var op engine.Operator
+
+	if p.tok.kind != tokOperator {
+		return op, p.errorf("expected operator, found %s", p.tok.String())
+	}
+	switch p.tok.text {
+	case "=", "==":
+		op = engine.EQ
+	case "!=", "<>":
+		op = engine.NE
+	case ">":
+		op = engine.GT
+	case ">=":
+		op = engine.GE
+	case "<":
+		op = engine.LT
+	case "<=":
+		op = engine.LE
+	}
+	return op, p.advance()
+}
+
+func (p *parser) parseValue() (interface{}, error) {
+
+	var value interface{}
+
+	switch p.tok.kind {
+	case tokString:
+		value = p.tok.text
+	case tokInt, tokFloat:
+		value = p.tok.value
+	case tokIdent:
+		switch p.tok.text {
+		case "true":
+			value = true
+		case "false":
+			value = false
+		case "null":
+			value = engine.Null
+		case "time", "duration":
+			return p.parseTime()
+		default:
+			return nil, p.errorf("expected value, found %s", p.tok.String())
+		}
+	default:
+		return nil, p.errorf("expected value, found %s", p.tok.String())
+	}
+	return value, p.advance()
+}
+
+//parseTime accepts a time (in RFC 3339 format) or a duration (as accepted by
+//time.ParseDuration) written as a quoted string after its keyword
+func (p *parser) parseTime() (interface{}, error) {
+
+	kind := p.tok.text
+	err := p.advance()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokString {
+		return nil, p.errorf("expected quoted %s, found %s", kind, p.tok.String())
+	}
+	var value interface{}
+	if kind == "time" {
+		value, err = time.Parse(time.RFC3339Nano, p.tok.text)
+	} else {
+		value, err = time.ParseDuration(p.tok.text)
+	}
+	if err != nil {
+		return nil, p.errorf("bad %s %q: %s", kind, p.tok.text, err)
+	}
+	return value, p.advance()
+}
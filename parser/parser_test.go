@@ -0,0 +1,393 @@
+package parser
+
+import "reflect"
+import "testing"
+import "time"
+
+import "github.com/Alan-Shaw/goference/engine"
+
+func TestParse(t *testing.T) {
+
+	src := `
+# the rule from the README
+rule simple-rule:
+	?o attribute1 = "value1",
+	not object2 attribute2 > 0.0,
+	?o attribute3 < 10
+=>
+	?o attribute4 3.14
+
+rule chain salience -5: ?a link == ?b, ?b link != "end", * kind <> -2, "odd object" size >= 1.5e3, x y <= 0 => ?a reaches ?b, call notify, fixed marker "yes"
+
+rule ship:
+	?f <- ?o status = "new",
+	?o paid <-1
+=>
+	modify ?f "shipped", retract 1, modify 1 ?o
+
+rule fever: threshold fever = ?limit, ?p temperature > ?limit => ?p feverish ?limit
+
+rule price:
+	?o price = ?p, ?o first = ?a, ?f <- ?o stock = ?n
+=>
+	?o gross ?p * 1.2 + 1,
+	?o net (?p - 2) / -?n % 3,
+	concat("person:", lower(?a)) name concat(?a, " ", upper("x")),
+	modify ?f ?n - 1
+
+rule flu:
+	?p fever = true,
+	(?f <- ?p cough = true or ?p sneeze = true, (?f <- ?p tired = true or ?f <- ?p weak = true))
+=>
+	?p suspect "flu", retract ?f
+
+rule cleared:
+	?p kind = "patient",
+	forall (?r patient = ?p: ?r status = "normal", ?r checked = true),
+	forall enabled = true
+=>
+	?p cleared true
+
+rule large:
+	?o limit = ?limit,
+	sum ?v (?i order = ?o, ?i price = ?v, not ?i cancelled = true) > ?limit as ?total,
+	not ?o approved-by = ?a,
+	not ?o discount > ?total,
+	count (?s symptom-of = ?o),
+	count x = 1
+=>
+	?o large ?total
+
+rule chase:
+	?o kind = "order",
+	not (?s shipment-of = ?o, ?r receipt-for = ?s, ?r signed = true)
+=>
+	?o chase true
+
+rule 7: 42 age = ?n, ?p 1.5 = -3 => 42 next ?n
+
+rule due: ?o due < time "2024-01-01T12:00:00Z", ?o late = false => ?o overdue time "2024-01-01T12:00:00.5+01:00", ?o grace duration "1h30m"
+`
+	var o engine.Variable = "o"
+	var a engine.Variable = "a"
+	var b engine.Variable = "b"
+	var f engine.Variable = "f"
+	var p engine.Variable = "p"
+	var limit engine.Variable = "limit"
+	var n engine.Variable = "n"
+
+	expected := []engine.Rule{
+		engine.Rule{
+			Id: "simple-rule",
+			LHS: []engine.Condition{
+				engine.Condition{ObjectId: o, Attribute: "attribute1", Comparator: engine.EQ, Value: "value1"},
+				engine.Condition{NotExists: true, ObjectId: "object2", Attribute: "attribute2", Comparator: engine.GT, Value: 0.0},
+				engine.Condition{ObjectId: o, Attribute: "attribute3", Comparator: engine.LT, Value: 10},
+			},
+			RHS: []engine.Inference{
+				engine.Inference{ObjectId: o, Attribute: "attribute4", Value: 3.14},
+			},
+		},
+		engine.Rule{
+			Id:       "chain",
+			Salience: -5,
+			LHS: []engine.Condition{
+				engine.Condition{ObjectId: a, Attribute: "link", Comparator: engine.EQ, Value: b},
+				engine.Condition{ObjectId: b, Attribute: "link", Comparator: engine.NE, Value: "end"},
+				engine.Condition{ObjectId: "", Attribute: "kind", Comparator: engine.NE, Value: -2},
+				engine.Condition{ObjectId: "odd object", Attribute: "size", Comparator: engine.GE, Value: 1500.0},
+				engine.Condition{ObjectId: "x", Attribute: "y", Comparator: engine.LE, Value: 0},
+			},
+			RHS: []engine.Inference{
+				engine.Inference{ObjectId: a, Attribute: "reaches", Value: b},
+				engine.Inference{ObjectId: "fixed", Attribute: "marker", Value: "yes"},
+			},
+			Actions: []engine.Action{engine.Action{Name: "notify"}},
+		},
+		engine.Rule{
+			Id: "ship",
+			LHS: []engine.Condition{
+				engine.Condition{Label: f, ObjectId: o, Attribute: "status", Comparator: engine.EQ, Value: "new"},
+				engine.Condition{ObjectId: o, Attribute: "paid", Comparator: engine.LT, Value: -1},
+			},
+			Retractions:   []engine.Retraction{engine.Retraction{Target: 1}},
+			Modifications: []engine.Modification{
+				engine.Modification{Target: f, Value: "shipped"},
+				engine.Modification{Target: 1, Value: o},
+			},
+		},
+		engine.Rule{
+			Id: "fever",
+			LHS: []engine.Condition{
+				engine.Condition{ObjectId: "threshold", Attribute: "fever", Comparator: engine.EQ, Value: limit},
+				engine.Condition{ObjectId: p, Attribute: "temperature", Comparator: engine.GT, Value: limit},
+			},
+			RHS: []engine.Inference{engine.Inference{ObjectId: p, Attribute: "feverish", Value: limit}},
+		},
+		engine.Rule{
+			Id: "price",
+			LHS: []engine.Condition{
+				engine.Condition{ObjectId: o, Attribute: "price", Comparator: engine.EQ, Value: p},
+				engine.Condition{ObjectId: o, Attribute: "first", Comparator: engine.EQ, Value: a},
+				engine.Condition{Label: f, ObjectId: o, Attribute: "stock", Comparator: engine.EQ, Value: n},
+			},
+			RHS: []engine.Inference{
+				engine.Inference{ObjectId: o, Attribute: "gross", Value: engine.Call("add", engine.Call("mul", p, 1.2), 1)},
+				engine.Inference{ObjectId: o, Attribute: "net", Value: engine.Call("mod", engine.Call("div", engine.Call("sub", p, 2), engine.Call("neg", n)), 3)},
+				engine.Inference{
+					ObjectId:  engine.Call("concat", "person:", engine.Call("lower", a)),
+					Attribute: "name",
+					Value:     engine.Call("concat", a, " ", engine.Call("upper", "x")),
+				},
+			},
+			Modifications: []engine.Modification{engine.Modification{Target: f, Value: engine.Call("sub", n, 1)}},
+		},
+		engine.Rule{
+			Id: "flu",
+			LHS: []engine.Condition{
+				engine.Condition{ObjectId: p, Attribute: "fever", Comparator: engine.EQ, Value: true},
+				engine.Condition{Any: [][]engine.Condition{
+					[]engine.Condition{engine.Condition{Label: f, ObjectId: p, Attribute: "cough", Comparator: engine.EQ, Value: true}},
+					[]engine.Condition{
+						engine.Condition{ObjectId: p, Attribute: "sneeze", Comparator: engine.EQ, Value: true},
+						engine.Condition{Any: [][]engine.Condition{
+							[]engine.Condition{engine.Condition{Label: f, ObjectId: p, Attribute: "tired", Comparator: engine.EQ, Value: true}},
+							[]engine.Condition{engine.Condition{Label: f, ObjectId: p, Attribute: "weak", Comparator: engine.EQ, Value: true}},
+						}},
+					},
+				}},
+			},
+			RHS:         []engine.Inference{engine.Inference{ObjectId: p, Attribute: "suspect", Value: "flu"}},
+			Retractions: []engine.Retraction{engine.Retraction{Target: f}},
+		},
+		engine.Rule{
+			Id: "cleared",
+			LHS: []engine.Condition{
+				engine.Condition{ObjectId: p, Attribute: "kind", Comparator: engine.EQ, Value: "patient"},
+				engine.Condition{ForAll: []engine.Condition{
+					engine.Condition{ObjectId: engine.Variable("r"), Attribute: "patient", Comparator: engine.EQ, Value: p},
+					engine.Condition{ObjectId: engine.Variable("r"), Attribute: "status", Comparator: engine.EQ, Value: "normal"},
+					engine.Condition{ObjectId: engine.Variable("r"), Attribute: "checked", Comparator: engine.EQ, Value: true},
+				}},
+				engine.Condition{ObjectId: "forall", Attribute: "enabled", Comparator: engine.EQ, Value: true},
+			},
+			RHS: []engine.Inference{engine.Inference{ObjectId: p, Attribute: "cleared", Value: true}},
+		},
+		engine.Rule{
+			Id: "large",
+			LHS: []engine.Condition{
+				engine.Condition{ObjectId: o, Attribute: "limit", Comparator: engine.EQ, Value: limit},
+				engine.Condition{Comparator: engine.GT, Value: limit, Aggregate: &engine.Aggregate{Function: "sum", Of: engine.Variable("v"), Into: engine.Variable("total"), Conditions: []engine.Condition{
+					engine.Condition{ObjectId: engine.Variable("i"), Attribute: "order", Comparator: engine.EQ, Value: o},
+					engine.Condition{ObjectId: engine.Variable("i"), Attribute: "price", Comparator: engine.EQ, Value: engine.Variable("v")},
+					engine.Condition{NotExists: true, ObjectId: engine.Variable("i"), Attribute: "cancelled", Comparator: engine.EQ, Value: true},
+				}}},
+				engine.Condition{NotExists: true, ObjectId: o, Attribute: "approved-by", Comparator: engine.EQ, Value: a},
+				engine.Condition{NotExists: true, ObjectId: o, Attribute: "discount", Comparator: engine.GT, Value: engine.Variable("total")},
+				engine.Condition{Aggregate: &engine.Aggregate{Function: "count", Conditions: []engine.Condition{
+					engine.Condition{ObjectId: engine.Variable("s"), Attribute: "symptom-of", Comparator: engine.EQ, Value: o},
+				}}},
+				engine.Condition{ObjectId: "count", Attribute: "x", Comparator: engine.EQ, Value: 1},
+			},
+			RHS: []engine.Inference{engine.Inference{ObjectId: o, Attribute: "large", Value: engine.Variable("total")}},
+		},
+		engine.Rule{
+			Id: "chase",
+			LHS: []engine.Condition{
+				engine.Condition{ObjectId: o, Attribute: "kind", Comparator: engine.EQ, Value: "order"},
+				engine.Condition{None: []engine.Condition{
+					engine.Condition{ObjectId: engine.Variable("s"), Attribute: "shipment-of", Comparator: engine.EQ, Value: o},
+					engine.Condition{ObjectId: engine.Variable("r"), Attribute: "receipt-for", Comparator: engine.EQ, Value: engine.Variable("s")},
+					engine.Condition{ObjectId: engine.Variable("r"), Attribute: "signed", Comparator: engine.EQ, Value: true},
+				}},
+			},
+			RHS: []engine.Inference{engine.Inference{ObjectId: o, Attribute: "chase", Value: true}},
+		},
+		engine.Rule{
+			Id: "7",
+			LHS: []engine.Condition{
+				engine.Condition{ObjectId: "42", Attribute: "age", Comparator: engine.EQ, Value: n},
+				engine.Condition{ObjectId: p, Attribute: "1.5", Comparator: engine.EQ, Value: -3},
+			},
+			RHS: []engine.Inference{engine.Inference{ObjectId: "42", Attribute: "next", Value: n}},
+		},
+		engine.Rule{
+			Id: "due",
+			LHS: []engine.Condition{
+				engine.Condition{ObjectId: o, Attribute: "due", Comparator: engine.LT, Value: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)},
+				engine.Condition{ObjectId: o, Attribute: "late", Comparator: engine.EQ, Value: false},
+			},
+			RHS: []engine.Inference{
+				engine.Inference{ObjectId: o, Attribute: "overdue", Value: time.Date(2024, 1, 1, 12, 0, 0, 5e8, time.FixedZone("", 3600))},
+				engine.Inference{ObjectId: o, Attribute: "grace", Value: 90 * time.Minute},
+			},
+		},
+	}
+
+	rules, err := Parse(src)
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Parse: expected %v, got %v", expected, rules)
+	}
+
+	//formatting and parsing again must give back the same rules
+	for _, r := range rules {
+		again, err := Parse(Format(r))
+		if err != nil {
+			t.Errorf("Format of %s does not parse: %s\n%s", r.Id, err, Format(r))
+			continue
+		}
+		if len(again) != 1 || !reflect.DeepEqual(again[0], r) {
+			t.Errorf("Format of %s does not round trip: %s", r.Id, Format(r))
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+
+	tests := []struct {
+		src    string
+		line   int
+		column int
+	}{
+		{`rule r1 ?o a = 1 => ?o b 2`, 1, 9},
+		{"rule r1:\n\t?o a ~ 1 => ?o b 2", 2, 7},
+		{`rule r1: ?o a = 1 => ?x b 2`, 1, 22},
+		{`rule r1: ?o a > ?v => ?o b 2`, 1, 17},
+		{`rule r1: not ?o a = 1 => ?o b 2`, 1, 26},
+		{`rule r1: ?o a = "open => ?o b 2`, 1, 17},
+		{`rule r1: ?o a = 1 => ?o b 2 rule r1: ?o a = 1 => ?o b 2`, 1, 29},
+		{`rule r1: ?o a = 1 ?o b 2`, 1, 19},
+		{`?o a = 1 => ?o b 2`, 1, 1},
+		{`rule r1 salience high: ?o a = 1 => ?o b 2`, 1, 18},
+		{`rule r1: ?o a = 1 => retract ?o`, 1, 30},
+		{`rule r1: ?o a = 1 => retract 1`, 1, 30},
+		{`rule r1: ?f <- not x a = 1 => retract 0`, 1, 16},
+		{`rule r1: ?f <- ?o a = 1, ?f b = 2 => retract ?f`, 1, 26},
+		{`rule r1: ?o a = ?v => ?o b (?v + 1`, 1, 35},
+		{`rule r1: ?o a = ?v => ?o b twice ?v`, 1, 34},
+		{`rule r1: ?o a = ?v => ?o b ?v * ?w`, 1, 33},
+		{`rule r1: ?o a = ?v => ?o b ?v +`, 1, 32},
+		{`rule r1: (?o a = 1 or ?x b = 2) => ?x c 3`, 1, 36},
+		{`rule r1: not (?o a = 1 or ?o b = 2) => x b 2`, 1, 24},
+		{`rule r1: ?o a = 1, not (not ?s b = ?o) => ?o c 2`, 1, 25},
+		{`rule r1: ?o a = 1, not (?s b = ?o) => ?s c 2`, 1, 39},
+		{`rule r1: (?o a = 1 or ?o b = 2 => ?o c 3`, 1, 32},
+		{`rule r1: (?f <- ?o a = 1 or ?o b = 2) => retract ?f`, 1, 50},
+		{`rule r1: ?p a = 1, forall (?r b = ?p) => ?p c 2`, 1, 37},
+		{`rule r1: ?p a = 1, forall (?r b = ?p: ?r c = 1) => ?r d 2`, 1, 52},
+		{`rule r1: ?p a = 1, forall (?r b = ?p: ?f <- ?r c = 1) => ?p d 2`, 1, 39},
+		{`rule r1: ?p a = 1, count (?s b = ?p) as ?s => ?p c ?s`, 1, 41},
+		{`rule r1: ?p a = 1, sum ?v (?s b = ?p) > 3 => ?p c 2`, 1, 24},
+		{`rule r1: ?p a = 1, count (?s b = ?p) > ?n => ?p c 2`, 1, 40},
+		{`rule r1: ?p a = 1, not count (?s b = ?p) => ?p c 2`, 1, 24},
+		{`rule r1: ?p a = 1, count (not x b = 1) => ?p c 2`, 1, 27},
+		{`rule r1: ?p a = 1, count (?s b = ?p) as 3 => ?p c 2`, 1, 41},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.src)
+		if err == nil {
+			t.Errorf("Test %q: expected an error", test.src)
+			continue
+		}
+		perr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("Test %q: expected *Error, got %T", test.src, err)
+			continue
+		}
+		if perr.Pos.Line != test.line || perr.Pos.Column != test.column {
+			t.Errorf("Test %q: expected error at %d:%d, got %s", test.src, test.line, test.column, perr)
+		}
+	}
+}
+
+func TestParseFact(t *testing.T) {
+
+	tests := []struct {
+		src      string
+		expected engine.Fact
+	}{
+		{`123A test "some value"`, engine.Fact{ObjectId: "123A", Attribute: "test", Value: "some value"}},
+		{`"set 1" testAttr1 18.123`, engine.Fact{ObjectId: "set 1", Attribute: "testAttr1", Value: 18.123}},
+		{`set1obj6 testAttr6 42`, engine.Fact{ObjectId: "set1obj6", Attribute: "testAttr6", Value: 42}},
+		{`order1 paid true`, engine.Fact{ObjectId: "order1", Attribute: "paid", Value: true}},
+		{`order1 "true" false`, engine.Fact{ObjectId: "order1", Attribute: "true", Value: false}},
+		{`order1 note null`, engine.Fact{ObjectId: "order1", Attribute: "note", Value: engine.Null}},
+		{`42 age 10`, engine.Fact{ObjectId: "42", Attribute: "age", Value: 10}},
+		{`-7 1.5 "x"`, engine.Fact{ObjectId: "-7", Attribute: "1.5", Value: "x"}},
+		{`job due time "2024-06-30T23:59:59.25Z"`, engine.Fact{ObjectId: "job", Attribute: "due", Value: time.Date(2024, 6, 30, 23, 59, 59, 25e7, time.UTC)}},
+		{`job timeout duration "1m30s"`, engine.Fact{ObjectId: "job", Attribute: "timeout", Value: 90 * time.Second}},
+		{`time duration duration "-2ms"`, engine.Fact{ObjectId: "time", Attribute: "duration", Value: -2 * time.Millisecond}},
+	}
+
+	for _, test := range tests {
+		fct, err := ParseFact(test.src)
+		if err != nil {
+			t.Errorf("Test %q: %s", test.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(fct, test.expected) {
+			t.Errorf("Test %q: expected %v, got %v", test.src, test.expected, fct)
+		}
+		if FormatFact(fct) != FormatFact(test.expected) {
+			t.Errorf("Test %q: FormatFact mismatch", test.src)
+		}
+		again, err := ParseFact(FormatFact(fct))
+		if err != nil || !reflect.DeepEqual(again, fct) {
+			t.Errorf("Test %q: FormatFact gives %s, which does not round trip", test.src, FormatFact(fct))
+		}
+	}
+
+	for _, src := range []string{`a b`, `a b ?v`, `a b 1 2`, `a b yes`, `a b time 5`, `a b time "yesterday"`, `a b duration "1 hour"`} {
+		_, err := ParseFact(src)
+		if err == nil {
+			t.Errorf("Test %q: expected an error", src)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+
+	testEngine := engine.Engine{}
+
+	_, err := Load(&testEngine, `
+rule adult: ?p age >= 18, not * curfew = "on" => ?p may-drive "true"
+`)
+	if err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+
+	for _, src := range []string{`ann age 21`, `bob age 12`} {
+		fct, err := ParseFact(src)
+		if err != nil {
+			t.Fatalf("ParseFact failed: %s", err)
+		}
+		err = testEngine.Assert(fct)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+	}
+
+	result, err := testEngine.GetInferences("", "may-drive")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(result) != 1 || result[0].ObjectId != "ann" {
+		t.Errorf("Test Load: expected ann may drive, got %v", result)
+	}
+
+	//a rule that cannot be defined takes the rules before it along
+	rules, err := Load(&testEngine, `
+rule senior: ?p age >= 65 => ?p retired "true"
+rule adult: ?p age >= 21 => ?p may-drink "true"
+`)
+	if err == nil || err.Error() != "3:1: Rule adult is already defined" || rules != nil {
+		t.Errorf("Test Load: expected adult to be rejected, got %v %v", rules, err)
+	}
+	if defined := testEngine.Rules(); len(defined) != 1 || defined[0].Id != "adult" {
+		t.Errorf("Test Load: expected adult only, got %v", defined)
+	}
+}
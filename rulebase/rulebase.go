@@ -0,0 +1,763 @@
+//Package rulebase reads and writes goference rules as JSON or YAML, so that a rule base can
+//be kept in files and edited by other programs. A document holds a version and a list of
+//rules:
+//
+//	{
+//	  "version": 1,
+//	  "rules": [
+//	    {
+//	      "id": "ship",
+//	      "salience": 10,
+//	      "if": [
+//	        {"label": "f", "object": {"var": "o"}, "attribute": "status", "op": "EQ", "value": "new"},
+//	        {"not": true, "object": "", "attribute": "halt", "op": "EQ", "value": "yes"},
+//	        {"object": {"var": "o"}, "attribute": "weight", "op": "LT", "value": 2.5}
+//	      ],
+//	      "then": [
+//	        {"object": {"var": "o"}, "attribute": "shipped", "value": 1}
+//	      ],
+//	      "actions": ["notify"],
+//	      "modify": [{"target": {"var": "f"}, "value": "shipped"}]
+//	    }
+//	  ]
+//	}
+//
+//The fields of a rule are those of engine.Rule: "if" holds the conditions (LHS), "then" the
+//inferences (RHS), "actions" the names of registered actions, "retract" the targets of
+//retractions and "modify" the modifications. Only "id" and "if" are required. A condition
+//has "object", "attribute", "op" (EQ, NE, GT, GE, LT or LE) and "value", and optionally
+//"not" (for a negated condition) and "label". An object of "" accepts any object id.
+//A condition may instead be a set of alternatives, {"any": [[...], [...]]}, which holds
+//when all of the conditions of any one of its lists do (see engine.Condition.Any), and a
+//forall condition is written {"forall": [...]}, with the condition whose every fact must
+//match the rest first, and a negated group, which holds when no facts match all of its
+//conditions together, {"none": [...]}. None of these has other fields. An aggregate is written
+//{"aggregate": {"function": "sum", "of": "v", "into": "total", "if": [...]}, "op": "GT", "value": 1000},
+//where "of" (unused by count) and "into" (optional) are the names of variables and "op" and
+//"value" test the result (see engine.Aggregate); without "value" any result will do.
+//
+//Terms (objects, values and targets) are typed by their form, so that they are read back
+//exactly as they were written: a string is a string, {"var": "name"} is a Variable, and
+//a number is an int unless it is written with a decimal point or an exponent, in which
+//case it is a float64. Other integer and float types, and unsigned integers, are written as
+//int and float64 (which the engine compares with them by value).
+//true and false are bools, {"time": "2006-01-02T15:04:05Z"} is a time.Time (in RFC 3339
+//format, read back in UTC or at a fixed offset), {"duration": "1h30m"} is a time.Duration
+//and {"null": true} is engine.Null. An engine.Expression is written {"call": "mul",
+//"args": [{"var": "price"}, 1.2]}. A null term is a nil value, as in a condition that
+//accepts any value.
+//A target is the index of a condition (an int) or a label (a Variable).
+//
+//YAML documents have the same structure; YAML strings that look like numbers must be quoted.
+package rulebase
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "io"
+import "math"
+import "os"
+import "path/filepath"
+import "reflect"
+import "strconv"
+import "strings"
+import "time"
+
+import "gopkg.in/yaml.v3"
+
+import "github.com/Alan-Shaw/goference/engine"
+
+//Version is the version of the document format written, and the only one read
+const Version = 1
+
+type document struct {
+	Version int    `json:"version" yaml:"version"`
+	Rules   []rule `json:"rules" yaml:"rules"`
+}
+
+type rule struct {
+	Id            string         `json:"id" yaml:"id"`
+	Salience      int            `json:"salience,omitempty" yaml:"salience,omitempty"`
+	LHS           []condition    `json:"if" yaml:"if"`
+	RHS           []inference    `json:"then,omitempty" yaml:"then,omitempty"`
+	Actions       []string       `json:"actions,omitempty" yaml:"actions,omitempty"`
+	Retractions   []term         `json:"retract,omitempty" yaml:"retract,omitempty"`
+	Modifications []modification `json:"modify,omitempty" yaml:"modify,omitempty"`
+}
+
+type condition struct {
+	Label     string        `json:"label,omitempty" yaml:"label,omitempty"`
+	NotExists bool          `json:"not,omitempty" yaml:"not,omitempty"`
+	ObjectId  term          `json:"object" yaml:"object"`
+	Attribute string        `json:"attribute" yaml:"attribute"`
+	Operator  string        `json:"op" yaml:"op"`
+	Value     term          `json:"value" yaml:"value"`
+	Any       [][]condition `json:"any,omitempty" yaml:"any,omitempty"`
+	ForAll    []condition   `json:"forall,omitempty" yaml:"forall,omitempty"`
+	None      []condition   `json:"none,omitempty" yaml:"none,omitempty"`
+	Aggregate *aggregate    `json:"aggregate,omitempty" yaml:"aggregate,omitempty"`
+}
+
+type aggregate struct {
+	Function   string      `json:"function" yaml:"function"`
+	Of         string      `json:"of,omitempty" yaml:"of,omitempty"`
+	Into       string      `json:"into,omitempty" yaml:"into,omitempty"`
+	Conditions []condition `json:"if" yaml:"if"`
+}
+
+//aggregated is the form in which an aggregate is written, with the test of its result if any
+type aggregated struct {
+	Aggregate *aggregate `json:"aggregate" yaml:"aggregate"`
+	Operator  string     `json:"op,omitempty" yaml:"op,omitempty"`
+	Value     *term      `json:"value,omitempty" yaml:"value,omitempty"`
+}
+
+//group is the form in which a condition with alternatives, a forall condition or a negated
+//group is written
+type group struct {
+	Any    [][]condition `json:"any,omitempty" yaml:"any,omitempty"`
+	ForAll []condition   `json:"forall,omitempty" yaml:"forall,omitempty"`
+	None   []condition   `json:"none,omitempty" yaml:"none,omitempty"`
+}
+
+//plain is a condition without its methods, for writing it as usual
+type plain condition
+
+type inference struct {
+	ObjectId  term   `json:"object" yaml:"object"`
+	Attribute string `json:"attribute" yaml:"attribute"`
+	Value     term   `json:"value" yaml:"value"`
+}
+
+type modification struct {
+	Target term `json:"target" yaml:"target"`
+	Value  term `json:"value" yaml:"value"`
+}
+
+//a term is a string, Variable, int, float64, bool, time.Time, time.Duration or Null (or nil)
+type term struct {
+	value interface{}
+}
+
+var operators = []engine.Operator{engine.EQ, engine.GE, engine.GT, engine.LE, engine.LT, engine.NE}
+
+//WriteJSON writes rules as an indented JSON document
+func WriteJSON(w io.Writer, rules []engine.Rule) error {
+
+	doc, err := fromRules(rules)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+//ReadJSON reads the rules of a JSON document; unknown fields are errors
+func ReadJSON(r io.Reader) ([]engine.Rule, error) {
+
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var doc document
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc.toRules()
+}
+
+//WriteYAML writes rules as a YAML document
+func WriteYAML(w io.Writer, rules []engine.Rule) error {
+
+	doc, err := fromRules(rules)
+	if err != nil {
+		return err
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	err = encoder.Encode(doc)
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+//ReadYAML reads the rules of a YAML document; unknown fields are errors
+func ReadYAML(r io.Reader) ([]engine.Rule, error) {
+
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	var doc document
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc.toRules()
+}
+
+//LoadRules reads a rule file and defines every rule in the engine. The format is
+//YAML if the file name ends in .yaml or .yml, and JSON otherwise. If a rule cannot be
+//defined, the rules defined before it are undefined again and the error is returned, so
+//the file is loaded whole or not at all.
+func LoadRules(e *engine.Engine, filename string) ([]engine.Rule, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []engine.Rule
+	if isYAML(filename) {
+		rules, err = ReadYAML(f)
+	} else {
+		rules, err = ReadJSON(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	for i, r := range rules {
+		err = e.Define(r)
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("%s: rule %s: %s", filename, r.Id, err)
+		for j := i - 1; j >= 0; j-- {
+			undefineErr := e.Undefine(rules[j].Id)
+			if undefineErr != nil {
+				return nil, fmt.Errorf("%s (and undefining %s: %s)", err, rules[j].Id, undefineErr)
+			}
+		}
+		return nil, err
+	}
+	return rules, nil
+}
+
+//SaveRules writes the rules defined in the engine to a file, in YAML if the file name
+//ends in .yaml or .yml, and JSON otherwise
+func SaveRules(e *engine.Engine, filename string) error {
+
+	var buf bytes.Buffer
+	var err error
+	if isYAML(filename) {
+		err = WriteYAML(&buf, e.Rules())
+	} else {
+		err = WriteJSON(&buf, e.Rules())
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+func isYAML(filename string) bool {
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+func fromRules(rules []engine.Rule) (*document, error) {
+
+	doc := &document{Version: Version, Rules: make([]rule, 0, len(rules))}
+	for _, r := range rules {
+		out := rule{Id: r.Id, Salience: r.Salience}
+		terms := func(values ...interface{}) ([]term, error) {
+			list := make([]term, len(values))
+			for i, v := range values {
+				t, err := newTerm(v)
+				if err != nil {
+					return nil, fmt.Errorf("rule %s: %s", r.Id, err)
+				}
+				list[i] = t
+			}
+			return list, nil
+		}
+		var conditions func(lhs []engine.Condition) ([]condition, error)
+		conditions = func(lhs []engine.Condition) ([]condition, error) {
+			var list []condition
+			for _, c := range lhs {
+				if c.Any != nil {
+					out := condition{}
+					for _, group := range c.Any {
+						g, err := conditions(group)
+						if err != nil {
+							return nil, err
+						}
+						out.Any = append(out.Any, g)
+					}
+					list = append(list, out)
+					continue
+				}
+				if c.ForAll != nil {
+					forall, err := conditions(c.ForAll)
+					if err != nil {
+						return nil, err
+					}
+					list = append(list, condition{ForAll: forall})
+					continue
+				}
+				if c.None != nil {
+					none, err := conditions(c.None)
+					if err != nil {
+						return nil, err
+					}
+					list = append(list, condition{None: none})
+					continue
+				}
+				if a := c.Aggregate; a != nil {
+					in, err := conditions(a.Conditions)
+					if err != nil {
+						return nil, err
+					}
+					t, err := terms(c.Value)
+					if err != nil {
+						return nil, err
+					}
+					out := condition{Value: t[0], Aggregate: &aggregate{Function: a.Function, Of: string(a.Of), Into: string(a.Into), Conditions: in}}
+					if c.Value != nil {
+						out.Operator = c.Comparator.String()
+					}
+					list = append(list, out)
+					continue
+				}
+				t, err := terms(c.ObjectId, c.Value)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, condition{
+					Label:     string(c.Label),
+					NotExists: c.NotExists,
+					ObjectId:  t[0],
+					Attribute: c.Attribute,
+					Operator:  c.Comparator.String(),
+					Value:     t[1],
+				})
+			}
+			return list, nil
+		}
+		var err error
+		out.LHS, err = conditions(r.LHS)
+		if err != nil {
+			return nil, err
+		}
+		for _, inf := range r.RHS {
+			t, err := terms(inf.ObjectId, inf.Value)
+			if err != nil {
+				return nil, err
+			}
+			out.RHS = append(out.RHS, inference{ObjectId: t[0], Attribute: inf.Attribute, Value: t[1]})
+		}
+		for _, a := range r.Actions {
+			out.Actions = append(out.Actions, a.Name)
+		}
+		for _, retraction := range r.Retractions {
+			t, err := terms(retraction.Target)
+			if err != nil {
+				return nil, err
+			}
+			out.Retractions = append(out.Retractions, t[0])
+		}
+		for _, m := range r.Modifications {
+			t, err := terms(m.Target, m.Value)
+			if err != nil {
+				return nil, err
+			}
+			out.Modifications = append(out.Modifications, modification{Target: t[0], Value: t[1]})
+		}
+		doc.Rules = append(doc.Rules, out)
+	}
+	return doc, nil
+}
+
+func (doc *document) toRules() ([]engine.Rule, error) {
+
+	if doc.Version != Version {
+		return nil, fmt.Errorf("document version %d is not supported", doc.Version)
+	}
+	var rules []engine.Rule
+	for _, in := range doc.Rules {
+		if in.Id == "" {
+			return nil, fmt.Errorf("rule %d has no id", len(rules))
+		}
+		r := engine.Rule{Id: in.Id, Salience: in.Salience}
+		for i, c := range in.LHS {
+			condition, err := c.toCondition()
+			if err != nil {
+				return nil, fmt.Errorf("rule %s, condition %d: %s", in.Id, i, err)
+			}
+			r.LHS = append(r.LHS, condition)
+		}
+		for _, inf := range in.RHS {
+			r.RHS = append(r.RHS, engine.Inference{ObjectId: inf.ObjectId.value, Attribute: inf.Attribute, Value: inf.Value.value})
+		}
+		for _, name := range in.Actions {
+			r.Actions = append(r.Actions, engine.Action{Name: name})
+		}
+		for _, t := range in.Retractions {
+			r.Retractions = append(r.Retractions, engine.Retraction{Target: t.value})
+		}
+		for _, m := range in.Modifications {
+			r.Modifications = append(r.Modifications, engine.Modification{Target: m.Target.value, Value: m.Value.value})
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func (c condition) toCondition() (engine.Condition, error) {
+
+	if c.Any != nil || c.ForAll != nil || c.None != nil {
+		groups := 0
+		for _, set := range []bool{c.Any != nil, c.ForAll != nil, c.None != nil} {
+			if set {
+				groups++
+			}
+		}
+		if c.Label != "" || c.NotExists || c.ObjectId.value != nil || c.Attribute != "" || c.Operator != "" || c.Value.value != nil || groups > 1 || c.Aggregate != nil {
+			return engine.Condition{}, fmt.Errorf("a condition with alternatives, forall or a negated group cannot have other fields")
+		}
+		out := engine.Condition{}
+		for _, group := range c.Any {
+			var list []engine.Condition
+			for _, in := range group {
+				condition, err := in.toCondition()
+				if err != nil {
+					return engine.Condition{}, err
+				}
+				list = append(list, condition)
+			}
+			out.Any = append(out.Any, list)
+		}
+		for _, in := range c.ForAll {
+			condition, err := in.toCondition()
+			if err != nil {
+				return engine.Condition{}, err
+			}
+			out.ForAll = append(out.ForAll, condition)
+		}
+		for _, in := range c.None {
+			condition, err := in.toCondition()
+			if err != nil {
+				return engine.Condition{}, err
+			}
+			out.None = append(out.None, condition)
+		}
+		return out, nil
+	}
+	if a := c.Aggregate; a != nil {
+		if c.Label != "" || c.NotExists || c.ObjectId.value != nil || c.Attribute != "" {
+			return engine.Condition{}, fmt.Errorf("an aggregate cannot have a label, not, object or attribute")
+		}
+		out := engine.Condition{Value: c.Value.value, Aggregate: &engine.Aggregate{Function: a.Function, Of: engine.Variable(a.Of), Into: engine.Variable(a.Into)}}
+		if c.Operator != "" || c.Value.value != nil {
+			op, err := parseOperator(c.Operator)
+			if err != nil {
+				return engine.Condition{}, err
+			}
+			out.Comparator = op
+		}
+		for _, in := range a.Conditions {
+			condition, err := in.toCondition()
+			if err != nil {
+				return engine.Condition{}, err
+			}
+			out.Aggregate.Conditions = append(out.Aggregate.Conditions, condition)
+		}
+		return out, nil
+	}
+	op, err := parseOperator(c.Operator)
+	if err != nil {
+		return engine.Condition{}, err
+	}
+	objectId := c.ObjectId.value
+	if objectId == nil {
+		objectId = "" //any object id
+	}
+	return engine.Condition{
+		NotExists:  c.NotExists,
+		ObjectId:   objectId,
+		Attribute:  c.Attribute,
+		Comparator: op,
+		Value:      c.Value.value,
+		Label:      engine.Variable(c.Label),
+	}, nil
+}
+
+func (c condition) MarshalJSON() ([]byte, error) {
+
+	if c.Any != nil || c.ForAll != nil || c.None != nil {
+		return json.Marshal(group{Any: c.Any, ForAll: c.ForAll, None: c.None})
+	}
+	if c.Aggregate != nil {
+		return json.Marshal(c.aggregated())
+	}
+	return json.Marshal(plain(c))
+}
+
+func (c condition) MarshalYAML() (interface{}, error) {
+
+	if c.Any != nil || c.ForAll != nil || c.None != nil {
+		return group{Any: c.Any, ForAll: c.ForAll, None: c.None}, nil
+	}
+	if c.Aggregate != nil {
+		return c.aggregated(), nil
+	}
+	return plain(c), nil
+}
+
+func (c condition) aggregated() aggregated {
+
+	a := aggregated{Aggregate: c.Aggregate, Operator: c.Operator}
+	if c.Value.value != nil {
+		a.Value = &c.Value
+	}
+	return a
+}
+
+func parseOperator(s string) (engine.Operator, error) {
+
+	for _, op := range operators {
+		if op.String() == s {
+			return op, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown operator %q", s)
+}
+
+//newTerm normalizes a value of a rule into a term
+func newTerm(v interface{}) (term, error) {
+
+	if v == nil {
+		return term{}, nil
+	}
+	switch e := v.(type) {
+	case engine.Variable, bool, time.Time, time.Duration, engine.NullValue:
+		return term{v}, nil
+	case engine.Expression:
+		normalized := engine.Expression{Function: e.Function}
+		for _, arg := range e.Args {
+			t, err := newTerm(arg)
+			if err != nil {
+				return term{}, err
+			}
+			normalized.Args = append(normalized.Args, t.value)
+		}
+		return term{normalized}, nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String:
+		return term{rv.String()}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return term{int(rv.Int())}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if rv.Uint() > math.MaxInt64 {
+			return term{}, fmt.Errorf("cannot write %d as an int", rv.Uint())
+		}
+		return term{int(rv.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		return term{rv.Float()}, nil
+	}
+	return term{}, fmt.Errorf("cannot write a value of type %T", v)
+}
+
+//formatFloat writes a float so that it is read back as a float
+func formatFloat(f float64) string {
+
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eEnN") { //NaN and Inf are left to fail
+		s += ".0"
+	}
+	return s
+}
+
+//parseNumber reads a number as an int, or as a float if it has a decimal point or an exponent
+func parseNumber(s string) (interface{}, error) {
+
+	if strings.ContainsAny(s, ".eE") {
+		return strconv.ParseFloat(s, 64)
+	}
+	n, err := strconv.ParseInt(s, 10, 0)
+	if err != nil {
+		return nil, err
+	}
+	return int(n), nil
+}
+
+//an objectTerm is a term written as an object with a single field (or, for an
+//expression, a function and its arguments)
+type objectTerm struct {
+	Var      string `json:"var,omitempty" yaml:"var,omitempty"`
+	Time     string `json:"time,omitempty" yaml:"time,omitempty"`
+	Duration string `json:"duration,omitempty" yaml:"duration,omitempty"`
+	Null     bool   `json:"null,omitempty" yaml:"null,omitempty"`
+	Call     string `json:"call,omitempty" yaml:"call,omitempty"`
+	Args     []term `json:"args,omitempty" yaml:"args,omitempty"`
+}
+
+//newObjectTerm returns the object form of a value, if it has one
+func newObjectTerm(v interface{}) (objectTerm, bool) {
+
+	switch v := v.(type) {
+	case engine.Variable:
+		return objectTerm{Var: string(v)}, true
+	case time.Time:
+		return objectTerm{Time: v.Format(time.RFC3339Nano)}, true
+	case time.Duration:
+		return objectTerm{Duration: v.String()}, true
+	case engine.NullValue:
+		return objectTerm{Null: true}, true
+	case engine.Expression:
+		o := objectTerm{Call: v.Function}
+		for _, arg := range v.Args {
+			o.Args = append(o.Args, term{arg}) //normalized by newTerm
+		}
+		return o, true
+	}
+	return objectTerm{}, false
+}
+
+func (o objectTerm) value() (interface{}, error) {
+
+	set := 0
+	for _, ok := range []bool{o.Var != "", o.Time != "", o.Duration != "", o.Null, o.Call != ""} {
+		if ok {
+			set++
+		}
+	}
+	switch {
+	case set != 1 || (o.Args != nil && o.Call == ""):
+		return nil, fmt.Errorf("a term object must have one of var, time, duration, null: true or call (with args)")
+	case o.Var != "":
+		return engine.Variable(o.Var), nil
+	case o.Time != "":
+		return time.Parse(time.RFC3339Nano, o.Time)
+	case o.Duration != "":
+		return time.ParseDuration(o.Duration)
+	case o.Null:
+		return engine.Null, nil
+	}
+	e := engine.Expression{Function: o.Call}
+	for _, arg := range o.Args {
+		e.Args = append(e.Args, arg.value)
+	}
+	return e, nil
+}
+
+func (t term) MarshalJSON() ([]byte, error) {
+
+	switch v := t.value.(type) {
+	case nil:
+		return []byte("null"), nil
+	case float64:
+		return []byte(formatFloat(v)), nil
+	}
+	if o, ok := newObjectTerm(t.value); ok {
+		return json.Marshal(o)
+	}
+	return json.Marshal(t.value)
+}
+
+func (t *term) UnmarshalJSON(data []byte) error {
+
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		t.value = nil
+	case bytes.Equal(data, []byte("true")), bytes.Equal(data, []byte("false")):
+		t.value = data[0] == 't'
+	case len(data) > 0 && data[0] == '"':
+		var s string
+		err := json.Unmarshal(data, &s)
+		if err != nil {
+			return err
+		}
+		t.value = s
+	case len(data) > 0 && data[0] == '{':
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		var o objectTerm
+		err := decoder.Decode(&o)
+		if err != nil {
+			return err
+		}
+		t.value, err = o.value()
+		if err != nil {
+			return err
+		}
+	default:
+		n, err := parseNumber(string(data))
+		if err != nil {
+			return fmt.Errorf("cannot read %s as a term", data)
+		}
+		t.value = n
+	}
+	return nil
+}
+
+func (t term) MarshalYAML() (interface{}, error) {
+
+	switch v := t.value.(type) {
+	case nil:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v)}, nil
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}, nil
+	case int:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(v)}, nil
+	case float64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: formatFloat(v)}, nil
+	}
+	if o, ok := newObjectTerm(t.value); ok {
+		return o, nil
+	}
+	return nil, fmt.Errorf("cannot write a value of type %T", t.value)
+}
+
+func (t *term) UnmarshalYAML(node *yaml.Node) error {
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		var o objectTerm
+		err := node.Decode(&o)
+		if err != nil {
+			return err
+		}
+		if len(node.Content) != 2 && (len(node.Content) != 4 || o.Call == "") {
+			return fmt.Errorf("line %d: a term object must have a single field", node.Line)
+		}
+		t.value, err = o.value()
+		if err != nil {
+			return fmt.Errorf("line %d: %s", node.Line, err)
+		}
+		return nil
+	case yaml.ScalarNode:
+		switch node.ShortTag() {
+		case "!!null":
+			t.value = nil
+			return nil
+		case "!!str":
+			t.value = node.Value
+			return nil
+		case "!!bool":
+			b, err := strconv.ParseBool(node.Value)
+			if err != nil {
+				return fmt.Errorf("line %d: %s", node.Line, err)
+			}
+			t.value = b
+			return nil
+		case "!!int", "!!float":
+			n, err := parseNumber(node.Value)
+			if err != nil {
+				return fmt.Errorf("line %d: %s", node.Line, err)
+			}
+			t.value = n
+			return nil
+		}
+	}
+	return fmt.Errorf("line %d: cannot read %q as a term", node.Line, node.Value)
+}
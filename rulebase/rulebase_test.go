@@ -0,0 +1,237 @@
+package rulebase
+
+import "bytes"
+import "os"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "testing"
+import "time"
+
+import "github.com/Alan-Shaw/goference/engine"
+
+func testRules() []engine.Rule {
+
+	var o engine.Variable = "o"
+	var f engine.Variable = "f"
+	var w engine.Variable = "w"
+
+	return []engine.Rule{
+		engine.Rule{
+			Id:       "ship",
+			Salience: 10,
+			LHS: []engine.Condition{
+				engine.Condition{Label: f, ObjectId: o, Attribute: "status", Comparator: engine.EQ, Value: "new"},
+				engine.Condition{NotExists: true, ObjectId: "", Attribute: "halt", Comparator: engine.EQ, Value: "3"},
+				engine.Condition{ObjectId: o, Attribute: "weight", Comparator: engine.LT, Value: 2.0},
+				engine.Condition{ObjectId: o, Attribute: "size", Comparator: engine.GE, Value: 2},
+				engine.Condition{ObjectId: o, Attribute: "net", Comparator: engine.EQ, Value: w},
+			},
+			RHS: []engine.Inference{
+				engine.Inference{ObjectId: o, Attribute: "shipped", Value: 1},
+				engine.Inference{ObjectId: "log", Attribute: "weight", Value: w},
+				engine.Inference{ObjectId: "log", Attribute: "name", Value: "?o"},
+			},
+			Actions:       []engine.Action{engine.Action{Name: "notify"}},
+			Retractions:   []engine.Retraction{engine.Retraction{Target: 3}},
+			Modifications: []engine.Modification{engine.Modification{Target: f, Value: 1e21}},
+		},
+		engine.Rule{
+			Id:  "plain",
+			LHS: []engine.Condition{engine.Condition{ObjectId: "box", Attribute: "size", Comparator: engine.NE, Value: -0.5}},
+			RHS: []engine.Inference{engine.Inference{ObjectId: "box", Attribute: "odd", Value: "yes"}},
+		},
+		engine.Rule{
+			Id: "typed",
+			LHS: []engine.Condition{
+				engine.Condition{ObjectId: o, Attribute: "paid", Comparator: engine.EQ, Value: true},
+				engine.Condition{ObjectId: o, Attribute: "due", Comparator: engine.LT, Value: time.Date(2024, 3, 1, 12, 30, 0, 500, time.UTC)},
+				engine.Condition{ObjectId: o, Attribute: "delay", Comparator: engine.GE, Value: 90 * time.Minute},
+				engine.Condition{ObjectId: o, Attribute: "note", Comparator: engine.NE, Value: engine.Null},
+				engine.Condition{ObjectId: o, Attribute: "extra", Comparator: engine.EQ, Value: nil},
+			},
+			RHS: []engine.Inference{
+				engine.Inference{ObjectId: o, Attribute: "late", Value: false},
+				engine.Inference{ObjectId: engine.Call("concat", "log:", o), Attribute: "due", Value: engine.Call("add", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), engine.Call("neg", time.Hour))},
+			},
+		},
+		engine.Rule{
+			Id: "either",
+			LHS: []engine.Condition{
+				engine.Condition{ObjectId: o, Attribute: "status", Comparator: engine.EQ, Value: "new"},
+				engine.Condition{Any: [][]engine.Condition{
+					[]engine.Condition{engine.Condition{ObjectId: o, Attribute: "paid", Comparator: engine.EQ, Value: true}},
+					[]engine.Condition{
+						engine.Condition{ObjectId: o, Attribute: "credit", Comparator: engine.GT, Value: 0},
+						engine.Condition{Any: [][]engine.Condition{
+							[]engine.Condition{engine.Condition{ObjectId: o, Attribute: "vip", Comparator: engine.EQ, Value: true}},
+							[]engine.Condition{engine.Condition{NotExists: true, ObjectId: "", Attribute: "halt", Comparator: engine.EQ, Value: nil}},
+						}},
+					},
+				}},
+				engine.Condition{ForAll: []engine.Condition{
+					engine.Condition{ObjectId: w, Attribute: "item-of", Comparator: engine.EQ, Value: o},
+					engine.Condition{ObjectId: w, Attribute: "stock", Comparator: engine.GT, Value: 0},
+				}},
+			},
+			RHS: []engine.Inference{engine.Inference{ObjectId: o, Attribute: "release", Value: true}},
+		},
+		engine.Rule{
+			Id: "totals",
+			LHS: []engine.Condition{
+				engine.Condition{ObjectId: o, Attribute: "status", Comparator: engine.EQ, Value: "new"},
+				engine.Condition{Comparator: engine.GT, Value: 1000, Aggregate: &engine.Aggregate{Function: "sum", Of: "v", Into: "total", Conditions: []engine.Condition{
+					engine.Condition{ObjectId: w, Attribute: "item-of", Comparator: engine.EQ, Value: o},
+					engine.Condition{ObjectId: w, Attribute: "price", Comparator: engine.EQ, Value: engine.Variable("v")},
+				}}},
+				engine.Condition{Aggregate: &engine.Aggregate{Function: "count", Conditions: []engine.Condition{
+					engine.Condition{ObjectId: w, Attribute: "item-of", Comparator: engine.EQ, Value: o},
+				}}},
+				engine.Condition{None: []engine.Condition{
+					engine.Condition{ObjectId: w, Attribute: "item-of", Comparator: engine.EQ, Value: o},
+					engine.Condition{ObjectId: w, Attribute: "stock", Comparator: engine.EQ, Value: 0},
+				}},
+			},
+			RHS: []engine.Inference{engine.Inference{ObjectId: o, Attribute: "total", Value: engine.Variable("total")}},
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+
+	rules := testRules()
+
+	var buf bytes.Buffer
+	err := WriteJSON(&buf, rules)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	fromJSON, err := ReadJSON(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !reflect.DeepEqual(rules, fromJSON) {
+		t.Errorf("Test 1 JSON: expected\n%#v\ngot\n%#v\n", rules, fromJSON)
+	}
+
+	buf.Reset()
+	err = WriteYAML(&buf, rules)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	text := buf.String()
+	fromYAML, err := ReadYAML(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !reflect.DeepEqual(rules, fromYAML) {
+		t.Errorf("Test 2 YAML: expected\n%#v\ngot\n%#v\n%s", rules, fromYAML, text)
+	}
+
+	//other integer and float types are normalized
+	rules[1].LHS[0].Value = float32(0.5)
+	rules[1].RHS[0].Value = uint16(7)
+	buf.Reset()
+	err = WriteJSON(&buf, rules)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	normalized, err := ReadJSON(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if normalized[1].LHS[0].Value != 0.5 || normalized[1].RHS[0].Value != 7 {
+		t.Errorf("Test 3 normalized: got %#v and %#v\n", normalized[1].LHS[0].Value, normalized[1].RHS[0].Value)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+
+	for i, src := range []string{
+		`{"version": 2, "rules": []}`,
+		`{"version": 1, "rules": [{"id": "r", "if": [{"object": "", "attribute": "a", "op": "EQ", "value": 1, "extra": 1}]}]}`,
+		`{"version": 1, "rules": [{"id": "r", "if": [{"object": "", "attribute": "a", "op": "==", "value": 1}]}]}`,
+		`{"version": 1, "rules": [{"id": "r", "if": [{"object": {"var": ""}, "attribute": "a", "op": "EQ", "value": 1}]}]}`,
+		`{"version": 1, "rules": [{"id": "r", "if": [{"object": "", "attribute": "a", "op": "EQ", "value": [1]}]}]}`,
+		`{"version": 1, "rules": [{"if": []}]}`,
+		`{"version": 1, "rules": [{"id": "r", "if": [{"object": "", "attribute": "a", "op": "EQ", "value": {"null": false}}]}]}`,
+		`{"version": 1, "rules": [{"id": "r", "if": [{"object": "", "attribute": "a", "op": "EQ", "value": {"var": "x", "duration": "1s"}}]}]}`,
+		`{"version": 1, "rules": [{"id": "r", "if": [{"object": "", "attribute": "a", "op": "EQ", "value": {"time": "yesterday"}}]}]}`,
+		`{"version": 1, "rules": [{"id": "r", "if": [{"object": "", "attribute": "a", "op": "EQ", "value": {"var": "x", "args": [1]}}]}]}`,
+		`{"version": 1, "rules": [{"id": "r", "if": [{"attribute": "a", "any": [[{"object": "", "attribute": "a", "op": "EQ", "value": 1}]]}]}]}`,
+		`{"version": 1, "rules": [{"id": "r", "if": [{"any": [[{"object": "", "attribute": "a", "op": "=", "value": 1}]]}]}]}`,
+		`{"version": 1, "rules": [{"id": "r", "if": [{"not": true, "forall": [{"object": "", "attribute": "a", "op": "EQ", "value": 1}]}]}]}`,
+		`{"version": 1, "rules": [{"id": "r", "if": [{"attribute": "a", "aggregate": {"function": "count", "if": [{"object": "", "attribute": "a", "op": "EQ", "value": 1}]}}]}]}`,
+		`{"version": 1, "rules": [{"id": "r", "if": [{"aggregate": {"function": "count", "if": [{"object": "", "attribute": "a", "op": "EQ", "value": 1}]}, "value": 3}]}]}`,
+		`{"version": 1, "rules": [{"id": "r", "if": [{"forall": [{"object": "", "attribute": "a", "op": "EQ", "value": 1}], "none": [{"object": "", "attribute": "a", "op": "EQ", "value": 1}]}]}]}`,
+	} {
+		_, err := ReadJSON(strings.NewReader(src))
+		if err == nil {
+			t.Errorf("Test %d: expected an error reading %s\n", i+1, src)
+		}
+	}
+	_, err := ReadYAML(strings.NewReader("version: 1\nrules:\n  - id: r\n    if:\n      - {object: \"\", attribute: a, op: EQ, value: [1]}\n"))
+	if err == nil {
+		t.Errorf("Test YAML: expected an error reading a list\n")
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+
+	dir := t.TempDir()
+	source := &engine.Engine{}
+	err := source.RegisterAction("notify", func(ruleId string, bindings engine.Bindings) error { return nil }, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, r := range testRules() {
+		err = source.Define(r)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	for _, name := range []string{"rules.json", "rules.yaml"} {
+		filename := filepath.Join(dir, name)
+		err = SaveRules(source, filename)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		target := &engine.Engine{}
+		err = target.RegisterAction("notify", func(ruleId string, bindings engine.Bindings) error { return nil }, nil)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		rules, err := LoadRules(target, filename)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !reflect.DeepEqual(rules, target.Rules()) || !reflect.DeepEqual(rules, source.Rules()) {
+			t.Errorf("Test %s: the rules were not defined as saved\n", name)
+		}
+
+		//an action that is not registered stops the loading
+		_, err = LoadRules(&engine.Engine{}, filename)
+		if err == nil {
+			t.Errorf("Test %s: expected an error for an unregistered action\n", name)
+		}
+	}
+
+	//the rules defined before a rule that fails are undefined again
+	rules := testRules()
+	filename := filepath.Join(dir, "last.json")
+	var buf bytes.Buffer
+	err = WriteJSON(&buf, append(rules[1:], rules[0]))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = os.WriteFile(filename, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	target := &engine.Engine{}
+	loaded, err := LoadRules(target, filename)
+	if err == nil || loaded != nil || len(target.Rules()) != 0 {
+		t.Errorf("Test partial: expected an error and no rules, got %v %v %v\n", err, loaded, target.Rules())
+	}
+}